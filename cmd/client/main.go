@@ -28,12 +28,79 @@ func main() {
 				Value: -1,
 				Usage: "The length of the sequence of numbers the server should send",
 			},
+			&cli.BoolFlag{
+				Name:  "infinite",
+				Value: false,
+				Usage: "Stream numbers until interrupted (Ctrl+C) instead of requesting a fixed length sequence, overrides sequence-count",
+			},
+			&cli.StringFlag{
+				Name:  "generator",
+				Value: "",
+				Usage: "The sequence generator the server should use (seeded, crypto, counter or file), defaults to the server's configured generator",
+			},
+			&cli.StringFlag{
+				Name:  "transport",
+				Value: "websocket",
+				Usage: "The transport to receive the sequence over (websocket, sse, poll or tcp)",
+			},
+			&cli.IntFlag{
+				Name:  "batch-size",
+				Value: 0,
+				Usage: "The number of numbers the server should send together in a single frame over websocket or tcp, 0 to receive numbers individually",
+			},
+			&cli.IntFlag{
+				Name:  "batch-interval",
+				Value: 100,
+				Usage: "The number of milliseconds the server should wait for a batch to fill before sending it",
+			},
+			&cli.IntFlag{
+				Name:  "result-timeout",
+				Value: 300,
+				Usage: "The number of seconds to wait for the full sequence before giving up, 0 to wait indefinitely",
+			},
+			&cli.StringFlag{
+				Name:  "state-file",
+				Value: "",
+				Usage: "Path to a new file to record the session in so it can be resumed with --resume if the client exits early",
+			},
+			&cli.StringFlag{
+				Name:  "resume",
+				Value: "",
+				Usage: "Path to a state file recorded with --state-file to resume the session from, overrides sequence-count and generator",
+			},
+			&cli.BoolFlag{
+				Name:  "tls",
+				Value: false,
+				Usage: "Whether to connect to the server over TLS (wss or https)",
+			},
+			&cli.StringFlag{
+				Name:  "ca-bundle",
+				Value: "",
+				Usage: "Path to a PEM encoded CA bundle used to verify the server certificate, defaults to the system's root CAs",
+			},
+			&cli.BoolFlag{
+				Name:  "insecure-skip-verify",
+				Value: false,
+				Usage: "Skip verification of the server certificate, only use this for local development",
+			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			host := cCtx.String("server-host")
-			port := cCtx.Int("server-port")
-			sequenceCount := cCtx.Int("sequence-count")
-			return clientapp.Run(host, port, sequenceCount)
+			return clientapp.Run(&clientapp.Options{
+				ServerHost:         cCtx.String("server-host"),
+				ServerPort:         cCtx.Int("server-port"),
+				SequenceCount:      cCtx.Int("sequence-count"),
+				Infinite:           cCtx.Bool("infinite"),
+				Generator:          cCtx.String("generator"),
+				Transport:          cCtx.String("transport"),
+				BatchSize:          cCtx.Int("batch-size"),
+				BatchInterval:      cCtx.Int("batch-interval"),
+				ResultTimeout:      cCtx.Int("result-timeout"),
+				StateFile:          cCtx.String("state-file"),
+				ResumeFile:         cCtx.String("resume"),
+				UseTLS:             cCtx.Bool("tls"),
+				CABundleFile:       cCtx.String("ca-bundle"),
+				InsecureSkipVerify: cCtx.Bool("insecure-skip-verify"),
+			})
 		},
 	}
 
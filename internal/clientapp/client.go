@@ -1,16 +1,49 @@
 package clientapp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/client"
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/config"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 )
 
-func Run(serverHost string, serverPort int, sequenceCount int) error {
+type Options struct {
+	ServerHost    string
+	ServerPort    int
+	SequenceCount int
+	// Streams numbers until the process is interrupted.
+	Infinite  bool
+	Generator string
+	// One of websocket, sse, poll or tcp.
+	Transport string
+	// Numbers are received individually when the batch size is 0.
+	BatchSize     int
+	BatchInterval int
+	ResultTimeout int
+	// Optional, a new file to record the session in so it can be resumed
+	// if the client process exits before the sequence is complete.
+	StateFile string
+	// Optional, a state file recorded by a previous client process to resume
+	// the session from, the client ID, sequence count and generator are taken from the file.
+	ResumeFile string
+	// TLS options.
+	UseTLS             bool
+	CABundleFile       string
+	InsecureSkipVerify bool
+}
+
+func Run(opts *Options) error {
 	err := godotenv.Load(".env.client")
 	if err != nil {
 		log.Fatal("Failed to load environment variables: ", err)
@@ -32,19 +65,113 @@ func Run(serverHost string, serverPort int, sequenceCount int) error {
 	}
 	logger.SetLevel(logLevel)
 
+	var tlsConfig *tls.Config
+	if opts.UseTLS {
+		tlsConfig, err = client.NewTLSConfig(opts.CABundleFile, opts.InsecureSkipVerify)
+		if err != nil {
+			log.Fatal("Failed to load TLS configuration for client: ", err)
+		}
+	}
+
+	if opts.Infinite && (opts.StateFile != "" || opts.ResumeFile != "") {
+		log.Fatal("State files are only supported for sequences of a fixed length")
+	}
+
+	var state *stateFile
+	var clientID *string
+	var token string
+	var receivedNumbers []uint32
+	sequenceCount := opts.SequenceCount
+	generator := opts.Generator
+	if opts.ResumeFile != "" {
+		var header *stateFileHeader
+		state, header, receivedNumbers, err = openStateFile(opts.ResumeFile)
+		if err != nil {
+			log.Fatal("Failed to load state file: ", err)
+		}
+		if header.SequenceCount > -1 && len(receivedNumbers) >= header.SequenceCount {
+			log.Fatal("State file already holds the full sequence")
+		}
+		clientID = &header.ClientID
+		sequenceCount = header.SequenceCount
+		generator = header.Generator
+		token = header.Token
+		logger.Info("resuming session ", header.ClientID, " after ", len(receivedNumbers), " numbers")
+	} else if opts.StateFile != "" {
+		newClientID := uuid.New().String()
+		clientID = &newClientID
+		// The token is requested up front so it is recorded before the session exists,
+		// over raw TCP a resumed session can only be authenticated when tokens are not required.
+		if opts.Transport != client.TransportTCP {
+			token, err = client.RequestToken(&client.ClientParams{
+				ServerHost: opts.ServerHost,
+				ServerPort: opts.ServerPort,
+				Transport:  opts.Transport,
+				UseTLS:     opts.UseTLS,
+				TLSConfig:  tlsConfig,
+			}, newClientID)
+			if err != nil && !errors.Is(err, client.ErrTokensNotRequired) {
+				log.Fatal("Failed to request client token: ", err)
+			}
+		}
+		state, err = createStateFile(opts.StateFile, &stateFileHeader{
+			ClientID:      newClientID,
+			SequenceCount: sequenceCount,
+			Generator:     generator,
+			Token:         token,
+		})
+		if err != nil {
+			log.Fatal("Failed to create state file: ", err)
+		}
+	}
+	if state != nil {
+		defer state.Close()
+	}
+
+	// Infinite sequences only end when interrupted so there is nothing to time out.
+	resultTimeout := opts.ResultTimeout
+	if opts.Infinite {
+		resultTimeout = 0
+	}
+
 	// The client implementation is currently limited to run as a one-off client-side
 	// connection/session, in the future this could be expanded to manage multiple connections
 	// with a single client implementation.
 	clientInstance := client.NewDefaultClient(
 		&client.ClientParams{
-			ServerHost:            serverHost,
-			ServerPort:            serverPort,
+			ServerHost:            opts.ServerHost,
+			ServerPort:            opts.ServerPort,
 			SequenceCount:         sequenceCount,
+			Infinite:              opts.Infinite,
+			Generator:             generator,
+			Transport:             opts.Transport,
+			BatchSize:             opts.BatchSize,
+			BatchInterval:         opts.BatchInterval,
 			SendLastReceivedIndex: conf.SendLastReceivedIndex,
 			MaxReconnectAttempts:  conf.MaxReconnectAttempts,
+			ResultTimeout:         resultTimeout,
+			Heartbeat: &utils.HeartbeatParams{
+				PingInterval: conf.PingInterval,
+				PongTimeout:  conf.PongTimeout,
+			},
+			UseTLS:           opts.UseTLS,
+			TLSConfig:        tlsConfig,
+			OverrideClientID: clientID,
+			ReceivedNumbers:  receivedNumbers,
+			Token:            token,
 		},
 		logger,
 	)
+	if state != nil {
+		// Numbers are passed to the handler in order exactly once so the file
+		// always holds the sequence from the start without gaps.
+		clientInstance.OnNumber(func(index int, number uint32) {
+			err := state.appendNumber(number)
+			if err != nil {
+				logger.Error("failed to record number in state file: ", err)
+			}
+		})
+	}
 
 	err = clientInstance.Connect()
 	if err != nil {
@@ -52,16 +179,39 @@ func Run(serverHost string, serverPort int, sequenceCount int) error {
 	}
 	defer clientInstance.Close()
 
-	result := clientInstance.Result()
+	if opts.Infinite {
+		go stopOnInterrupt(clientInstance, logger)
+	}
+
+	result := clientInstance.Result(context.Background())
 	printResult(result)
 	return nil
 }
 
+func stopOnInterrupt(clientInstance client.Client, logger *logrus.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	signal.Stop(signals)
+
+	logger.Info("stopping the sequence")
+	err := clientInstance.Stop()
+	if err != nil {
+		logger.Error("failed to stop the sequence: ", err)
+	}
+}
+
 func printResult(result client.Result) {
 	fmt.Print("Result\n____________\n\n\n")
 	fmt.Printf("Client-side Checksum: %s\n", result.Checksum)
 	fmt.Printf("Server-provided Checksum: %s\n", result.ServerChecksum)
 	fmt.Printf("Successful: %v\n", result.Success)
+	if result.Generator != "" {
+		fmt.Printf("Generator: %s\n", result.Generator)
+	}
+	if result.Seed != nil {
+		fmt.Printf("Seed: %d\n", *result.Seed)
+	}
 	if result.Error != nil {
 		fmt.Printf("Error: %s\n", result.Error)
 	}
@@ -0,0 +1,119 @@
+package clientapp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+// The first line of a state file, every number received
+// follows as a little-endian uint32 in order of index.
+type stateFileHeader struct {
+	ClientID      string `json:"clientId"`
+	SequenceCount int    `json:"sequenceCount"`
+	Generator     string `json:"generator,omitempty"`
+	// Only recorded when the server requires clients to authenticate.
+	Token string `json:"token,omitempty"`
+}
+
+// An append-only record of the numbers received for a session so a restarted
+// client process can resume the session where the previous process left off.
+type stateFile struct {
+	file *os.File
+}
+
+// Creates a new state file, an existing file is never overwritten
+// as it may hold a session that can still be resumed.
+func createStateFile(path string, header *stateFileHeader) (*stateFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	_, err = file.Write(append(headerBytes, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &stateFile{file: file}, nil
+}
+
+// Reads the header and numbers from an existing state file and opens it
+// to record further numbers. A number that was only partially written before
+// the previous process exited is discarded.
+func openStateFile(path string) (*stateFile, *stateFileHeader, []uint32, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	header, numbers, size, err := readStateFile(file)
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+	return &stateFile{file: file}, header, numbers, nil
+}
+
+// Returns the size of the complete records in the file along with their contents.
+func readStateFile(file *os.File) (*stateFileHeader, []uint32, int64, error) {
+	reader := bufio.NewReader(file)
+	headerLine, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, 0, errors.New("missing header")
+	}
+	header := &stateFileHeader{}
+	err = json.Unmarshal(headerLine, header)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if header.ClientID == "" {
+		return nil, nil, 0, errors.New("header is missing a client ID")
+	}
+
+	numbers := []uint32{}
+	numberBytes := make([]byte, 4)
+	for {
+		_, err = io.ReadFull(reader, numberBytes)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		numbers = append(numbers, utils.ByteArrayToSingleUint32(numberBytes))
+	}
+	return header, numbers, int64(len(headerLine)) + 4*int64(len(numbers)), nil
+}
+
+// Appends a number and waits for it to reach the disk.
+func (f *stateFile) appendNumber(number uint32) error {
+	_, err := f.file.Write(utils.Uint32ToByteArray([]uint32{number}))
+	if err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *stateFile) Close() error {
+	return f.file.Close()
+}
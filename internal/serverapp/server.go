@@ -1,20 +1,32 @@
 package serverapp
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/admin"
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/config"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/metrics"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/server"
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 
 	"github.com/joho/godotenv"
 )
 
+const adminPathPrefix = "/admin"
+
 func Run(port int) error {
 	err := godotenv.Load(".env.server")
 	if err != nil {
@@ -47,22 +59,193 @@ func Run(port int) error {
 	}
 	logger.SetLevel(logLevel)
 
-	store := sessions.NewInMemoryStore(
-		&sessions.InMemoryStoreParams{
-			ExpireAfterIdleTime: conf.SessionStateIdleTimeExpiry,
-		},
-		logger,
-	)
+	store, err := createSessionStore(conf, logger)
+	if err != nil {
+		log.Fatal("Failed to create session store: ", err)
+	}
+	defer store.Close()
+
+	generator, err := createSequenceGenerator(conf.SequenceGenerator, conf)
+	if err != nil {
+		log.Fatal("Failed to create sequence generator: ", err)
+	}
+	selectableGenerators := []sequence.SequenceGenerator{}
+	for _, name := range conf.ClientSelectableGenerators {
+		selectable, err := createSequenceGenerator(name, conf)
+		if err != nil {
+			log.Fatal("Failed to create sequence generator: ", err)
+		}
+		selectableGenerators = append(selectableGenerators, selectable)
+	}
 
+	registry := metrics.NewRegistry()
 	srv := server.NewDefaultServer(
 		&server.ServerParams{
-			SequenceMessageInterval: conf.SequenceMessageInterval,
+			SequenceMessageInterval:    conf.SequenceMessageInterval,
+			MinSequenceMessageInterval: conf.MinSequenceMessageInterval,
+			MaxSequenceMessageInterval: conf.MaxSequenceMessageInterval,
+			SendWindowSize:             conf.SendWindowSize,
+			RetransmitTimeout:          conf.RetransmitTimeout,
+			CheckpointInterval:         conf.CheckpointInterval,
+			MaxBatchSize:               conf.MaxBatchSize,
+			PollBatchSize:              conf.PollBatchSize,
+			PollTimeout:                conf.PollTimeout,
+			Heartbeat: &utils.HeartbeatParams{
+				PingInterval: conf.PingInterval,
+				PongTimeout:  conf.PongTimeout,
+			},
+			SequenceGenerator:     generator,
+			SelectableGenerators:  selectableGenerators,
+			Metrics:               registry,
+			SessionConflictPolicy: server.SessionConflictPolicy(conf.SessionConflictPolicy),
+			ClientTokenKeys:       createTokenKeys(conf.ClientTokenKeys),
 		},
 		store,
 		logger,
 	)
-	router.Handle("/", srv)
+	router.Handle("/metrics", registry).Methods(http.MethodGet)
+	if conf.AdminToken != "" {
+		router.PathPrefix(adminPathPrefix).Handler(admin.NewHandler(
+			&admin.HandlerParams{
+				Token:      conf.AdminToken,
+				PathPrefix: adminPathPrefix,
+			},
+			store,
+			logger,
+		))
+	}
+	// The server serves Server-Sent Events from its own paths alongside WebSockets.
+	router.PathPrefix("/").Handler(srv)
+
+	// Both the HTTP server and the TCP listener can fail.
+	serveErr := make(chan error, 2)
+	go func() {
+		if conf.TLSCertFile != "" {
+			log.Printf("Server listening with TLS on port %d ... \n", port)
+			serveErr <- httpSrv.ListenAndServeTLS(conf.TLSCertFile, conf.TLSKeyFile)
+			return
+		}
+		log.Printf("Server listening on port %d ... \n", port)
+		serveErr <- httpSrv.ListenAndServe()
+	}()
+
+	var tcpListener net.Listener
+	if conf.TCPPort > 0 {
+		tcpListener, err = listenTCP(conf)
+		if err != nil {
+			log.Fatal("Failed to listen for TCP connections: ", err)
+		}
+		log.Printf("Server listening for TCP connections on port %d ... \n", conf.TCPPort)
+		go func() {
+			serveErr <- srv.ServeTCP(tcpListener)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down ... \n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(conf.ShutdownGracePeriod)*time.Second,
+	)
+	defer cancel()
+
+	shutdown(ctx, httpSrv, tcpListener, srv, logger)
+
+	log.Println("Server shut down")
+	return nil
+}
+
+// Drains the connections served by srv while the HTTP server stops accepting new
+// connections. The HTTP server waits for event streams and long polls to return so
+// they must be told the server is going away before or while it shuts down, not after.
+func shutdown(
+	ctx context.Context,
+	httpSrv *http.Server,
+	tcpListener net.Listener,
+	srv server.Server,
+	logger *logrus.Logger,
+) {
+	drained := make(chan error, 1)
+	go func() {
+		drained <- srv.Shutdown(ctx)
+	}()
 
-	log.Printf("Server listening on port %d ... \n", port)
-	return httpSrv.ListenAndServe()
+	err := httpSrv.Shutdown(ctx)
+	if err != nil {
+		logger.Error("Failed to shut down HTTP server: ", err)
+	}
+	if tcpListener != nil {
+		tcpListener.Close()
+	}
+	err = <-drained
+	if err != nil {
+		logger.Error("Failed to drain connections: ", err)
+	}
+}
+
+func listenTCP(conf *config.Config) (net.Listener, error) {
+	address := fmt.Sprintf(":%d", conf.TCPPort)
+	if conf.TLSCertFile == "" {
+		return net.Listen("tcp", address)
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+func createSessionStore(conf *config.Config, logger *logrus.Logger) (sessions.SessionStore, error) {
+	if conf.SessionStore == "file" {
+		return sessions.NewFileStore(
+			&sessions.FileStoreParams{
+				ExpireAfterIdleTime: conf.SessionStateIdleTimeExpiry,
+				Path:                conf.SessionStoreFilePath,
+				CompactionInterval:  conf.SessionStoreCompactionInterval,
+				CleanupInterval:     conf.SessionStateCleanupInterval,
+				TombstoneTTL:        conf.SessionStateTombstoneTTL,
+			},
+			logger,
+		)
+	}
+
+	return sessions.NewInMemoryStore(
+		&sessions.InMemoryStoreParams{
+			ExpireAfterIdleTime: conf.SessionStateIdleTimeExpiry,
+			CleanupInterval:     conf.SessionStateCleanupInterval,
+			TombstoneTTL:        conf.SessionStateTombstoneTTL,
+		},
+		logger,
+	), nil
+}
+
+func createSequenceGenerator(name string, conf *config.Config) (sequence.SequenceGenerator, error) {
+	switch name {
+	case sequence.GeneratorCrypto:
+		return sequence.NewCryptoGenerator(), nil
+	case sequence.GeneratorCounter:
+		return sequence.NewCounterGenerator(), nil
+	case sequence.GeneratorFile:
+		return sequence.NewFileGenerator(conf.SequenceGeneratorFilePath)
+	default:
+		return sequence.NewSeededGenerator(conf.SequenceGeneratorSeed), nil
+	}
+}
+
+func createTokenKeys(keys []config.ClientTokenKey) []server.TokenKey {
+	tokenKeys := make([]server.TokenKey, 0, len(keys))
+	for _, key := range keys {
+		tokenKeys = append(tokenKeys, server.TokenKey{ID: key.ID, Secret: []byte(key.Secret)})
+	}
+	return tokenKeys
 }
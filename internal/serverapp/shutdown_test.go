@@ -0,0 +1,72 @@
+package serverapp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/server"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+func Test_shutdown_closes_event_streams_within_the_grace_period(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	srv := server.NewDefaultServer(&server.ServerParams{SequenceMessageInterval: 5}, store, logger)
+	testServer := httptest.NewServer(srv)
+	defer testServer.Close()
+
+	// Long enough that the stream would outlast the grace period if it was not closed.
+	resp, err := http.Get(testServer.URL + server.EventStreamPath + "?clientId=shutdown&sequenceCount=10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	_, err = utils.ReadEvent(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients end the stream once they have read the close event.
+	closeCodes := make(chan int, 1)
+	go func() {
+		defer resp.Body.Close()
+		for {
+			event, err := utils.ReadEvent(reader)
+			if err != nil {
+				close(closeCodes)
+				return
+			}
+			if event.Name == utils.EventClose {
+				closeMessage := &utils.EventStreamClose{}
+				json.Unmarshal([]byte(event.Data), closeMessage)
+				closeCodes <- closeMessage.Code
+				return
+			}
+		}
+	}()
+
+	gracePeriod := 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	start := time.Now()
+	shutdown(ctx, testServer.Config, nil, srv, logger)
+	if elapsed := time.Since(start); elapsed >= gracePeriod/2 {
+		t.Fatalf("expected the event stream to be drained promptly, shutdown took %s", elapsed)
+	}
+
+	code, received := <-closeCodes
+	if !received || code != websocket.CloseGoingAway {
+		t.Fatalf("expected a close event with code %d before the stream ended, received %d", websocket.CloseGoingAway, code)
+	}
+}
@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 1000
+)
+
+type HandlerParams struct {
+	// The bearer token that must be provided in the Authorization
+	// header of every request to the admin API.
+	Token string
+	// The path the admin API is mounted under, e.g. /admin.
+	PathPrefix string
+}
+
+type handler struct {
+	params *HandlerParams
+	store  sessions.SessionStore
+	logger *logrus.Logger
+}
+
+type listSessionsResponse struct {
+	Sessions []sessions.SessionSummary `json:"sessions"`
+	// The client ID to pass as the after query parameter to fetch the next page,
+	// omitted when there are no more sessions.
+	NextAfter string `json:"nextAfter,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler creates a handler for the admin API to inspect and manage
+// sessions held by the given store.
+func NewHandler(params *HandlerParams, store sessions.SessionStore, logger *logrus.Logger) http.Handler {
+	h := &handler{
+		params: params,
+		store:  store,
+		logger: logger,
+	}
+
+	router := mux.NewRouter()
+	sub := router.PathPrefix(params.PathPrefix).Subrouter()
+	sub.Use(h.authenticate)
+	sub.HandleFunc("/sessions", h.listSessions).Methods(http.MethodGet)
+	sub.HandleFunc("/sessions/{clientId}", h.getSession).Methods(http.MethodGet)
+	sub.HandleFunc("/sessions/{clientId}", h.deleteSession).Methods(http.MethodDelete)
+	sub.HandleFunc("/sessions/{clientId}/expire", h.expireSession).Methods(http.MethodPost)
+	sub.HandleFunc("/sessions/{clientId}/reset-acks", h.resetAcks).Methods(http.MethodPost)
+	return router
+}
+
+func (h *handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, hasScheme := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hasScheme || h.params.Token == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(h.params.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) listSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := DefaultPageSize
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			writeError(w, http.StatusBadRequest, "limit must be an integer between 1 and 1000")
+			return
+		}
+	}
+
+	// Fetch an extra session to find out whether there is another page.
+	summaries, err := h.store.List(query.Get("after"), limit+1)
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+
+	response := &listSessionsResponse{Sessions: summaries}
+	if len(summaries) > limit {
+		response.Sessions = summaries[:limit]
+		response.NextAfter = summaries[limit-1].ClientID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *handler) getSession(w http.ResponseWriter, r *http.Request) {
+	summary, err := h.store.Summary(mux.Vars(r)["clientId"])
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+func (h *handler) deleteSession(w http.ResponseWriter, r *http.Request) {
+	h.mutate(w, r, h.store.Delete)
+}
+
+func (h *handler) expireSession(w http.ResponseWriter, r *http.Request) {
+	h.mutate(w, r, h.store.Expire)
+}
+
+func (h *handler) resetAcks(w http.ResponseWriter, r *http.Request) {
+	h.mutate(w, r, h.store.ResetAcks)
+}
+
+func (h *handler) mutate(w http.ResponseWriter, r *http.Request, apply func(clientID string) error) {
+	clientID := mux.Vars(r)["clientId"]
+	err := apply(clientID)
+	if err != nil {
+		h.writeStoreError(w, err)
+		return
+	}
+	h.logger.Info("admin API ", r.Method, " ", r.URL.Path, " applied to session for client ", clientID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sessions.ErrSessionNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, sessions.ErrSessionExpired):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		h.logger.Error("admin API session store error: ", err)
+		writeError(w, http.StatusInternalServerError, "internal server error")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &errorResponse{Error: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/sirupsen/logrus"
+)
+
+const testToken = "test-token"
+
+func Test_admin_api_rejects_requests_without_a_valid_token(t *testing.T) {
+	testServer, _ := createTestAdminServer()
+	defer testServer.Close()
+
+	for _, token := range []string{"", "wrong-token"} {
+		resp := doRequest(t, testServer, http.MethodGet, "/admin/sessions", token)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for token %q, received %d", token, resp.StatusCode)
+		}
+	}
+}
+
+func Test_admin_api_rejects_tokens_without_the_bearer_scheme(t *testing.T) {
+	testServer, _ := createTestAdminServer()
+	defer testServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, testServer.URL+"/admin/sessions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a token without the bearer scheme, received %d", resp.StatusCode)
+	}
+}
+
+func Test_admin_api_pages_through_sessions(t *testing.T) {
+	testServer, store := createTestAdminServer()
+	defer testServer.Close()
+
+	for _, clientID := range []string{"client-a", "client-b", "client-c"} {
+		store.Initialise(clientID, sequence.List([]uint32{10, 20}), "")
+	}
+
+	page := &listSessionsResponse{}
+	resp := doRequest(t, testServer, http.MethodGet, "/admin/sessions?limit=2", testToken)
+	decodeBody(t, resp, page)
+	if len(page.Sessions) != 2 || page.NextAfter != "client-b" {
+		t.Fatalf("expected a first page of 2 sessions ending with client-b, received %+v", page)
+	}
+
+	nextAfter := page.NextAfter
+	page = &listSessionsResponse{}
+	resp = doRequest(t, testServer, http.MethodGet, "/admin/sessions?limit=2&after="+nextAfter, testToken)
+	decodeBody(t, resp, page)
+	if len(page.Sessions) != 1 || page.Sessions[0].ClientID != "client-c" || page.NextAfter != "" {
+		t.Fatalf("expected a final page containing client-c, received %+v", page)
+	}
+
+	resp = doRequest(t, testServer, http.MethodGet, "/admin/sessions?limit=0", testToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid limit, received %d", resp.StatusCode)
+	}
+}
+
+func Test_admin_api_manages_a_single_session(t *testing.T) {
+	testServer, store := createTestAdminServer()
+	defer testServer.Close()
+
+	store.Initialise("client-1", sequence.List([]uint32{10, 20, 30}), "")
+	store.Next("client-1", -1, true)
+	store.Ack("client-1", 0)
+
+	summary := &sessions.SessionSummary{}
+	resp := doRequest(t, testServer, http.MethodGet, "/admin/sessions/client-1", testToken)
+	decodeBody(t, resp, summary)
+	if summary.Length != 3 || summary.NextIndex != 1 || summary.Acknowledged != 1 || summary.Expired {
+		t.Fatalf("unexpected session summary %+v", summary)
+	}
+
+	resp = doRequest(t, testServer, http.MethodPost, "/admin/sessions/client-1/reset-acks", testToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204 resetting acks, received %d", resp.StatusCode)
+	}
+	stored, _ := store.Summary("client-1")
+	if stored.Acknowledged != 0 {
+		t.Fatalf("expected acknowledgements to be reset, received %+v", stored)
+	}
+
+	resp = doRequest(t, testServer, http.MethodPost, "/admin/sessions/client-1/expire", testToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204 expiring the session, received %d", resp.StatusCode)
+	}
+	_, err := store.Get("client-1")
+	if !errors.Is(err, sessions.ErrSessionExpired) {
+		t.Fatal("expected the session to be expired, received: ", err)
+	}
+
+	resp = doRequest(t, testServer, http.MethodDelete, "/admin/sessions/client-1", testToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204 deleting the session, received %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, testServer, http.MethodGet, "/admin/sessions/client-1", testToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status 404 for a deleted session, received %d", resp.StatusCode)
+	}
+}
+
+func createTestAdminServer() (*httptest.Server, sessions.SessionStore) {
+	logger := logrus.New()
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	handler := NewHandler(&HandlerParams{Token: testToken, PathPrefix: "/admin"}, store, logger)
+	return httptest.NewServer(handler), store
+}
+
+func doRequest(t *testing.T, testServer *httptest.Server, method string, path string, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, testServer.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func decodeBody(t *testing.T, resp *http.Response, target interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, received %d", resp.StatusCode)
+	}
+	err := json.NewDecoder(resp.Body).Decode(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,10 +1,14 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -16,11 +20,23 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// The most numbers held after a gap, numbers beyond this are ignored and left
+// for the server to resend. This could be made configurable.
+const maxOutOfOrderNumbers = 1000
+
 type Result struct {
+	// For infinite sequences the checksums are of the numbers
+	// covered by the last verified checkpoint.
 	Checksum       string
 	ServerChecksum string
 	Success        bool
 	Error          error
+	// The name of the generator the server used to create the sequence,
+	// only known when the handshake for the session has been received.
+	Generator string
+	// The seed the sequence was generated from, only provided for
+	// generators that can reproduce a sequence from a seed.
+	Seed *int64
 }
 
 type ClientParams struct {
@@ -29,6 +45,38 @@ type ClientParams struct {
 	SendLastReceivedIndex bool
 	MaxReconnectAttempts  int
 	SequenceCount         int
+	// Requests a sequence that is streamed until Stop is called,
+	// SequenceCount is ignored when this is set.
+	// Numbers are only kept in memory until they have been delivered and
+	// verified by a checkpoint so long-lived sessions use a bounded amount of memory.
+	Infinite bool
+	// Optional, the name of the generator the server should use to create
+	// the sequence, the server's default generator is used when empty.
+	Generator string
+	// Optional, the number of numbers to request the server sends together
+	// in a single frame, numbers are sent individually when this is 0.
+	// The server may reduce the batch size, batching only applies to WebSockets and raw TCP.
+	BatchSize int
+	// The number of milliseconds the server should wait for a batch to fill
+	// before sending it.
+	BatchInterval int
+	// Optional, heartbeats are disabled when not provided.
+	Heartbeat *utils.HeartbeatParams
+	// Optional, the transport to receive the sequence over,
+	// one of TransportWebSocket, TransportEventStream, TransportLongPoll or TransportTCP.
+	// WebSockets are used when not provided.
+	Transport string
+	// Whether to connect to the server over TLS (wss or https).
+	UseTLS bool
+	// Optional TLS configuration used when UseTLS is true,
+	// the default configuration is used when not provided.
+	TLSConfig *tls.Config
+	// Optional, the protocol versions to request in order of preference,
+	// every version supported by the client is requested when nil.
+	// An empty list requests no version in the same way as clients
+	// that predate protocol versioning.
+	// Only applies to WebSockets, the other transports always use the second version.
+	Subprotocols []string
 	// The following are primarily for providing a programmable interface
 	// for automated tests to simulate failure.
 	// These are references to allow for nil checks
@@ -36,32 +84,112 @@ type ClientParams struct {
 	// or 0 as valid inputs.
 	OverrideClientID          *string
 	OverrideLastReceivedIndex *int
+	// Optional, the numbers received by a previous client for the session identified
+	// by OverrideClientID, in order from the start of the sequence.
+	// Delivery resumes after the last of these, they are included in the checksum
+	// of the full sequence but are not passed to the number handler.
+	ReceivedNumbers []uint32
+	// Optional, the token authenticating the client as the owner of the session
+	// identified by OverrideClientID, the token is taken from the handshake
+	// of new sessions when not provided.
+	Token string
+	// The maximum number of seconds Result will wait for the sequence to complete,
+	// when this is 0 only the context passed into Result is used.
+	ResultTimeout int
 }
 
 type clientImpl struct {
-	params   *ClientParams
-	session  *sessionState
-	wsClient *websocket.Conn
-	logger   *logrus.Logger
+	params  *ClientParams
+	session *sessionState
+	conn    transport
+	// The codec for the protocol version negotiated for conn.
+	codec  utils.Codec
+	logger *logrus.Logger
+	// Serialises calls to the number handler so numbers are
+	// delivered in order even if messages are handled on
+	// different goroutines across re-connections.
+	deliveryMu    sync.Mutex
+	numberHandler func(index int, number uint32)
 }
 
 type sessionState struct {
-	clientID                 string
+	clientID string
+	// Numbers received from the offset onwards, numbers before the offset
+	// have been discarded once delivered and verified by a checkpoint.
 	sequenceReceived         []uint32
+	offset                   int
 	lastReceivedIndex        int
 	receivedCompleteSequence bool
-	success                  bool
-	finalErr                 error
-	serverChecksum           string
-	mu                       sync.Mutex
+	// Numbers received after a gap keyed by their index, these are
+	// placed in the sequence once the gap has been filled.
+	outOfOrder map[int]uint32
+	// The index of the next number sent over the current connection without
+	// its index (the first version of the protocol), -1 when it is not known
+	// and such numbers can not be placed.
+	unindexedNext int
+	// Checkpoints for numbers that are yet to be received.
+	pendingCheckpoints []utils.SequenceCheckpointMessage
+	verifiedThrough    int
+	checkpointChecksum string
+	hasNumberHandler   bool
+	// Set once the server has confirmed the sequence has been stopped
+	// at the client's request.
+	stopped        bool
+	success        bool
+	finalErr       error
+	serverChecksum string
+	handshake      *utils.SequenceHandshakeMessage
+	// Sent with every connection once known, only servers that
+	// require clients to authenticate issue tokens.
+	token string
+	// Set once the server has confirmed batching for the current connection,
+	// numbers in batches are then acknowledged cumulatively.
+	batchSettings *utils.BatchSettingsMessage
+	// The pace of delivery requested by the caller, the message interval is -1
+	// until a rate has been requested.
+	paused          bool
+	messageInterval int
+	// Set on re-connection when the requested pace of delivery is yet to be
+	// sent over the new connection.
+	flowControlPending bool
+	// The pace of delivery last confirmed by the server.
+	flowSettings *utils.FlowSettingsMessage
+	// Set once the client has been closed by the caller
+	// to prevent further re-connections.
+	closed bool
+	// The number of received numbers that have been passed
+	// to the number handler.
+	delivered int
+	// Closed once the full sequence has been received or the
+	// session has failed with a final error.
+	done     chan struct{}
+	doneOnce sync.Once
+	mu       sync.Mutex
+}
+
+func (s *sessionState) finish() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
 }
 
 func NewDefaultClient(params *ClientParams, logger *logrus.Logger) Client {
+	received := make([]uint32, len(params.ReceivedNumbers))
+	copy(received, params.ReceivedNumbers)
 	return &clientImpl{params: params, session: &sessionState{
-		// Ensure we initialise last received as -1, otherwise it will be 0
-		// which is the default empty value and therefore the first message will be skipped.
-		lastReceivedIndex: -1,
-	}, wsClient: nil, logger: logger}
+		sequenceReceived: received,
+		// Ensure we initialise last received as -1 when no numbers have been received,
+		// otherwise it will be 0 which is the default empty value and therefore
+		// the first message will be skipped.
+		lastReceivedIndex: len(received) - 1,
+		verifiedThrough:   -1,
+		messageInterval:   -1,
+		outOfOrder:        map[int]uint32{},
+		unindexedNext:     -1,
+		token:             params.Token,
+		delivered:         len(received),
+		done:              make(chan struct{}),
+	}, conn: nil, logger: logger}
 }
 
 func (c *clientImpl) Connect() error {
@@ -90,13 +218,31 @@ func (c *clientImpl) connect() error {
 }
 
 func (c *clientImpl) handleMessages() {
-	for c.session.finalErr == nil && !c.session.receivedCompleteSequence {
-		_, message, err := c.wsClient.ReadMessage()
+	// Hold on to the connection messages are being read from as the close
+	// handler may reconnect and replace c.conn before the read loop exits.
+	c.session.mu.Lock()
+	conn := c.conn
+	c.session.mu.Unlock()
+
+	ctx, stopHeartbeat := context.WithCancel(context.Background())
+	defer stopHeartbeat()
+	conn.StartHeartbeat(ctx, c.params.Heartbeat)
+
+	for !c.isFinished() {
+		message, err := conn.ReadMessage()
 		if err != nil {
 			c.logger.Debug("read message error: ", err)
-			c.wsClient.Close()
+			conn.Close()
+			// Closures initiated by the server are handled by the close handler,
+			// any other read error (e.g. the server going silent and the read
+			// deadline passing) means the connection has been lost.
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) && c.shouldReconnect() {
+				go c.reconnect()
+			}
 			break
 		} else {
+			conn.ExtendReadDeadline(c.params.Heartbeat)
 			c.handleMessage(message)
 		}
 	}
@@ -104,10 +250,75 @@ func (c *clientImpl) handleMessages() {
 
 func (c *clientImpl) handleMessage(message []byte) {
 	c.logger.Debug("Received message: ", message)
+	if len(message) == 0 {
+		// Every message starts with a prefix, the server will resend
+		// any number lost to a malformed message.
+		c.logger.Error("received an empty message")
+		return
+	}
+	c.restoreFlowControl()
 	if message[0] == utils.NumberInSequencePrefix {
 		c.handleMessageInSequence(message[1:])
 	} else if message[0] == utils.LastNumberInSequencePrefix {
 		c.handleLastMessageInSequence(message[1:])
+	} else if message[0] == utils.RetransmittedNumberInSequencePrefix {
+		c.handleRetransmittedMessageInSequence(message[1:])
+	} else if message[0] == utils.SequenceHandshakePrefix {
+		c.handleHandshake(message[1:])
+	} else if message[0] == utils.SequenceCheckpointPrefix {
+		c.handleCheckpoint(message[1:])
+	} else if message[0] == utils.BatchSettingsPrefix {
+		c.handleBatchSettings(message[1:])
+	} else if message[0] == utils.NumberBatchPrefix {
+		c.handleNumberBatch(message[1:])
+	} else if message[0] == utils.FlowSettingsPrefix {
+		c.handleFlowSettings(message[1:])
+	}
+
+	c.deliverNumbers()
+	// Only mark the session as done once the handler has seen every number
+	// so consumers can rely on having processed the full sequence when
+	// Result returns.
+	if c.isFinished() {
+		c.session.finish()
+	}
+}
+
+func (c *clientImpl) OnNumber(handler func(index int, number uint32)) {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	c.numberHandler = handler
+
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	c.session.hasNumberHandler = handler != nil
+}
+
+// Passes each received number that has not yet been delivered to the
+// number handler, the handler is called without holding the session lock
+// so it is free to call other client methods.
+func (c *clientImpl) deliverNumbers() {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	if c.numberHandler == nil {
+		return
+	}
+
+	for {
+		c.session.mu.Lock()
+		if c.session.delivered >= c.session.received() {
+			c.session.mu.Unlock()
+			return
+		}
+		index := c.session.delivered
+		number := c.session.sequenceReceived[index-c.session.offset]
+		c.session.delivered += 1
+		c.discardVerifiedNumbers()
+		c.session.mu.Unlock()
+
+		c.numberHandler(index, number)
 	}
 }
 
@@ -115,25 +326,265 @@ func (c *clientImpl) handleMessageInSequence(message []byte) {
 	c.session.mu.Lock()
 	defer c.session.mu.Unlock()
 
-	sequenceNumber := utils.ByteArrayToSingleUint32(message)
-	c.session.sequenceReceived = append(c.session.sequenceReceived, sequenceNumber)
-	newIndex := len(c.session.sequenceReceived) - 1
-	c.session.lastReceivedIndex = newIndex
-	c.logger.Debug(
-		"len sequence received: ", len(c.session.sequenceReceived), " uint32: ", uint32(len(c.session.sequenceReceived)-1),
-	)
-	c.wsClient.WriteMessage(websocket.BinaryMessage, append(
+	index, sequenceNumber, err := c.codec.DecodeNumber(message)
+	if err != nil {
+		c.logger.Error("failed to parse number in sequence: ", err)
+		return
+	}
+	if index == -1 {
+		// The server only sends numbers without their index when they follow on from
+		// the previous number sent over the connection, any other number is sent
+		// with its index as a retransmission.
+		if c.session.unindexedNext == -1 {
+			// Without an acknowledgement the server will resend the number with its index.
+			c.logger.Debug("rejecting number without an index as its position is not known")
+			return
+		}
+		index = c.session.unindexedNext
+		c.session.unindexedNext += 1
+	}
+	c.receiveIndexedNumber(index, sequenceNumber)
+}
+
+func (c *clientImpl) handleRetransmittedMessageInSequence(message []byte) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	index, sequenceNumber, err := c.codec.DecodeRetransmission(message)
+	if err != nil {
+		c.logger.Error("failed to parse retransmitted number in sequence: ", err)
+		return
+	}
+	c.receiveIndexedNumber(index, sequenceNumber)
+}
+
+// Places a number sent along with its index in the sequence and acknowledges it,
+// must be called with the session lock held.
+func (c *clientImpl) receiveIndexedNumber(index int, sequenceNumber uint32) {
+	if !c.placeIndexedNumber(index, sequenceNumber) {
+		// Letting the server know which numbers are held after the gap
+		// allows it to resend the missing numbers straight away.
+		c.sendSelectiveAck()
+		return
+	}
+
+	// Acknowledge duplicates too as the server only retransmits
+	// when it has not seen the previous acknowledgement.
+	c.conn.WriteMessage(append(
 		[]byte{utils.AcknowledgementPrefix},
-		utils.Uint32ToByteArray([]uint32{uint32(newIndex)})...,
+		utils.Uint32ToByteArray([]uint32{uint32(index)})...,
 	))
 }
 
+// Returns false when the number comes after a gap and is held until the gap is filled,
+// must be called with the session lock held.
+func (c *clientImpl) placeIndexedNumber(index int, sequenceNumber uint32) bool {
+	if index > c.session.received() {
+		c.holdOutOfOrderNumber(index, sequenceNumber)
+		return false
+	}
+
+	if index == c.session.received() {
+		c.session.sequenceReceived = append(c.session.sequenceReceived, sequenceNumber)
+		// Filling a gap may allow numbers held after it to be placed.
+		for {
+			held, exists := c.session.outOfOrder[c.session.received()]
+			if !exists {
+				break
+			}
+			delete(c.session.outOfOrder, c.session.received())
+			c.session.sequenceReceived = append(c.session.sequenceReceived, held)
+		}
+		c.session.lastReceivedIndex = c.session.received() - 1
+		c.verifyCheckpoints()
+	} else {
+		c.logger.Debug("discarding duplicate number at index: ", index)
+	}
+	return true
+}
+
+// Must be called with the session lock held.
+func (c *clientImpl) holdOutOfOrderNumber(index int, sequenceNumber uint32) {
+	_, exists := c.session.outOfOrder[index]
+	if !exists && len(c.session.outOfOrder) >= maxOutOfOrderNumbers {
+		// The server will keep retransmitting until the gap is filled.
+		c.logger.Debug("ignoring number after a gap at index: ", index)
+		return
+	}
+	c.session.outOfOrder[index] = sequenceNumber
+}
+
+// Acknowledges the ranges of numbers held after a gap in a single message,
+// must be called with the session lock held.
+func (c *clientImpl) sendSelectiveAck() {
+	if len(c.session.outOfOrder) == 0 {
+		return
+	}
+
+	indexes := make([]int, 0, len(c.session.outOfOrder))
+	for index := range c.session.outOfOrder {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	ranges := [][2]int{{indexes[0], indexes[0]}}
+	for _, index := range indexes[1:] {
+		last := &ranges[len(ranges)-1]
+		if index == last[1]+1 {
+			last[1] = index
+		} else {
+			ranges = append(ranges, [2]int{index, index})
+		}
+	}
+	c.conn.WriteMessage(utils.EncodeSelectiveAcknowledgement(ranges))
+}
+
+func (c *clientImpl) handleBatchSettings(message []byte) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	settings := &utils.BatchSettingsMessage{}
+	err := json.Unmarshal(message, settings)
+	if err != nil {
+		// Batches can still be received, they are acknowledged
+		// individually until the settings are known.
+		c.logger.Error("failed to parse batch settings: ", err)
+		return
+	}
+	c.session.batchSettings = settings
+}
+
+// Places every number in a batch and acknowledges them together with
+// a single cumulative acknowledgement of the last number received in order,
+// followed by a selective acknowledgement of any numbers held after a gap.
+func (c *clientImpl) handleNumberBatch(message []byte) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	fromIndex, numbers, err := utils.DecodeNumberBatch(message)
+	if err != nil {
+		c.logger.Error("failed to parse batch of numbers: ", err)
+		return
+	}
+	// Batches are only ever sent once, numbers that follow
+	// are sent as if the batch had been sent as individual numbers.
+	c.session.unindexedNext = fromIndex + len(numbers)
+	if c.session.batchSettings == nil {
+		for i, number := range numbers {
+			c.receiveIndexedNumber(fromIndex+i, number)
+		}
+		return
+	}
+
+	for i, number := range numbers {
+		c.placeIndexedNumber(fromIndex+i, number)
+	}
+	if c.session.lastReceivedIndex > -1 {
+		c.conn.WriteMessage(append(
+			[]byte{utils.CumulativeAcknowledgementPrefix},
+			utils.Uint32ToByteArray([]uint32{uint32(c.session.lastReceivedIndex)})...,
+		))
+	}
+	c.sendSelectiveAck()
+}
+
+func (c *clientImpl) handleHandshake(message []byte) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	handshake := &utils.SequenceHandshakeMessage{}
+	err := json.Unmarshal(message, handshake)
+	if err != nil {
+		// The handshake is informational, the sequence can still be verified
+		// with the checksum without it.
+		c.logger.Error("failed to parse sequence handshake: ", err)
+		return
+	}
+	c.session.handshake = handshake
+	if handshake.Token != "" {
+		c.session.token = handshake.Token
+	}
+}
+
+func (c *clientImpl) handleCheckpoint(message []byte) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	checkpoint := utils.SequenceCheckpointMessage{}
+	err := json.Unmarshal(message, &checkpoint)
+	if err != nil {
+		c.session.finalErr = fmt.Errorf("failed to parse checkpoint: %w", err)
+		c.session.success = false
+		return
+	}
+	c.session.pendingCheckpoints = append(c.session.pendingCheckpoints, checkpoint)
+	c.verifyCheckpoints()
+}
+
+// Verifies pending checkpoints for which every number has been received,
+// must be called with the session lock held.
+func (c *clientImpl) verifyCheckpoints() {
+	remaining := c.session.pendingCheckpoints[:0]
+	for _, checkpoint := range c.session.pendingCheckpoints {
+		if checkpoint.ToIndex >= c.session.received() {
+			remaining = append(remaining, checkpoint)
+			continue
+		}
+		if checkpoint.FromIndex < c.session.offset || checkpoint.FromIndex > checkpoint.ToIndex {
+			c.logger.Debug("skipping checkpoint for numbers that are no longer held: ", checkpoint.FromIndex)
+			continue
+		}
+
+		covered := c.session.sequenceReceived[checkpoint.FromIndex-c.session.offset : checkpoint.ToIndex-c.session.offset+1]
+		clientChecksum := utils.CreateChecksum(covered)
+		if clientChecksum != checkpoint.Checksum {
+			c.session.finalErr = fmt.Errorf(
+				"client checksum %s for numbers %d to %d does not match checkpoint from server %s",
+				clientChecksum,
+				checkpoint.FromIndex,
+				checkpoint.ToIndex,
+				checkpoint.Checksum,
+			)
+			c.session.success = false
+		}
+		c.session.checkpointChecksum = clientChecksum
+		c.session.serverChecksum = checkpoint.Checksum
+		if checkpoint.ToIndex > c.session.verifiedThrough {
+			c.session.verifiedThrough = checkpoint.ToIndex
+		}
+	}
+	c.session.pendingCheckpoints = remaining
+	c.discardVerifiedNumbers()
+}
+
+// Only infinite sequences discard numbers, must be called with the session lock held.
+func (c *clientImpl) discardVerifiedNumbers() {
+	if !c.params.Infinite {
+		return
+	}
+
+	discardTo := c.session.verifiedThrough + 1
+	if c.session.hasNumberHandler && c.session.delivered < discardTo {
+		discardTo = c.session.delivered
+	}
+	if discardTo <= c.session.offset {
+		return
+	}
+	remaining := make([]uint32, c.session.received()-discardTo)
+	copy(remaining, c.session.sequenceReceived[discardTo-c.session.offset:])
+	c.session.sequenceReceived = remaining
+	c.session.offset = discardTo
+}
+
+func (s *sessionState) received() int {
+	return s.offset + len(s.sequenceReceived)
+}
+
 func (c *clientImpl) handleLastMessageInSequence(message []byte) {
 	c.session.mu.Lock()
 	defer c.session.mu.Unlock()
 
-	finalMessage := &utils.SequenceFinalMessage{}
-	err := json.Unmarshal(message, finalMessage)
+	index, finalMessage, err := c.codec.DecodeLastNumber(message)
 	// Failure to parse the last message should be deemed one of the
 	// possible final errors.
 	if err != nil {
@@ -141,6 +592,18 @@ func (c *clientImpl) handleLastMessageInSequence(message []byte) {
 		c.session.success = false
 		return
 	}
+	if index > -1 && index != c.session.received() {
+		// The server keeps resending the last number along with any
+		// numbers missing before it until it is acknowledged.
+		c.logger.Debug("ignoring last number out of order at index: ", index)
+		return
+	}
+	if index == -1 && len(c.session.outOfOrder) > 0 {
+		// Without its index the last number can only be placed once
+		// every number before it has been received.
+		c.logger.Debug("ignoring last number received after a gap")
+		return
+	}
 
 	c.session.sequenceReceived = append(c.session.sequenceReceived, finalMessage.Number)
 	clientChecksum := utils.CreateChecksum(c.session.sequenceReceived)
@@ -164,41 +627,128 @@ func (c *clientImpl) handleLastMessageInSequence(message []byte) {
 	)
 	// Perhaps this isn't necessary as the server will be closing after sending
 	// the final number in the sequence with the checksum.
-	c.wsClient.WriteMessage(websocket.BinaryMessage, append(
+	c.conn.WriteMessage(append(
 		[]byte{utils.AcknowledgementPrefix},
 		utils.Uint32ToByteArray([]uint32{uint32(newIndex)})...,
 	))
 }
 
 func (c *clientImpl) retryConnect() error {
-	// todo: support TLS.
-	url := c.buildUrl()
+	query, lastReceived := c.buildQuery()
 
-	wsClient, _, err := websocket.DefaultDialer.Dial(url, nil)
+	var conn transport
+	var codec utils.Codec
+	var err error
+	switch c.params.Transport {
+	case TransportWebSocket, "":
+		conn, codec, err = c.dialWebSocket(query, lastReceived)
+	case TransportEventStream:
+		conn, codec, err = c.dialEventStream(query, lastReceived)
+	case TransportLongPoll:
+		conn, codec, err = c.dialLongPoll(query, lastReceived)
+	case TransportTCP:
+		conn, codec, err = c.dialTCP(query, lastReceived)
+	default:
+		err = backoff.Permanent(fmt.Errorf("unknown transport %q", c.params.Transport))
+	}
 	if err != nil {
 		return err
 	}
-	wsClient.SetCloseHandler(c.closeHandler)
-	c.wsClient = wsClient
+
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	c.conn = conn
+	c.codec = codec
+	c.session.unindexedNext = -1
+	if lastReceived != "" {
+		// The server sends from the number after the last received index.
+		lastReceivedIndex, _ := strconv.Atoi(lastReceived)
+		c.session.unindexedNext = lastReceivedIndex + 1
+	} else if c.session.received() == 0 {
+		c.session.unindexedNext = 0
+	}
+	// Batch and flow settings are confirmed for each connection.
+	c.session.batchSettings = nil
+	c.session.flowSettings = nil
+	c.session.flowControlPending = c.session.paused || c.session.messageInterval > -1
 	return nil
 }
 
+func (c *clientImpl) dialWebSocket(query url.Values, lastReceived string) (transport, utils.Codec, error) {
+	if lastReceived != "" {
+		query.Set("lastReceived", lastReceived)
+	}
+	scheme := "ws"
+	if c.params.UseTLS {
+		scheme = "wss"
+	}
+
+	wsClient, _, err := c.dialer().Dial(c.buildUrl(scheme, "", query), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	codec, supported := utils.CodecForSubprotocol(wsClient.Subprotocol())
+	if !supported {
+		wsClient.Close()
+		return nil, nil, backoff.Permanent(
+			fmt.Errorf("server selected unsupported protocol version %q", wsClient.Subprotocol()),
+		)
+	}
+	wsClient.SetCloseHandler(c.closeHandler)
+	return &webSocketTransport{conn: wsClient}, codec, nil
+}
+
+// The index of the last number received is sent as the last event ID
+// in the same way browsers resume an event stream.
+func (c *clientImpl) dialEventStream(query url.Values, lastReceived string) (transport, utils.Codec, error) {
+	scheme := "http"
+	if c.params.UseTLS {
+		scheme = "https"
+	}
+	messagesQuery := url.Values{"clientId": {query.Get("clientId")}}
+	if query.Has("token") {
+		messagesQuery.Set("token", query.Get("token"))
+	}
+	messagesURL, err := url.Parse(c.buildUrl(scheme, eventStreamMessagesPath, messagesQuery))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := dialEventStream(
+		c.httpClient(),
+		c.buildUrl(scheme, eventStreamPath, query),
+		*messagesURL,
+		lastReceived,
+		c.closeHandler,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, utils.EventStreamCodec(), nil
+}
+
 func (c *clientImpl) closeHandler(code int, text string) error {
 	c.session.mu.Lock()
 	defer c.session.mu.Unlock()
 
 	// Implement the default close handler behaviour and then try to reconnect
 	// if not complete and the connection was not closed due to known client issues.
-	message := websocket.FormatCloseMessage(code, "")
-	c.wsClient.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	c.conn.WriteClose(code)
+
+	if text == "sequence stopped" {
+		c.session.stopped = true
+		c.session.success = c.session.finalErr == nil
+		c.session.finish()
+	}
 
 	// We only try to reconnect on unexpected closures before the full sequence has
 	// been received by the client.
-	finishedProcessing := c.session.finalErr == nil && !c.session.receivedCompleteSequence
-	if !utils.IsKnownClientErrorCode(code) && finishedProcessing && text != "sequence complete" {
+	finishedProcessing := c.session.finalErr == nil && !c.session.receivedCompleteSequence && !c.session.stopped
+	if !utils.IsKnownClientErrorCode(code) && finishedProcessing && !c.session.closed &&
+		text != "sequence complete" {
 		// Do not let retrying the connection block the close handler,
 		// we need to free up the WebSocket connection to complete clean up.
-		go c.connect()
+		go c.reconnect()
 	}
 
 	if utils.IsKnownClientErrorCode(code) {
@@ -208,59 +758,284 @@ func (c *clientImpl) closeHandler(code int, text string) error {
 			code,
 			text,
 		)
+		c.session.finish()
 	}
 
 	return nil
 }
 
-func (c *clientImpl) buildUrl() string {
+func (c *clientImpl) reconnect() {
+	err := c.connect()
+	if err != nil {
+		c.session.mu.Lock()
+		defer c.session.mu.Unlock()
+
+		c.session.finalErr = fmt.Errorf("failed to reconnect: %w", err)
+		c.session.finish()
+	}
+}
+
+func (c *clientImpl) shouldReconnect() bool {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	return !c.session.closed && c.session.finalErr == nil && !c.session.receivedCompleteSequence &&
+		!c.session.stopped
+}
+
+func (c *clientImpl) isFinished() bool {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	return c.session.finalErr != nil || c.session.receivedCompleteSequence || c.session.stopped
+}
+
+func (c *clientImpl) dialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = utils.Subprotocols
+	if c.params.Subprotocols != nil {
+		dialer.Subprotocols = c.params.Subprotocols
+	}
+	if c.params.UseTLS && c.params.TLSConfig != nil {
+		dialer.TLSClientConfig = c.params.TLSConfig
+	}
+	return &dialer
+}
+
+func (c *clientImpl) dialLongPoll(query url.Values, lastReceived string) (transport, utils.Codec, error) {
+	scheme := "http"
+	if c.params.UseTLS {
+		scheme = "https"
+	}
+	pollURL, err := url.Parse(c.buildUrl(scheme, longPollPath, query))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := dialLongPoll(c.httpClient(), *pollURL, lastReceived, c.closeHandler)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.codec, nil
+}
+
+func (c *clientImpl) dialTCP(query url.Values, lastReceived string) (transport, utils.Codec, error) {
+	conn, err := dialTCP(
+		fmt.Sprintf("%s:%d", c.params.ServerHost, c.params.ServerPort),
+		c.params.UseTLS,
+		c.params.TLSConfig,
+		query,
+		lastReceived,
+		c.closeHandler,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, v2Codec(), nil
+}
+
+func (c *clientImpl) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.params.UseTLS && c.params.TLSConfig != nil {
+		transport.TLSClientConfig = c.params.TLSConfig
+	}
+	return &http.Client{Transport: transport}
+}
+
+// Builds the query parameters for connecting to the server along with the index
+// of the last number received, which is empty when it should not be sent.
+func (c *clientImpl) buildQuery() (url.Values, string) {
 	c.session.mu.Lock()
 	defer c.session.mu.Unlock()
 
 	q := url.Values{
 		"clientId": {c.session.clientID},
 	}
-	if c.params.SequenceCount > -1 {
+	if c.params.Infinite {
+		q.Set("sequenceCount", "infinite")
+	} else if c.params.SequenceCount > -1 {
 		q.Set("sequenceCount", strconv.Itoa(c.params.SequenceCount))
 	}
-	if c.params.SendLastReceivedIndex && c.session.lastReceivedIndex > -1 {
-		q.Set("lastReceived", strconv.Itoa(c.session.lastReceivedIndex))
+	if c.params.Generator != "" {
+		q.Set("generator", c.params.Generator)
+	}
+	if c.params.BatchSize > 0 {
+		q.Set("batchSize", strconv.Itoa(c.params.BatchSize))
+		q.Set("batchInterval", strconv.Itoa(c.params.BatchInterval))
+	}
+	if c.session.token != "" {
+		q.Set("token", c.session.token)
+	}
+	lastReceived := ""
+	// A client resuming from numbers received by a previous client must always
+	// say where it is resuming from as the server may hold acknowledgements
+	// for numbers that were not passed on.
+	// The same applies to connections that negotiated a version of the protocol without
+	// indexes as the client can only place numbers sent without their index when it knows
+	// where the server is sending from.
+	sendLastReceived := c.params.SendLastReceivedIndex || len(c.params.ReceivedNumbers) > 0 ||
+		(c.codec != nil && !utils.NumbersCarryIndex(c.codec))
+	if sendLastReceived && c.session.lastReceivedIndex > -1 {
+		lastReceived = strconv.Itoa(c.session.lastReceivedIndex)
 	} else if c.params.SendLastReceivedIndex && c.params.OverrideLastReceivedIndex != nil {
-		q.Set("lastReceived", strconv.Itoa(*c.params.OverrideLastReceivedIndex))
+		lastReceived = strconv.Itoa(*c.params.OverrideLastReceivedIndex)
 	}
+	return q, lastReceived
+}
 
+func (c *clientImpl) buildUrl(scheme string, path string, q url.Values) string {
 	url := url.URL{
-		// todo: support TLS.
-		Scheme:   "ws",
+		Scheme:   scheme,
 		Host:     fmt.Sprintf("%s:%d", c.params.ServerHost, c.params.ServerPort),
+		Path:     path,
 		RawQuery: q.Encode(),
 	}
 	return url.String()
 }
 
 func (c *clientImpl) Close() error {
-	return c.wsClient.Close()
+	c.session.mu.Lock()
+	c.session.closed = true
+	conn := c.conn
+	c.session.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
 }
 
-func (c *clientImpl) Result() Result {
-	// Make deadline configurable.
-	deadline := time.Now().Add(300 * time.Second) // 5 minutes
-	// todo: improve communication by using channels.
-	for {
-		if c.session.finalErr != nil || c.session.receivedCompleteSequence || time.Now().After(deadline) {
-			break
+func (c *clientImpl) Stop() error {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	if c.conn == nil {
+		return errors.New("client is not connected")
+	}
+	lastReceived := utils.NoIndex
+	if c.session.lastReceivedIndex > -1 {
+		lastReceived = uint32(c.session.lastReceivedIndex)
+	}
+	return c.conn.WriteMessage(append(
+		[]byte{utils.StopSequencePrefix},
+		utils.Uint32ToByteArray([]uint32{lastReceived})...,
+	))
+}
+
+func (c *clientImpl) Pause() error {
+	return c.writeFlowControl(func() []byte {
+		c.session.paused = true
+		return []byte{utils.PauseSequencePrefix}
+	})
+}
+
+func (c *clientImpl) Resume() error {
+	return c.writeFlowControl(func() []byte {
+		c.session.paused = false
+		return []byte{utils.ResumeSequencePrefix}
+	})
+}
+
+func (c *clientImpl) SetRate(messageInterval int) error {
+	if messageInterval < 0 {
+		return errors.New("message interval must not be negative")
+	}
+	return c.writeFlowControl(func() []byte {
+		c.session.messageInterval = messageInterval
+		return append(
+			[]byte{utils.SetRatePrefix},
+			utils.Uint32ToByteArray([]uint32{uint32(messageInterval)})...,
+		)
+	})
+}
+
+// Records the requested pace of delivery so it can be restored on re-connection
+// and sends the message produced by update to the server.
+func (c *clientImpl) writeFlowControl(update func() []byte) error {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	if c.conn == nil {
+		return errors.New("client is not connected")
+	}
+	return c.conn.WriteMessage(update())
+}
+
+// Sends the requested pace of delivery over a new connection once the server has
+// sent the first message, by which point the server is ready to receive messages
+// over every transport.
+func (c *clientImpl) restoreFlowControl() {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	if !c.session.flowControlPending {
+		return
+	}
+	c.session.flowControlPending = false
+
+	messages := [][]byte{}
+	if c.session.paused {
+		messages = append(messages, []byte{utils.PauseSequencePrefix})
+	}
+	if c.session.messageInterval > -1 {
+		messages = append(messages, append(
+			[]byte{utils.SetRatePrefix},
+			utils.Uint32ToByteArray([]uint32{uint32(c.session.messageInterval)})...,
+		))
+	}
+	for _, message := range messages {
+		err := c.conn.WriteMessage(message)
+		if err != nil {
+			c.logger.Debug("failed to restore flow control: ", err)
 		}
 	}
+}
 
-	timedOut := c.session.finalErr == nil && !c.session.receivedCompleteSequence
-	if timedOut {
-		return Result{Error: errors.New("timed out after 300 seconds waiting to receive full sequence")}
+func (c *clientImpl) handleFlowSettings(message []byte) {
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	settings := &utils.FlowSettingsMessage{}
+	err := json.Unmarshal(message, settings)
+	if err != nil {
+		c.logger.Error("failed to parse flow settings: ", err)
+		return
+	}
+	c.logger.Debug("server confirmed flow settings, paused: ", settings.Paused, " message interval: ", settings.MessageInterval)
+	c.session.flowSettings = settings
+}
+
+func (c *clientImpl) Result(ctx context.Context) Result {
+	if c.params.ResultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.params.ResultTimeout)*time.Second)
+		defer cancel()
 	}
 
-	return Result{
-		Checksum:       utils.CreateChecksum(c.session.sequenceReceived),
+	select {
+	case <-c.session.done:
+	case <-ctx.Done():
+		return Result{
+			Error: fmt.Errorf("stopped waiting to receive full sequence: %w", ctx.Err()),
+		}
+	}
+
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+
+	checksum := c.session.checkpointChecksum
+	if !c.params.Infinite {
+		checksum = utils.CreateChecksum(c.session.sequenceReceived)
+	}
+	result := Result{
+		Checksum:       checksum,
 		ServerChecksum: c.session.serverChecksum,
 		Error:          c.session.finalErr,
 		Success:        c.session.success,
 	}
+	if c.session.handshake != nil {
+		result.Generator = c.session.handshake.Generator
+		result.Seed = c.session.handshake.Seed
+	}
+	return result
 }
@@ -1,7 +1,27 @@
 package client
 
+import "context"
+
 type Client interface {
 	Connect() error
 	Close() error
-	Result() Result
+	// Asks the server to stop the sequence, primarily for infinite sequences,
+	// Result returns once the server has confirmed the sequence has stopped.
+	Stop() error
+	// Asks the server to stop sending new numbers until Resume is called,
+	// numbers already in flight may still be received.
+	Pause() error
+	Resume() error
+	// Asks the server to wait the given number of milliseconds between numbers,
+	// the server keeps the interval within its own bounds.
+	// Flow control is restored on re-connection and is not supported over long polling.
+	SetRate(messageInterval int) error
+	// Blocks until the full sequence has been received, the session fails
+	// or the context is done.
+	Result(ctx context.Context) Result
+	// Registers a handler that is called with each number in the sequence
+	// as it is received, including the final number.
+	// Numbers are delivered in order exactly once, across re-connections,
+	// the handler should be registered before calling Connect.
+	OnNumber(handler func(index int, number uint32))
 }
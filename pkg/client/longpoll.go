@@ -0,0 +1,259 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+const longPollPath = "/poll"
+
+// Longer than the time the server waits to fill a batch by default,
+// polls that take longer are treated as the server having gone silent.
+const longPollRequestTimeout = 60 * time.Second
+
+var (
+	errLongPollStopUnsupported = errors.New("sequences can not be stopped over long polling")
+	// Clients control the pace of long polling by when they poll.
+	errLongPollFlowControlUnsupported = errors.New("flow control is not supported over long polling")
+)
+
+// Translates batches of numbers from long polls into messages in the format
+// of the second version of the protocol, acknowledgements are sent with the next poll.
+type longPollTransport struct {
+	httpClient   *http.Client
+	pollURL      url.URL
+	closeHandler func(code int, text string) error
+	codec        utils.Codec
+	// Cancels the poll in flight when the transport is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	// Messages from the last poll that are yet to be read.
+	pending [][]byte
+	// Set when a poll has been rejected or the sequence is complete.
+	pendingClose *utils.PollError
+	// The last received index the transport was dialed with,
+	// sent as the after query parameter until a number is acknowledged.
+	lastReceived string
+	// The index of the last number acknowledged by the client,
+	// sent as the after query parameter of the next poll.
+	acknowledged int
+	finalIndex   int
+}
+
+// Sends the first poll so connection failures are retried in the same way as
+// the other transports.
+func dialLongPoll(
+	httpClient *http.Client,
+	pollURL url.URL,
+	lastReceived string,
+	closeHandler func(code int, text string) error,
+) (*longPollTransport, error) {
+	httpClient.Timeout = longPollRequestTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &longPollTransport{
+		httpClient:   httpClient,
+		pollURL:      pollURL,
+		closeHandler: closeHandler,
+		codec:        v2Codec(),
+		ctx:          ctx,
+		cancel:       cancel,
+		lastReceived: lastReceived,
+		acknowledged: -1,
+		finalIndex:   -1,
+	}
+	err := t.poll()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return t, nil
+}
+
+func v2Codec() utils.Codec {
+	codec, _ := utils.CodecForSubprotocol(utils.SubprotocolV2)
+	return codec
+}
+
+func (t *longPollTransport) ReadMessage() ([]byte, error) {
+	for {
+		t.mu.Lock()
+		if len(t.pending) > 0 {
+			message := t.pending[0]
+			t.pending = t.pending[1:]
+			t.mu.Unlock()
+			return message, nil
+		}
+		pendingClose := t.pendingClose
+		t.mu.Unlock()
+
+		if pendingClose != nil {
+			t.closeHandler(pendingClose.Code, pendingClose.Reason)
+			return nil, &websocket.CloseError{Code: pendingClose.Code, Text: pendingClose.Reason}
+		}
+
+		err := t.poll()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Acknowledgements are held until the next poll apart from the acknowledgement
+// of the final number which is sent straight away as there will be no next poll.
+func (t *longPollTransport) WriteMessage(message []byte) error {
+	if len(message) > 0 && (message[0] == utils.PauseSequencePrefix ||
+		message[0] == utils.ResumeSequencePrefix ||
+		message[0] == utils.SetRatePrefix) {
+		return errLongPollFlowControlUnsupported
+	}
+	if len(message) < 5 {
+		return errors.New("message is too short")
+	}
+	if message[0] == utils.StopSequencePrefix {
+		return errLongPollStopUnsupported
+	}
+	if message[0] != utils.AcknowledgementPrefix {
+		return fmt.Errorf("message with prefix 0x%x can not be sent over long polling", message[0])
+	}
+
+	index := int(binary.LittleEndian.Uint32(message[1:]))
+	t.mu.Lock()
+	if index > t.acknowledged {
+		t.acknowledged = index
+	}
+	final := index == t.finalIndex
+	t.mu.Unlock()
+
+	if final {
+		return t.poll()
+	}
+	return nil
+}
+
+// There is no connection to close with a closing handshake.
+func (t *longPollTransport) WriteClose(code int) error {
+	return nil
+}
+
+func (t *longPollTransport) Close() error {
+	t.cancel()
+	t.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// Every poll is a new request so there is no long-lived
+// connection to keep alive.
+func (t *longPollTransport) StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams) {}
+
+func (t *longPollTransport) ExtendReadDeadline(params *utils.HeartbeatParams) {}
+
+func (t *longPollTransport) poll() error {
+	t.mu.Lock()
+	pollURL := t.pollURL
+	after := t.lastReceived
+	if t.acknowledged > -1 {
+		after = strconv.Itoa(t.acknowledged)
+	}
+	t.mu.Unlock()
+	if after != "" {
+		query := pollURL.Query()
+		query.Set("after", after)
+		pollURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodGet, pollURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		pollErr := &utils.PollError{}
+		err = json.NewDecoder(resp.Body).Decode(pollErr)
+		if err != nil {
+			return fmt.Errorf("long poll failed: %s", resp.Status)
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.pendingClose = pollErr
+		return nil
+	}
+
+	batch := &utils.PollResponse{}
+	err = json.NewDecoder(resp.Body).Decode(batch)
+	if err != nil {
+		return err
+	}
+	return t.receiveBatch(batch)
+}
+
+func (t *longPollTransport) receiveBatch(batch *utils.PollResponse) error {
+	messages := [][]byte{}
+	if batch.Handshake != nil {
+		handshakeBytes, err := json.Marshal(batch.Handshake)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, append([]byte{utils.SequenceHandshakePrefix}, handshakeBytes...))
+	}
+
+	finalIndex := -1
+	checkpoints := map[int]utils.SequenceCheckpointMessage{}
+	for _, checkpoint := range batch.Checkpoints {
+		checkpoints[checkpoint.ToIndex] = checkpoint
+	}
+	for i, number := range batch.Numbers {
+		index := batch.FromIndex + i
+		if batch.Checksum != "" && i == len(batch.Numbers)-1 {
+			message, err := t.codec.EncodeLastNumber(index, number, batch.Checksum)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, message)
+			finalIndex = index
+			continue
+		}
+
+		messages = append(messages, t.codec.EncodeNumber(index, number))
+		if checkpoint, exists := checkpoints[index]; exists {
+			checkpointBytes, err := json.Marshal(&checkpoint)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, append([]byte{utils.SequenceCheckpointPrefix}, checkpointBytes...))
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if batch.Handshake != nil && batch.Handshake.Token != "" {
+		// Every poll after the one that created the session resumes it.
+		query := t.pollURL.Query()
+		query.Set("token", batch.Handshake.Token)
+		t.pollURL.RawQuery = query.Encode()
+	}
+	t.pending = append(t.pending, messages...)
+	if finalIndex > -1 {
+		t.finalIndex = finalIndex
+	}
+	if batch.Complete {
+		t.pendingClose = &utils.PollError{Code: websocket.CloseNormalClosure, Reason: "sequence complete"}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+// This could be made configurable.
+const tcpDialTimeout = 10 * time.Second
+
+type tcpTransport struct {
+	*utils.TCPConn
+	closeHandler func(code int, text string) error
+}
+
+// Connects and sends the handshake frame, the server replies with
+// the sequence or an error frame.
+func dialTCP(
+	address string,
+	useTLS bool,
+	tlsConfig *tls.Config,
+	query url.Values,
+	lastReceived string,
+	closeHandler func(code int, text string) error,
+) (*tcpTransport, error) {
+	// Retrying will not fix a handshake that can not be encoded.
+	handshake, err := utils.TCPHandshakeFromQuery(query, lastReceived)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+	handshakeFrame, err := utils.EncodeTCPHandshake(handshake)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+
+	dialer := &net.Dialer{Timeout: tcpDialTimeout}
+	var netConn net.Conn
+	if useTLS {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tcpTransport{
+		TCPConn:      utils.NewTCPConn(netConn),
+		closeHandler: closeHandler,
+	}
+	err = t.WriteMessage(handshakeFrame)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tcpTransport) ReadMessage() ([]byte, error) {
+	message, err := t.TCPConn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if message[0] != utils.TCPErrorPrefix {
+		return message, nil
+	}
+
+	code, reason, err := utils.DecodeTCPError(message)
+	if err != nil {
+		return nil, err
+	}
+	t.closeHandler(code, reason)
+	t.Close()
+	return nil, &websocket.CloseError{Code: code, Text: reason}
+}
+
+// The server treats the connection being closed once the error frame
+// has been read as the end of the closing handshake.
+func (t *tcpTransport) WriteClose(code int) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// NewTLSConfig creates the TLS configuration used to connect to a server over wss,
+// the CA bundle is optional and when not provided the system's root CAs are used.
+func NewTLSConfig(caBundleFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Only intended for local development against servers
+		// with self-signed certificates.
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caBundleFile == "" {
+		return tlsConfig, nil
+	}
+
+	caBundle, err := os.ReadFile(caBundleFile)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caBundle) {
+		return nil, errors.New("no valid PEM encoded certificates found in CA bundle")
+	}
+	tlsConfig.RootCAs = rootCAs
+	return tlsConfig, nil
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+const tokenPath = "/tokens"
+
+// ErrTokensNotRequired is returned by RequestToken when the server
+// does not require clients to authenticate.
+var ErrTokensNotRequired = errors.New("the server does not require client tokens")
+
+// RequestToken asks the server for the token for a client ID before the client
+// connects so the token can be recorded before the session exists, the token must be
+// provided as ClientParams.Token on the connection that creates the session.
+// Tokens can only be requested over HTTP so this is not supported for raw TCP,
+// clients over TCP are given their token in the handshake of a new session.
+func RequestToken(params *ClientParams, clientID string) (string, error) {
+	if params.Transport == TransportTCP {
+		return "", errors.New("tokens can not be requested over raw TCP")
+	}
+	c := &clientImpl{params: params}
+	scheme := "http"
+	if params.UseTLS {
+		scheme = "https"
+	}
+
+	resp, err := c.httpClient().Post(
+		c.buildUrl(scheme, tokenPath, url.Values{"clientId": {clientID}}),
+		"application/json",
+		http.NoBody,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrTokensNotRequired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request token: %s", resp.Status)
+	}
+	tokenResponse := &utils.TokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(tokenResponse)
+	if err != nil {
+		return "", err
+	}
+	return tokenResponse.Token, nil
+}
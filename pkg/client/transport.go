@@ -0,0 +1,259 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+// Transports the client can receive a sequence over.
+const (
+	TransportWebSocket = "websocket"
+	// Server-Sent Events, numbers are streamed as events and messages
+	// to the server are sent as separate requests.
+	TransportEventStream = "sse"
+	// Numbers are fetched in batches with long polls, for networks
+	// that do not allow long-lived connections.
+	// Sequences can not be stopped over long polling.
+	TransportLongPoll = "poll"
+	// Length-prefixed frames over a raw TCP connection for service-to-service use,
+	// the server port is the port of the server's TCP listener.
+	TransportTCP = "tcp"
+)
+
+// Paths of the Server-Sent Events endpoints on the server.
+const (
+	eventStreamPath         = "/events"
+	eventStreamMessagesPath = "/events/messages"
+)
+
+// A connection to the server over one of the supported transports,
+// messages are exchanged in the format of the codec for the connection.
+type transport interface {
+	// Returns a *websocket.CloseError once the server has closed
+	// the connection, after the close handler has been called.
+	ReadMessage() ([]byte, error)
+	WriteMessage(message []byte) error
+	// Completes the closing handshake started by the server
+	// for transports that have one.
+	WriteClose(code int) error
+	Close() error
+	StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams)
+	// Called for every message read from the server.
+	ExtendReadDeadline(params *utils.HeartbeatParams)
+}
+
+type webSocketTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *webSocketTransport) ReadMessage() ([]byte, error) {
+	_, message, err := t.conn.ReadMessage()
+	return message, err
+}
+
+func (t *webSocketTransport) WriteMessage(message []byte) error {
+	return t.conn.WriteMessage(websocket.BinaryMessage, message)
+}
+
+func (t *webSocketTransport) WriteClose(code int) error {
+	message := websocket.FormatCloseMessage(code, "")
+	return t.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
+
+func (t *webSocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *webSocketTransport) StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams) {
+	utils.StartHeartbeat(ctx, t.conn, params)
+}
+
+func (t *webSocketTransport) ExtendReadDeadline(params *utils.HeartbeatParams) {
+	utils.ExtendReadDeadline(t.conn, params)
+}
+
+type eventStreamTransport struct {
+	httpClient *http.Client
+	// Guarded by mu as the token is added once the handshake of a new session is read.
+	messagesURL  url.URL
+	body         io.ReadCloser
+	reader       *bufio.Reader
+	closeHandler func(code int, text string) error
+	mu           sync.Mutex
+	// Closes the stream when the server has been silent for longer
+	// than the pong timeout, nil when heartbeats are disabled.
+	idleTimer *time.Timer
+	heartbeat *utils.HeartbeatParams
+}
+
+// Opens an event stream, the last event ID is the index of the last
+// number received in the same way browsers resume an event stream.
+func dialEventStream(
+	httpClient *http.Client,
+	streamURL string,
+	messagesURL url.URL,
+	lastEventID string,
+	closeHandler func(code int, text string) error,
+) (*eventStreamTransport, error) {
+	req, err := http.NewRequest(http.MethodGet, streamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to open event stream: %s", resp.Status)
+	}
+
+	t := &eventStreamTransport{
+		httpClient:   httpClient,
+		messagesURL:  messagesURL,
+		body:         resp.Body,
+		closeHandler: closeHandler,
+	}
+	t.reader = bufio.NewReader(&heartbeatReader{reader: resp.Body, transport: t})
+	return t, nil
+}
+
+func (t *eventStreamTransport) ReadMessage() ([]byte, error) {
+	event, err := utils.ReadEvent(t.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Name != utils.EventClose {
+		message, err := utils.EventToMessage(event)
+		if err == nil && len(message) > 0 && message[0] == utils.SequenceHandshakePrefix {
+			t.useHandshakeToken(message[1:])
+		}
+		return message, err
+	}
+
+	closeMessage := &utils.EventStreamClose{}
+	err = json.Unmarshal([]byte(event.Data), closeMessage)
+	if err != nil {
+		return nil, err
+	}
+	t.closeHandler(closeMessage.Code, closeMessage.Reason)
+	t.body.Close()
+	return nil, &websocket.CloseError{Code: closeMessage.Code, Text: closeMessage.Reason}
+}
+
+// Messages are sent as separate requests that must carry the token
+// issued in the handshake of a new session.
+func (t *eventStreamTransport) useHandshakeToken(message []byte) {
+	handshake := &utils.SequenceHandshakeMessage{}
+	if json.Unmarshal(message, handshake) != nil || handshake.Token == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	query := t.messagesURL.Query()
+	query.Set("token", handshake.Token)
+	t.messagesURL.RawQuery = query.Encode()
+}
+
+func (t *eventStreamTransport) WriteMessage(message []byte) error {
+	t.mu.Lock()
+	messagesURL := t.messagesURL
+	t.mu.Unlock()
+	resp, err := t.httpClient.Post(messagesURL.String(), "application/octet-stream", bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused for the next message.
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to send message: %s", resp.Status)
+	}
+	return nil
+}
+
+// The server ends the stream after a close event
+// so there is no closing handshake.
+func (t *eventStreamTransport) WriteClose(code int) error {
+	return nil
+}
+
+func (t *eventStreamTransport) Close() error {
+	t.mu.Lock()
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+	}
+	t.mu.Unlock()
+
+	t.httpClient.CloseIdleConnections()
+	return t.body.Close()
+}
+
+// The server sends pings as comments that the client can not respond to,
+// any data received from the server counts towards the stream being alive.
+func (t *eventStreamTransport) StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams) {
+	if !params.Enabled() {
+		return
+	}
+
+	t.mu.Lock()
+	t.heartbeat = params
+	t.idleTimer = time.AfterFunc(time.Duration(params.PongTimeout)*time.Millisecond, func() {
+		t.body.Close()
+	})
+	t.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.idleTimer.Stop()
+	}()
+}
+
+func (t *eventStreamTransport) ExtendReadDeadline(params *utils.HeartbeatParams) {
+	t.extendReadDeadline()
+}
+
+func (t *eventStreamTransport) extendReadDeadline() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.idleTimer != nil {
+		t.idleTimer.Reset(time.Duration(t.heartbeat.PongTimeout) * time.Millisecond)
+	}
+}
+
+// Extends the read deadline of the event stream whenever
+// data is read, including comments sent as pings.
+type heartbeatReader struct {
+	reader    io.Reader
+	transport *eventStreamTransport
+}
+
+func (r *heartbeatReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.transport.extendReadDeadline()
+	}
+	return n, err
+}
@@ -8,6 +8,8 @@ import (
 type ClientConfig struct {
 	SendLastReceivedIndex bool
 	MaxReconnectAttempts  int
+	PingInterval          int
+	PongTimeout           int
 	LogLevel              string
 }
 
@@ -32,6 +34,24 @@ func LoadForClient() (*ClientConfig, error) {
 		return nil, err
 	}
 
+	pingIntervalStr, pingIntervalExists := os.LookupEnv("PING_INTERVAL")
+	if !pingIntervalExists {
+		pingIntervalStr = "5000"
+	}
+	pingInterval, err := strconv.Atoi(pingIntervalStr)
+	if err != nil {
+		return nil, err
+	}
+
+	pongTimeoutStr, pongTimeoutExists := os.LookupEnv("PONG_TIMEOUT")
+	if !pongTimeoutExists {
+		pongTimeoutStr = "15000"
+	}
+	pongTimeout, err := strconv.Atoi(pongTimeoutStr)
+	if err != nil {
+		return nil, err
+	}
+
 	logLevel, logLevelExists := os.LookupEnv("LOG_LEVEL")
 	if !logLevelExists {
 		logLevel = "info"
@@ -40,6 +60,8 @@ func LoadForClient() (*ClientConfig, error) {
 	return &ClientConfig{
 		SendLastReceivedIndex: sendLastReceived,
 		MaxReconnectAttempts:  maxReconnectAttempts,
+		PingInterval:          pingInterval,
+		PongTimeout:           pongTimeout,
 		LogLevel:              logLevel,
 	}, nil
 }
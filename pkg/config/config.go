@@ -1,16 +1,54 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	SequenceMessageInterval    int
-	SessionStateIdleTimeExpiry int
-	LogLevel                   string
+	SequenceMessageInterval        int
+	MinSequenceMessageInterval     int
+	MaxSequenceMessageInterval     int
+	SequenceGenerator              string
+	SequenceGeneratorSeed          *int64
+	SequenceGeneratorFilePath      string
+	ClientSelectableGenerators     []string
+	SessionStateIdleTimeExpiry     int
+	SessionStateCleanupInterval    int
+	SessionStateTombstoneTTL       int
+	SessionStore                   string
+	SessionStoreFilePath           string
+	SessionStoreCompactionInterval int
+	SessionConflictPolicy          string
+	ShutdownGracePeriod            int
+	SendWindowSize                 int
+	RetransmitTimeout              int
+	CheckpointInterval             int
+	MaxBatchSize                   int
+	PollBatchSize                  int
+	PollTimeout                    int
+	TCPPort                        int
+	PingInterval                   int
+	PongTimeout                    int
+	TLSCertFile                    string
+	TLSKeyFile                     string
+	AdminToken                     string
+	ClientTokenKeys                []ClientTokenKey
+	LogLevel                       string
 }
 
+// A key for signing and verifying client tokens.
+type ClientTokenKey struct {
+	ID     string
+	Secret string
+}
+
+// The shortest secret accepted for signing client tokens.
+const minClientTokenSecretLength = 16
+
 func Load() (*Config, error) {
 	intervalStr, intervalExists := os.LookupEnv("SEQUENCE_MESSAGE_INTERVAL")
 	if !intervalExists {
@@ -21,6 +59,67 @@ func Load() (*Config, error) {
 		return nil, err
 	}
 
+	minIntervalStr, minIntervalExists := os.LookupEnv("MIN_SEQUENCE_MESSAGE_INTERVAL")
+	if !minIntervalExists {
+		minIntervalStr = "1"
+	}
+	minSequenceMessageInterval, err := strconv.Atoi(minIntervalStr)
+	if err != nil {
+		return nil, err
+	}
+
+	maxIntervalStr, maxIntervalExists := os.LookupEnv("MAX_SEQUENCE_MESSAGE_INTERVAL")
+	if !maxIntervalExists {
+		maxIntervalStr = "60000"
+	}
+	maxSequenceMessageInterval, err := strconv.Atoi(maxIntervalStr)
+	if err != nil {
+		return nil, err
+	}
+
+	sequenceGenerator, sequenceGeneratorExists := os.LookupEnv("SEQUENCE_GENERATOR")
+	if !sequenceGeneratorExists {
+		sequenceGenerator = "seeded"
+	}
+	err = validateGeneratorName(sequenceGenerator)
+	if err != nil {
+		return nil, err
+	}
+
+	var sequenceGeneratorSeed *int64
+	seedStr := os.Getenv("SEQUENCE_GENERATOR_SEED")
+	if seedStr != "" {
+		seed, err := strconv.ParseInt(seedStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sequenceGeneratorSeed = &seed
+	}
+
+	sequenceGeneratorFilePath := os.Getenv("SEQUENCE_GENERATOR_FILE_PATH")
+
+	clientSelectableGenerators := []string{}
+	clientSelectableStr := os.Getenv("CLIENT_SELECTABLE_GENERATORS")
+	for _, name := range strings.Split(clientSelectableStr, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		err = validateGeneratorName(name)
+		if err != nil {
+			return nil, err
+		}
+		clientSelectableGenerators = append(clientSelectableGenerators, name)
+	}
+
+	usesFileGenerator := sequenceGenerator == "file"
+	for _, name := range clientSelectableGenerators {
+		usesFileGenerator = usesFileGenerator || name == "file"
+	}
+	if usesFileGenerator && sequenceGeneratorFilePath == "" {
+		return nil, errors.New("SEQUENCE_GENERATOR_FILE_PATH must be provided to use the file sequence generator")
+	}
+
 	expiryStr, expiryExists := os.LookupEnv("SESSION_STATE_IDLE_TIME_EXPIRY")
 	if !expiryExists {
 		expiryStr = "30"
@@ -32,14 +131,237 @@ func Load() (*Config, error) {
 		return nil, err
 	}
 
+	cleanupStr, cleanupExists := os.LookupEnv("SESSION_STATE_CLEANUP_INTERVAL")
+	if !cleanupExists {
+		cleanupStr = "60"
+	}
+	sessionStateCleanupInterval, err := strconv.Atoi(cleanupStr)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstoneTTLStr, tombstoneTTLExists := os.LookupEnv("SESSION_STATE_TOMBSTONE_TTL")
+	if !tombstoneTTLExists {
+		tombstoneTTLStr = "3600"
+	}
+	sessionStateTombstoneTTL, err := strconv.Atoi(tombstoneTTLStr)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionStore, sessionStoreExists := os.LookupEnv("SESSION_STORE")
+	if !sessionStoreExists {
+		sessionStore = "memory"
+	}
+	if sessionStore != "memory" && sessionStore != "file" {
+		return nil, fmt.Errorf("unsupported session store %q, must be one of memory or file", sessionStore)
+	}
+
+	sessionStoreFilePath, sessionStoreFilePathExists := os.LookupEnv("SESSION_STORE_FILE_PATH")
+	if !sessionStoreFilePathExists {
+		sessionStoreFilePath = "data/sessions.wal"
+	}
+
+	compactionStr, compactionExists := os.LookupEnv("SESSION_STORE_COMPACTION_INTERVAL")
+	if !compactionExists {
+		compactionStr = "60"
+	}
+	sessionStoreCompactionInterval, err := strconv.Atoi(compactionStr)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionConflictPolicy, sessionConflictPolicyExists := os.LookupEnv("SESSION_CONFLICT_POLICY")
+	if !sessionConflictPolicyExists {
+		sessionConflictPolicy = "takeover"
+	}
+	if sessionConflictPolicy != "takeover" && sessionConflictPolicy != "reject" {
+		return nil, fmt.Errorf(
+			"unsupported session conflict policy %q, must be one of takeover or reject",
+			sessionConflictPolicy,
+		)
+	}
+
+	gracePeriodStr, gracePeriodExists := os.LookupEnv("SHUTDOWN_GRACE_PERIOD")
+	if !gracePeriodExists {
+		gracePeriodStr = "10"
+	}
+	shutdownGracePeriod, err := strconv.Atoi(gracePeriodStr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be provided together")
+	}
+
+	windowSizeStr, windowSizeExists := os.LookupEnv("SEND_WINDOW_SIZE")
+	if !windowSizeExists {
+		windowSizeStr = "64"
+	}
+	sendWindowSize, err := strconv.Atoi(windowSizeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	retransmitTimeoutStr, retransmitTimeoutExists := os.LookupEnv("RETRANSMIT_TIMEOUT")
+	if !retransmitTimeoutExists {
+		retransmitTimeoutStr = "5000"
+	}
+	retransmitTimeout, err := strconv.Atoi(retransmitTimeoutStr)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpointIntervalStr, checkpointIntervalExists := os.LookupEnv("CHECKPOINT_INTERVAL")
+	if !checkpointIntervalExists {
+		checkpointIntervalStr = "1000"
+	}
+	checkpointInterval, err := strconv.Atoi(checkpointIntervalStr)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBatchSizeStr, maxBatchSizeExists := os.LookupEnv("MAX_BATCH_SIZE")
+	if !maxBatchSizeExists {
+		maxBatchSizeStr = "1000"
+	}
+	maxBatchSize, err := strconv.Atoi(maxBatchSizeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	pollBatchSizeStr, pollBatchSizeExists := os.LookupEnv("POLL_BATCH_SIZE")
+	if !pollBatchSizeExists {
+		pollBatchSizeStr = "100"
+	}
+	pollBatchSize, err := strconv.Atoi(pollBatchSizeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	pollTimeoutStr, pollTimeoutExists := os.LookupEnv("POLL_TIMEOUT")
+	if !pollTimeoutExists {
+		pollTimeoutStr = "20000"
+	}
+	pollTimeout, err := strconv.Atoi(pollTimeoutStr)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpPortStr, tcpPortExists := os.LookupEnv("TCP_PORT")
+	if !tcpPortExists {
+		tcpPortStr = "0"
+	}
+	tcpPort, err := strconv.Atoi(tcpPortStr)
+	if err != nil {
+		return nil, err
+	}
+
+	pingIntervalStr, pingIntervalExists := os.LookupEnv("PING_INTERVAL")
+	if !pingIntervalExists {
+		pingIntervalStr = "5000"
+	}
+	pingInterval, err := strconv.Atoi(pingIntervalStr)
+	if err != nil {
+		return nil, err
+	}
+
+	pongTimeoutStr, pongTimeoutExists := os.LookupEnv("PONG_TIMEOUT")
+	if !pongTimeoutExists {
+		pongTimeoutStr = "15000"
+	}
+	pongTimeout, err := strconv.Atoi(pongTimeoutStr)
+	if err != nil {
+		return nil, err
+	}
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
+	clientTokenKeys, err := parseClientTokenKeys(os.Getenv("CLIENT_TOKEN_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+
 	logLevel, logLevelExists := os.LookupEnv("LOG_LEVEL")
 	if !logLevelExists {
 		logLevel = "info"
 	}
 
 	return &Config{
-		SequenceMessageInterval:    sequenceMessageInterval,
-		SessionStateIdleTimeExpiry: sessionStateIdleTimeExpiry,
-		LogLevel:                   logLevel,
+		SequenceMessageInterval:        sequenceMessageInterval,
+		MinSequenceMessageInterval:     minSequenceMessageInterval,
+		MaxSequenceMessageInterval:     maxSequenceMessageInterval,
+		SequenceGenerator:              sequenceGenerator,
+		SequenceGeneratorSeed:          sequenceGeneratorSeed,
+		SequenceGeneratorFilePath:      sequenceGeneratorFilePath,
+		ClientSelectableGenerators:     clientSelectableGenerators,
+		SessionStateIdleTimeExpiry:     sessionStateIdleTimeExpiry,
+		SessionStateCleanupInterval:    sessionStateCleanupInterval,
+		SessionStateTombstoneTTL:       sessionStateTombstoneTTL,
+		SessionStore:                   sessionStore,
+		SessionStoreFilePath:           sessionStoreFilePath,
+		SessionStoreCompactionInterval: sessionStoreCompactionInterval,
+		SessionConflictPolicy:          sessionConflictPolicy,
+		ShutdownGracePeriod:            shutdownGracePeriod,
+		SendWindowSize:                 sendWindowSize,
+		RetransmitTimeout:              retransmitTimeout,
+		CheckpointInterval:             checkpointInterval,
+		MaxBatchSize:                   maxBatchSize,
+		PollBatchSize:                  pollBatchSize,
+		PollTimeout:                    pollTimeout,
+		TCPPort:                        tcpPort,
+		PingInterval:                   pingInterval,
+		PongTimeout:                    pongTimeout,
+		TLSCertFile:                    tlsCertFile,
+		TLSKeyFile:                     tlsKeyFile,
+		AdminToken:                     adminToken,
+		ClientTokenKeys:                clientTokenKeys,
+		LogLevel:                       logLevel,
 	}, nil
 }
+
+func validateGeneratorName(name string) error {
+	if name != "seeded" && name != "crypto" && name != "counter" && name != "file" {
+		return fmt.Errorf(
+			"unsupported sequence generator %q, must be one of seeded, crypto, counter or file",
+			name,
+		)
+	}
+	return nil
+}
+
+// Parses a comma-separated list of keys in the form id:secret,
+// the order of the keys is preserved as the first key signs new tokens.
+func parseClientTokenKeys(keysStr string) ([]ClientTokenKey, error) {
+	keys := []ClientTokenKey{}
+	keyIDs := map[string]bool{}
+	for _, keyStr := range strings.Split(keysStr, ",") {
+		keyStr = strings.TrimSpace(keyStr)
+		if keyStr == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(keyStr, ":")
+		if !found || id == "" || len(id) > 32 || strings.Contains(id, ".") {
+			return nil, errors.New(
+				"CLIENT_TOKEN_KEYS must be a comma-separated list of id:secret pairs " +
+					"with IDs of at most 32 characters that do not contain \".\"",
+			)
+		}
+		if len(secret) < minClientTokenSecretLength {
+			return nil, fmt.Errorf(
+				"the secret for client token key %q must be at least %d characters",
+				id,
+				minClientTokenSecretLength,
+			)
+		}
+		if keyIDs[id] {
+			return nil, fmt.Errorf("client token key %q is provided more than once", id)
+		}
+		keyIDs[id] = true
+		keys = append(keys, ClientTokenKey{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
@@ -0,0 +1,303 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds a set of metrics and exposes them in the Prometheus
+// text exposition format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// A set of values for a metric keyed by the serialised label values.
+type series struct {
+	mu         sync.Mutex
+	metricName string
+	help       string
+	metricType string
+	labelNames []string
+	values     map[string]float64
+}
+
+func newSeries(name string, help string, metricType string, labelNames []string) *series {
+	return &series{
+		metricName: name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+	}
+}
+
+func (s *series) name() string {
+	return s.metricName
+}
+
+func (s *series) add(delta float64, labelValues []string) {
+	key := s.key(labelValues)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] += delta
+}
+
+func (s *series) set(value float64, labelValues []string) {
+	key := s.key(labelValues)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+func (s *series) key(labelValues []string) string {
+	if len(labelValues) != len(s.labelNames) {
+		panic(fmt.Sprintf(
+			"metric %s expects %d label values, received %d",
+			s.metricName, len(s.labelNames), len(labelValues),
+		))
+	}
+	return formatLabels(s.labelNames, labelValues)
+}
+
+func (s *series) write(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeHeader(w, s.metricName, s.help, s.metricType)
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", s.metricName, key, formatValue(s.values[key]))
+	}
+}
+
+// Counter is a value that only ever increases.
+type Counter struct {
+	series *series
+}
+
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{series: newSeries(name, help, "counter", labelNames)}
+	r.register(counter.series)
+	return counter
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.series.add(1, labelValues)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counters can not decrease")
+	}
+	c.series.add(delta, labelValues)
+}
+
+// Gauge is a value that can increase and decrease.
+type Gauge struct {
+	series *series
+}
+
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	gauge := &Gauge{series: newSeries(name, help, "gauge", labelNames)}
+	r.register(gauge.series)
+	return gauge
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.series.add(1, labelValues)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.series.add(-1, labelValues)
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.series.set(value, labelValues)
+}
+
+// A gauge with values that are collected at the time of each scrape.
+type gaugeFunc struct {
+	metricName string
+	help       string
+	labelName  string
+	collect    func() map[string]float64
+}
+
+// NewGaugeFunc registers a gauge with a single label whose values are provided
+// by collect, keyed by label value, every time metrics are written.
+func (r *Registry) NewGaugeFunc(name string, help string, labelName string, collect func() map[string]float64) {
+	r.register(&gaugeFunc{
+		metricName: name,
+		help:       help,
+		labelName:  labelName,
+		collect:    collect,
+	})
+}
+
+func (g *gaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	values := g.collect()
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	writeHeader(w, g.metricName, g.help, "gauge")
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(
+			w, "%s%s %s\n",
+			g.metricName,
+			formatLabels([]string{g.labelName}, []string{labelValue}),
+			formatValue(values[labelValue]),
+		)
+	}
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	mu         sync.Mutex
+	metricName string
+	help       string
+	buckets    []float64
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+// NewHistogram creates a histogram with the given upper bounds for each bucket,
+// the +Inf bucket is added automatically.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	histogram := &Histogram{
+		metricName: name,
+		help:       help,
+		buckets:    sorted,
+		counts:     make([]uint64, len(sorted)),
+	}
+	r.register(histogram)
+	return histogram
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			h.counts[i] += 1
+		}
+	}
+	h.sum += value
+	h.count += 1
+}
+
+func (h *Histogram) name() string {
+	return h.metricName
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.metricName, h.help, "histogram")
+	for i, upperBound := range h.buckets {
+		fmt.Fprintf(
+			w, "%s_bucket%s %d\n",
+			h.metricName,
+			formatLabels([]string{"le"}, []string{formatValue(upperBound)}),
+			h.counts[i],
+		)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func formatLabels(labelNames []string, labelValues []string) string {
+	if len(labelNames) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", labelName, escapeLabelValue(labelValues[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_registry_writes_metrics_in_prometheus_text_format(t *testing.T) {
+	registry := NewRegistry()
+
+	counter := registry.NewCounter("test_requests_total", "Requests by \"code\".", "code")
+	counter.Inc("200")
+	counter.Add(2, "500")
+	counter.Inc("200")
+
+	gauge := registry.NewGauge("test_in_flight", "Requests in flight.")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	registry.NewGaugeFunc("test_queue_length", "Queue length\nby queue.", "queue", func() map[string]float64 {
+		return map[string]float64{"b": 2, "a\"quoted\"": 1}
+	})
+
+	histogram := registry.NewHistogram("test_latency_seconds", "Latency.", []float64{1, 0.1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	buf := &bytes.Buffer{}
+	registry.Write(buf)
+
+	expected := `# HELP test_in_flight Requests in flight.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 3.55
+test_latency_seconds_count 3
+# HELP test_queue_length Queue length\nby queue.
+# TYPE test_queue_length gauge
+test_queue_length{queue="a\"quoted\""} 1
+test_queue_length{queue="b"} 2
+# HELP test_requests_total Requests by "code".
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="500"} 2
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\nreceived:\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,18 @@
+package sequence
+
+// NewCounterGenerator creates a generator that produces the index of each
+// number as the number itself, wrapping back to 0 at the maximum number.
+// This is primarily useful for debugging as gaps and duplicates are easy to spot.
+func NewCounterGenerator() SequenceGenerator {
+	return &counterGenerator{}
+}
+
+type counterGenerator struct{}
+
+func (g *counterGenerator) Name() string {
+	return GeneratorCounter
+}
+
+func (g *counterGenerator) Generate(size int, maxNumber uint32) (*GeneratedSequence, error) {
+	return &GeneratedSequence{Sequence: Counter(size, maxNumber)}, nil
+}
@@ -0,0 +1,34 @@
+package sequence
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+)
+
+// NewCryptoGenerator creates a generator that derives numbers from
+// a key drawn from the operating system's cryptographically secure random
+// number generator, each number is the AES encryption of its index under the key.
+// Sequences can not be reproduced without the key so it is never shared with clients.
+func NewCryptoGenerator() SequenceGenerator {
+	return &cryptoGenerator{}
+}
+
+type cryptoGenerator struct{}
+
+func (g *cryptoGenerator) Name() string {
+	return GeneratorCrypto
+}
+
+func (g *cryptoGenerator) Generate(size int, maxNumber uint32) (*GeneratedSequence, error) {
+	key := make([]byte, aes.BlockSize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyed, err := Keyed(key, size, maxNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &GeneratedSequence{Sequence: keyed}, nil
+}
@@ -0,0 +1,60 @@
+package sequence
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NewFileGenerator creates a generator that replays the exact list of numbers
+// in the file at the given path, one decimal number per line.
+// Sequences are truncated to the requested size, when the file holds fewer
+// numbers than requested the sequence is the full list.
+// Numbers are replayed as they are without applying the maximum number.
+func NewFileGenerator(path string) (SequenceGenerator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	numbers := []uint32{}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		number, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number on line %d of %s: %w", line, path, err)
+		}
+		numbers = append(numbers, uint32(number))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &fileGenerator{numbers: numbers}, nil
+}
+
+type fileGenerator struct {
+	numbers []uint32
+}
+
+func (g *fileGenerator) Name() string {
+	return GeneratorFile
+}
+
+func (g *fileGenerator) Generate(size int, maxNumber uint32) (*GeneratedSequence, error) {
+	if size > len(g.numbers) {
+		size = len(g.numbers)
+	}
+	// Every sequence shares the list loaded from the file
+	// as sequences are never modified.
+	return &GeneratedSequence{Sequence: List(g.numbers[:size])}, nil
+}
@@ -0,0 +1,25 @@
+package sequence
+
+// Names of the built-in generators used to select them
+// through configuration and the generator query parameter.
+const (
+	GeneratorSeeded  = "seeded"
+	GeneratorCrypto  = "crypto"
+	GeneratorCounter = "counter"
+	GeneratorFile    = "file"
+)
+
+type SequenceGenerator interface {
+	// The name clients use to select the generator.
+	Name() string
+	// Generates a sequence of up to size numbers where each number
+	// is less than maxNumber.
+	Generate(size int, maxNumber uint32) (*GeneratedSequence, error)
+}
+
+type GeneratedSequence struct {
+	Sequence Sequence
+	// The seed the numbers were derived from, only set by
+	// generators that can reproduce a sequence from a seed.
+	Seed *int64
+}
@@ -0,0 +1,65 @@
+package sequence
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// NewSeededGenerator creates a generator that deterministically derives
+// each number from a seed, so a sequence can be reproduced from its seed alone.
+// A new random seed is chosen for every sequence unless a fixed seed is provided.
+func NewSeededGenerator(seed *int64) SequenceGenerator {
+	return &seededGenerator{seed: seed}
+}
+
+type seededGenerator struct {
+	seed *int64
+}
+
+func (g *seededGenerator) Name() string {
+	return GeneratorSeeded
+}
+
+func (g *seededGenerator) Generate(size int, maxNumber uint32) (*GeneratedSequence, error) {
+	seed, err := g.nextSeed()
+	if err != nil {
+		return nil, err
+	}
+
+	return &GeneratedSequence{Sequence: Seeded(seed, size, maxNumber), Seed: &seed}, nil
+}
+
+func (g *seededGenerator) nextSeed() (int64, error) {
+	if g.seed != nil {
+		return *g.seed, nil
+	}
+
+	seedBytes := make([]byte, 8)
+	_, err := rand.Read(seedBytes)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(seedBytes)), nil
+}
+
+// SeededNumber computes the number at the given index of the sequence for a seed,
+// numbers are computed independently of each other so any index can be
+// computed without generating the numbers before it.
+func SeededNumber(seed int64, index int, maxNumber uint32) uint32 {
+	if maxNumber == 0 {
+		return 0
+	}
+	return uint32(splitmix64(uint64(seed)+uint64(index)*splitmixIncrement) % uint64(maxNumber))
+}
+
+const splitmixIncrement uint64 = 0x9e3779b97f4a7c15
+
+// The SplitMix64 finaliser, a fast mixing function with good statistical properties
+// that is used to seed other PRNGs, this is not cryptographically secure.
+// https://prng.di.unimi.it/splitmix64.c
+func splitmix64(x uint64) uint64 {
+	x += splitmixIncrement
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,197 @@
+package sequence
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+// Sequence provides random access to the numbers in a sequence,
+// implementations derive numbers on demand where possible so a sequence
+// does not need to be held in memory in full.
+type Sequence interface {
+	Len() int
+	// The number at the given index, the index must be less than Len.
+	At(index int) uint32
+	// A serialisable description the sequence can be recreated from.
+	Spec() Spec
+}
+
+// UnboundedLength is the length of sequences that are streamed until the client
+// asks the server to stop, every index that can be represented on the wire
+// as a uint32 is available in an unbounded sequence.
+const UnboundedLength = 1 << 32
+
+// IsUnbounded determines whether a sequence is streamed until the client
+// asks the server to stop rather than having a fixed length.
+func IsUnbounded(sequence Sequence) bool {
+	return sequence.Len() >= UnboundedLength
+}
+
+// Kinds of sequence specs.
+const (
+	KindSeeded  = "seeded"
+	KindKeyed   = "keyed"
+	KindCounter = "counter"
+	KindList    = "list"
+)
+
+type Spec struct {
+	Kind      string   `json:"kind"`
+	Length    int      `json:"length"`
+	Seed      int64    `json:"seed,omitempty"`
+	Key       []byte   `json:"key,omitempty"`
+	MaxNumber uint32   `json:"maxNumber,omitempty"`
+	Numbers   []uint32 `json:"numbers,omitempty"`
+}
+
+// FromSpec recreates a sequence from its spec.
+func FromSpec(spec Spec) (Sequence, error) {
+	switch spec.Kind {
+	case KindSeeded:
+		return Seeded(spec.Seed, spec.Length, spec.MaxNumber), nil
+	case KindKeyed:
+		return Keyed(spec.Key, spec.Length, spec.MaxNumber)
+	case KindCounter:
+		return Counter(spec.Length, spec.MaxNumber), nil
+	case KindList:
+		return List(spec.Numbers), nil
+	default:
+		return nil, fmt.Errorf("unknown sequence kind %q", spec.Kind)
+	}
+}
+
+// Seeded creates a sequence where each number is derived from
+// the seed and its index, see SeededNumber.
+func Seeded(seed int64, length int, maxNumber uint32) Sequence {
+	return &seededSequence{seed: seed, length: length, maxNumber: maxNumber}
+}
+
+type seededSequence struct {
+	seed      int64
+	length    int
+	maxNumber uint32
+}
+
+func (s *seededSequence) Len() int {
+	return s.length
+}
+
+func (s *seededSequence) At(index int) uint32 {
+	return SeededNumber(s.seed, index, s.maxNumber)
+}
+
+func (s *seededSequence) Spec() Spec {
+	return Spec{Kind: KindSeeded, Length: s.length, Seed: s.seed, MaxNumber: s.maxNumber}
+}
+
+// Keyed creates a sequence where each number is derived from the AES encryption
+// of its index under the key, the key must be 16, 24 or 32 bytes long.
+// Numbers are reduced from 64 bits so the bias towards smaller numbers
+// introduced by the modulo is negligible.
+func Keyed(key []byte, length int, maxNumber uint32) (Sequence, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &keyedSequence{key: key, block: block, length: length, maxNumber: maxNumber}, nil
+}
+
+type keyedSequence struct {
+	key       []byte
+	block     cipher.Block
+	length    int
+	maxNumber uint32
+}
+
+func (s *keyedSequence) Len() int {
+	return s.length
+}
+
+func (s *keyedSequence) At(index int) uint32 {
+	if s.maxNumber == 0 {
+		return 0
+	}
+	var buf [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(index))
+	s.block.Encrypt(buf[:], buf[:])
+	return uint32(binary.LittleEndian.Uint64(buf[:]) % uint64(s.maxNumber))
+}
+
+func (s *keyedSequence) Spec() Spec {
+	return Spec{Kind: KindKeyed, Length: s.length, Key: s.key, MaxNumber: s.maxNumber}
+}
+
+// Counter creates a sequence where each number is its own index,
+// wrapping back to 0 at the maximum number.
+func Counter(length int, maxNumber uint32) Sequence {
+	return &counterSequence{length: length, maxNumber: maxNumber}
+}
+
+type counterSequence struct {
+	length    int
+	maxNumber uint32
+}
+
+func (s *counterSequence) Len() int {
+	return s.length
+}
+
+func (s *counterSequence) At(index int) uint32 {
+	if s.maxNumber == 0 {
+		return 0
+	}
+	return uint32(index) % s.maxNumber
+}
+
+func (s *counterSequence) Spec() Spec {
+	return Spec{Kind: KindCounter, Length: s.length, MaxNumber: s.maxNumber}
+}
+
+// List creates a sequence backed by an exact list of numbers
+// for sequences that can not be derived, the list must not be modified.
+func List(numbers []uint32) Sequence {
+	return listSequence(numbers)
+}
+
+type listSequence []uint32
+
+func (s listSequence) Len() int {
+	return len(s)
+}
+
+func (s listSequence) At(index int) uint32 {
+	return s[index]
+}
+
+func (s listSequence) Spec() Spec {
+	return Spec{Kind: KindList, Length: len(s), Numbers: s}
+}
+
+// Numbers materialises every number in the sequence.
+func Numbers(sequence Sequence) []uint32 {
+	numbers := make([]uint32, sequence.Len())
+	for i := range numbers {
+		numbers[i] = sequence.At(i)
+	}
+	return numbers
+}
+
+// Checksum produces the same checksum as utils.CreateChecksum
+// without materialising the sequence.
+func Checksum(sequence Sequence) string {
+	return RangeChecksum(sequence, 0, sequence.Len())
+}
+
+// RangeChecksum produces the same checksum as utils.CreateChecksum for
+// the numbers from the start index (inclusive) to the end index (exclusive).
+func RangeChecksum(sequence Sequence, start int, end int) string {
+	checksum := utils.NewChecksum()
+	for i := start; i < end; i++ {
+		checksum.Add(sequence.At(i))
+	}
+	return checksum.Sum()
+}
@@ -0,0 +1,146 @@
+package sequence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+func Test_seeded_generator_reproduces_sequences_from_a_seed(t *testing.T) {
+	generated, err := NewSeededGenerator(nil).Generate(100, 0xffff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.Seed == nil {
+		t.Fatal("expected the seed to be provided")
+	}
+
+	reproduced, err := NewSeededGenerator(generated.Seed).Generate(100, 0xffff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, number := range Numbers(generated.Sequence) {
+		if reproduced.Sequence.At(i) != number || SeededNumber(*generated.Seed, i, 0xffff) != number {
+			t.Fatalf("expected number at index %d to be reproduced from the seed", i)
+		}
+		if number >= 0xffff {
+			t.Fatalf("expected number at index %d to be less than the maximum, received %d", i, number)
+		}
+	}
+}
+
+func Test_crypto_generator_produces_numbers_below_the_maximum(t *testing.T) {
+	generated, err := NewCryptoGenerator().Generate(1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.Sequence.Len() != 1000 || generated.Seed != nil {
+		t.Fatalf("expected 1000 numbers without a seed, received %d", generated.Sequence.Len())
+	}
+	for i, number := range Numbers(generated.Sequence) {
+		if number >= 10 {
+			t.Fatalf("expected number at index %d to be less than 10, received %d", i, number)
+		}
+	}
+}
+
+func Test_counter_generator_produces_indexes(t *testing.T) {
+	generated, err := NewCounterGenerator().Generate(5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNumbers(t, Numbers(generated.Sequence), []uint32{0, 1, 2, 0, 1})
+}
+
+func Test_file_generator_replays_numbers_from_file(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sequence.txt")
+	err := os.WriteFile(path, []byte("5\n 10\n\n15\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generator, err := NewFileGenerator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, _ := generator.Generate(2, 0xffff)
+	assertNumbers(t, Numbers(truncated.Sequence), []uint32{5, 10})
+	full, _ := generator.Generate(10, 0xffff)
+	assertNumbers(t, Numbers(full.Sequence), []uint32{5, 10, 15})
+
+	err = os.WriteFile(path, []byte("5\nnot-a-number\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewFileGenerator(path)
+	if err == nil {
+		t.Fatal("expected an error for a file containing an invalid number")
+	}
+}
+
+func Test_sequences_are_recreated_from_their_spec(t *testing.T) {
+	sequences := []Sequence{
+		Seeded(42, 50, 0xffff),
+		Counter(50, 7),
+		List([]uint32{3, 1, 2}),
+		mustKeyed(t, make([]byte, 16), 50, 0xffff),
+	}
+	for _, original := range sequences {
+		recreated, err := FromSpec(original.Spec())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertNumbers(t, Numbers(recreated), Numbers(original))
+	}
+
+	_, err := FromSpec(Spec{Kind: "unknown"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown kind of sequence")
+	}
+}
+
+func Test_checksum_matches_checksum_of_materialised_sequence(t *testing.T) {
+	for _, seq := range []Sequence{Seeded(7, 1000, 0xffff), List([]uint32{}), List([]uint32{1})} {
+		expected := utils.CreateChecksum(Numbers(seq))
+		if Checksum(seq) != expected {
+			t.Fatalf("expected checksum %s, received %s", expected, Checksum(seq))
+		}
+	}
+}
+
+func Test_crypto_generator_does_not_hold_long_sequences_in_memory(t *testing.T) {
+	generated, err := NewCryptoGenerator().Generate(UnboundedLength, 0xffff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsUnbounded(generated.Sequence) || generated.Sequence.Spec().Kind != KindKeyed {
+		t.Fatalf("expected an unbounded keyed sequence, received %+v", generated.Sequence.Spec())
+	}
+	last := generated.Sequence.At(UnboundedLength - 1)
+	if last >= 0xffff || generated.Sequence.At(UnboundedLength-1) != last {
+		t.Fatalf("expected the last number to be derived consistently below the maximum, received %d", last)
+	}
+}
+
+func mustKeyed(t *testing.T, key []byte, length int, maxNumber uint32) Sequence {
+	t.Helper()
+	keyed, err := Keyed(key, length, maxNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyed
+}
+
+func assertNumbers(t *testing.T, actual []uint32, expected []uint32) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, received %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected %v, received %v", expected, actual)
+		}
+	}
+}
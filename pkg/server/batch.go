@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+// The longest flush interval in milliseconds clients can request,
+// longer intervals are reduced to this. This could be made configurable.
+const MaxBatchFlushInterval = 1000
+
+// Numbers held back to be sent together in a single frame.
+type numberBatch struct {
+	settings  utils.BatchSettingsMessage
+	fromIndex int
+	numbers   []uint32
+	// Fires once the flush interval has passed since the first number
+	// was added, nil while the batch is empty.
+	flushTimer <-chan time.Time
+}
+
+// Reads the batch settings requested by the client, the batch is nil when
+// the client has not requested batching or batching is disabled on the server.
+func (s *serverImpl) negotiateBatching(query url.Values) (*numberBatch, *sessionSetupError) {
+	batchSizeStr := query.Get("batchSize")
+	if batchSizeStr == "" {
+		return nil, nil
+	}
+
+	batchSize, err := strconv.Atoi(batchSizeStr)
+	flushInterval := 0
+	if batchIntervalStr := query.Get("batchInterval"); err == nil && batchIntervalStr != "" {
+		flushInterval, err = strconv.Atoi(batchIntervalStr)
+	}
+	if err != nil || batchSize < 0 || flushInterval < 0 {
+		s.logger.Error("Failed to parse batch settings: ", query.Get("batchSize"), " ", query.Get("batchInterval"))
+		return nil, &sessionSetupError{
+			code:   utils.CloseCodeInvalidBatchSettings,
+			reason: "batch size and interval must be non-negative integers",
+		}
+	}
+
+	if batchSize > s.params.MaxBatchSize {
+		batchSize = s.params.MaxBatchSize
+	}
+	// A batch of one number is no different to sending numbers individually.
+	if batchSize <= 1 {
+		return nil, nil
+	}
+	if flushInterval > MaxBatchFlushInterval {
+		flushInterval = MaxBatchFlushInterval
+	}
+	return &numberBatch{
+		settings: utils.BatchSettingsMessage{
+			BatchSize:     batchSize,
+			FlushInterval: flushInterval,
+		},
+		numbers: make([]uint32, 0, batchSize),
+	}, nil
+}
+
+func (b *numberBatch) add(index int, number uint32) {
+	if len(b.numbers) == 0 {
+		b.fromIndex = index
+		b.flushTimer = time.After(time.Duration(b.settings.FlushInterval) * time.Millisecond)
+	}
+	b.numbers = append(b.numbers, number)
+}
+
+// Whether the number at the index can be added to the batch,
+// numbers in a batch must be contiguous.
+func (b *numberBatch) follows(index int) bool {
+	return len(b.numbers) == 0 || index == b.fromIndex+len(b.numbers)
+}
+
+func (b *numberBatch) full() bool {
+	return len(b.numbers) >= b.settings.BatchSize
+}
+
+// The number of numbers waiting to be sent, safe to call
+// on a nil batch when batching is disabled.
+func (b *numberBatch) pending() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.numbers)
+}
+
+// Safe to call on a nil batch, a nil channel is never ready.
+func (b *numberBatch) timer() <-chan time.Time {
+	if b == nil {
+		return nil
+	}
+	return b.flushTimer
+}
+
+func (s *serverImpl) writeBatchSettings(conn clientConn, batch *numberBatch) error {
+	settingsBytes, err := json.Marshal(&batch.settings)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(append([]byte{utils.BatchSettingsPrefix}, settingsBytes...))
+}
+
+// Adds a number to the batch, sending the batch once it is full or when a checkpoint
+// is due so that checkpoints always follow the numbers they cover.
+func (s *serverImpl) batchNumber(
+	conn clientConn,
+	session sessions.SessionState,
+	window *sendWindow,
+	batch *numberBatch,
+	index int,
+	number uint32,
+) {
+	if !batch.follows(index) {
+		s.flushBatch(conn, session, window, batch)
+	}
+	batch.add(index, number)
+	if batch.full() || s.isCheckpointDue(session, index) {
+		s.flushBatch(conn, session, window, batch)
+	}
+}
+
+// Sends the numbers held in the batch and tracks them in the send window,
+// safe to call on a nil batch when batching is disabled.
+func (s *serverImpl) flushBatch(
+	conn clientConn,
+	session sessions.SessionState,
+	window *sendWindow,
+	batch *numberBatch,
+) {
+	if batch.pending() == 0 {
+		return
+	}
+
+	err := conn.WriteMessage(utils.EncodeNumberBatch(batch.fromIndex, batch.numbers))
+	if err != nil {
+		s.logger.Debug("batch write error, relying on retransmission or reconnection: ", err)
+	} else {
+		s.metrics.numbersSent.Add(float64(len(batch.numbers)))
+	}
+	for i, number := range batch.numbers {
+		window.add(batch.fromIndex+i, number)
+	}
+
+	lastIndex := batch.fromIndex + len(batch.numbers) - 1
+	batch.numbers = batch.numbers[:0]
+	batch.flushTimer = nil
+	s.writeCheckpointIfDue(conn, session, lastIndex)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+type sessionErrorCloseCode struct {
+	err    error
+	code   int
+	reason string
+}
+
+// Maps errors returned by a session store to the close codes
+// sent to clients, session store implementations must wrap or return
+// the sentinel errors from the sessions package for these to apply.
+var sessionErrorCloseCodes = []sessionErrorCloseCode{
+	{
+		err:    sessions.ErrSessionExpired,
+		code:   utils.CloseCodeExpiredSession,
+		reason: "session has expired",
+	},
+	{
+		// A session can only go missing after it has been initialised
+		// when it has been evicted, so from the client's perspective
+		// it has expired.
+		err:    sessions.ErrSessionNotFound,
+		code:   utils.CloseCodeExpiredSession,
+		reason: "session no longer exists",
+	},
+}
+
+// Determines the close code and reason to send to the client for an error
+// from the session store, errors that are not known to be caused by the client
+// are treated as internal server errors.
+func closeCodeForError(err error) (int, string) {
+	for _, mapping := range sessionErrorCloseCodes {
+		if errors.Is(err, mapping.err) {
+			return mapping.code, mapping.reason
+		}
+	}
+	return websocket.CloseInternalServerErr, "internal server error"
+}
+
+func (s *serverImpl) writeErrorCloseMessage(conn clientConn, err error) error {
+	code, reason := closeCodeForError(err)
+	return s.writeCloseMessage(conn, code, reason)
+}
+
+func (s *serverImpl) writeCloseMessage(conn clientConn, code int, reason string) error {
+	s.metrics.recordCloseCode(code)
+	return conn.WriteClose(code, reason)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+// How long a new connection waits for the connection it has taken over
+// to stop delivering the sequence before it starts delivering it.
+const evictionTimeout = 5 * time.Second
+
+// Stops delivery over a connection that has been taken over and closes it
+// without waiting for the client, which may no longer be there, to respond.
+// Must be called with the server lock held.
+func (s *serverImpl) evict(conn clientConn, live *liveConnection) {
+	s.logger.Debug("connection for client ", live.clientID, " taken over by a new connection")
+	live.stopSequence()
+	s.writeCloseMessage(conn, utils.CloseCodeSessionTakenOver, "session taken over by another connection")
+	conn.Close()
+}
+
+// Waits for a connection that has been taken over to stop taking numbers from
+// the session as two connections delivering the same session would split the sequence.
+func (s *serverImpl) waitForEviction(evicted *liveConnection) {
+	select {
+	case <-evicted.sequenceDone:
+	case <-time.After(evictionTimeout):
+		s.logger.Warn("timed out waiting for connection taken over for client ", evicted.clientID, " to stop")
+	}
+}
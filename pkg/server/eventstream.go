@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+// The largest message clients can post, selective acknowledgements are
+// the only messages that vary in size. This could be made configurable.
+const eventStreamMaxMessageSize = 4096
+
+var errEventStreamClosed = errors.New("event stream has been closed")
+
+// Streams the sequence as Server-Sent Events, clients send acknowledgements, stop requests
+// and flow control messages to the messages endpoint as they can not write to the stream.
+func (s *serverImpl) serveEventStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.isShuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := newEventStreamConn(w, r)
+	if err != nil {
+		s.logger.Error("event stream error: ", err)
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	query := r.URL.Query()
+	// Events are text so numbers are always sent individually.
+	query.Del("batchSize")
+	query.Del("batchInterval")
+	// Browsers reconnect with the ID of the last event they received which
+	// is the index of the last number received in order.
+	lastReceived := query.Get("lastReceived")
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		lastReceived = lastEventID
+	}
+	s.serveConnection(conn, utils.EventStreamCodec(), query, lastReceived)
+}
+
+// Hands a message from a client over to its live event stream, acknowledgements
+// that arrive once the stream has closed are persisted directly so the numbers
+// are not resent when the client resumes.
+func (s *serverImpl) serveEventStreamMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("clientId")
+	if clientID == "" {
+		http.Error(w, "missing client id", http.StatusBadRequest)
+		return
+	}
+	// Messages can acknowledge and stop a session so must come from its owner.
+	if !s.verifySessionToken(clientID, r.URL.Query().Get("token")) {
+		http.Error(w, unauthorizedReason, http.StatusUnauthorized)
+		return
+	}
+
+	message, err := io.ReadAll(io.LimitReader(r.Body, eventStreamMaxMessageSize+1))
+	if err != nil {
+		http.Error(w, "failed to read message", http.StatusBadRequest)
+		return
+	}
+	if !isValidClientMessage(message) {
+		http.Error(w, "expected an acknowledgement, stop or flow control message", http.StatusBadRequest)
+		return
+	}
+
+	conn := s.eventStreamFor(clientID)
+	if conn != nil && conn.deliver(r.Context(), message) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if message[0] != utils.AcknowledgementPrefix {
+		http.Error(w, "no live event stream for client", http.StatusNotFound)
+		return
+	}
+	_, err = s.store.Ack(clientID, int(binary.LittleEndian.Uint32(message[1:])))
+	if err != nil {
+		s.logger.Error("failed to persist client acknowledgement: ", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, sessions.ErrSessionNotFound) || errors.Is(err, sessions.ErrSessionExpired) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, sessions.ErrIndexOutOfRange) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Checks the prefix and size of a message posted by a client.
+func isValidClientMessage(message []byte) bool {
+	return len(message) <= eventStreamMaxMessageSize && isWellFormedClientMessage(message)
+}
+
+// Finds the event stream currently serving a client.
+func (s *serverImpl) eventStreamFor(clientID string) *eventStreamConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eventStream, isEventStream := s.clientConns[clientID].(*eventStreamConn)
+	if !isEventStream {
+		return nil
+	}
+	return eventStream
+}
+
+type eventStreamConn struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	// Carries messages posted by the client to the goroutine reading from the connection.
+	inbound     chan []byte
+	requestDone <-chan struct{}
+	done        chan struct{}
+	mu          sync.Mutex
+	// Set once the close event has been written or the connection has been closed,
+	// the response writer must not be used once the handler has returned.
+	writesClosed bool
+	closed       bool
+}
+
+func newEventStreamConn(w http.ResponseWriter, r *http.Request) (*eventStreamConn, error) {
+	controller := http.NewResponseController(w)
+	// The stream stays open for as long as the sequence is being delivered
+	// so must not be bound by the server's write timeout.
+	err := controller.SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	err = controller.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventStreamConn{
+		w:           w,
+		controller:  controller,
+		inbound:     make(chan []byte),
+		requestDone: r.Context().Done(),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+func (c *eventStreamConn) WriteMessage(message []byte) error {
+	event, err := utils.MessageToEvent(message)
+	if err != nil {
+		return err
+	}
+	return c.write(event.Bytes(), false)
+}
+
+func (c *eventStreamConn) ReadMessage() ([]byte, error) {
+	select {
+	case message := <-c.inbound:
+		return message, nil
+	case <-c.done:
+		return nil, errEventStreamClosed
+	case <-c.requestDone:
+		return nil, errEventStreamClosed
+	}
+}
+
+// Messages posted by the client are still read after the close event
+// has been written so acknowledgements in flight are persisted.
+func (c *eventStreamConn) WriteClose(code int, reason string) error {
+	event, err := utils.CloseEvent(code, reason)
+	if err != nil {
+		return err
+	}
+	return c.write(event.Bytes(), true)
+}
+
+func (c *eventStreamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writesClosed = true
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+// Clients can not respond to pings on the stream so the pings only keep
+// the connection alive through proxies and let clients detect a silent server.
+// A client that has gone away is detected when writes to the stream fail.
+func (c *eventStreamConn) StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams) {
+	if !params.Enabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(params.PingInterval) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := c.write([]byte(": ping\n\n"), false)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Messages from the client arrive in separate requests so there is
+// no read deadline to extend.
+func (c *eventStreamConn) ExtendReadDeadline(params *utils.HeartbeatParams) {}
+
+func (c *eventStreamConn) write(data []byte, closing bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writesClosed {
+		return errEventStreamClosed
+	}
+	if closing {
+		c.writesClosed = true
+	}
+
+	// This deadline could be made configurable.
+	c.controller.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	_, err := c.w.Write(data)
+	if err != nil {
+		return err
+	}
+	return c.controller.Flush()
+}
+
+func (c *eventStreamConn) deliver(ctx context.Context, message []byte) bool {
+	select {
+	case c.inbound <- message:
+		return true
+	case <-c.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+// The pace of delivery for a single connection, adjusted by the client
+// with pause, resume and set rate messages.
+type flowControl struct {
+	mu       sync.Mutex
+	settings utils.FlowSettingsMessage
+	// Set when the settings have changed since they were last confirmed to the client.
+	unconfirmed bool
+	// Signalled whenever the client changes the pace of delivery.
+	changed chan struct{}
+}
+
+func newFlowControl(messageInterval int) *flowControl {
+	return &flowControl{
+		settings: utils.FlowSettingsMessage{MessageInterval: messageInterval},
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+func (f *flowControl) setPaused(paused bool) {
+	f.mu.Lock()
+	f.settings.Paused = paused
+	f.unconfirmed = true
+	f.mu.Unlock()
+	f.signal()
+}
+
+func (f *flowControl) setMessageInterval(messageInterval int) {
+	f.mu.Lock()
+	f.settings.MessageInterval = messageInterval
+	f.unconfirmed = true
+	f.mu.Unlock()
+	f.signal()
+}
+
+func (f *flowControl) signal() {
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (f *flowControl) current() utils.FlowSettingsMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.settings
+}
+
+// Returns the settings to confirm to the client and false
+// when they have not changed since they were last confirmed.
+func (f *flowControl) takeUnconfirmed() (utils.FlowSettingsMessage, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	unconfirmed := f.unconfirmed
+	f.unconfirmed = false
+	return f.settings, unconfirmed
+}
+
+// The interval between numbers as a timer, nil when numbers are sent
+// without an interval as there is no need for a timer.
+func (f *flowControl) intervalTimer() <-chan time.Time {
+	settings := f.current()
+	if settings.MessageInterval <= 0 {
+		return nil
+	}
+	return time.After(time.Duration(settings.MessageInterval) * time.Millisecond)
+}
+
+// Keeps the interval requested by the client within the bounds
+// configured for the server.
+func (s *serverImpl) boundMessageInterval(requested int) int {
+	if requested < s.params.MinSequenceMessageInterval {
+		return s.params.MinSequenceMessageInterval
+	}
+	if s.params.MaxSequenceMessageInterval > 0 && requested > s.params.MaxSequenceMessageInterval {
+		return s.params.MaxSequenceMessageInterval
+	}
+	return requested
+}
+
+// Confirms the pace of delivery to the client when it has changed,
+// only called from the goroutine delivering the sequence.
+func (s *serverImpl) confirmFlowSettings(conn clientConn, flow *flowControl) {
+	settings, unconfirmed := flow.takeUnconfirmed()
+	if !unconfirmed {
+		return
+	}
+
+	settingsBytes, err := json.Marshal(&settings)
+	if err != nil {
+		s.logger.Error("failed to encode flow settings: ", err)
+		return
+	}
+	err = conn.WriteMessage(append([]byte{utils.FlowSettingsPrefix}, settingsBytes...))
+	if err != nil {
+		s.logger.Debug("flow settings write error, relying on reconnection: ", err)
+	}
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type Server interface {
+	http.Handler
+	// Serves the sequence over raw TCP connections accepted from the listener
+	// until the listener is closed, closing the listener is left to the caller.
+	ServeTCP(listener net.Listener) error
+	// Stops accepting new connections, asks connected clients to reconnect later
+	// and waits for their connections to drain or for the context to be done,
+	// at which point any remaining connections are closed.
+	Shutdown(ctx context.Context) error
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultPollBatchSize = 100
+	// In milliseconds.
+	DefaultPollTimeout = 20000
+)
+
+// Responds with the next batch of numbers for the client, the after query parameter
+// is the index of the last number the client has received which acknowledges the
+// previous batch. Progress is held in the session store so clients can switch
+// between long polling and the other transports mid-sequence.
+func (s *serverImpl) serveLongPoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.isShuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	batchSize, timeout := s.pollParams()
+	// The poll can take longer to fill a batch than the server's write timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + time.Second))
+
+	// Polls in flight are tracked in the same way as connections so they are subject
+	// to the session conflict policy and are waited for during shutdown.
+	ctx, stopPoll := context.WithCancel(r.Context())
+	defer stopPoll()
+	query := r.URL.Query()
+	conn := newLongPollConn()
+	live, evicted, trackErr := s.track(conn, query.Get("clientId"), stopPoll)
+	if trackErr != nil {
+		writePollError(w, trackErr.code, trackErr.reason)
+		return
+	}
+	defer s.untrack(conn)
+	defer live.finishSequence()
+	if evicted != nil {
+		s.waitForEviction(evicted)
+	}
+
+	setup, setupErr := s.setupSession(query, query.Get("after"))
+	if setupErr != nil {
+		writePollError(w, setupErr.code, setupErr.reason)
+		return
+	}
+
+	err := s.acknowledgeThrough(setup, batchSize)
+	if err != nil {
+		s.logger.Error("failed to persist client acknowledgements: ", err)
+		code, reason := closeCodeForError(err)
+		writePollError(w, code, reason)
+		return
+	}
+
+	response, err := s.collectBatch(ctx, setup, batchSize, timeout)
+	if err != nil {
+		s.logger.Error("failed to get next number in sequence: ", err)
+		code, reason := closeCodeForError(err)
+		writePollError(w, code, reason)
+		return
+	}
+	// Numbers collected before the server started shutting down are still
+	// delivered, a poll that has been taken over must not deliver them as
+	// they are being delivered to the client that took over the session.
+	if closing := conn.closing(); closing != nil && closing.Code != websocket.CloseGoingAway {
+		writePollError(w, closing.Code, closing.Reason)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *serverImpl) pollParams() (int, time.Duration) {
+	batchSize := s.params.PollBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPollBatchSize
+	}
+	timeout := s.params.PollTimeout
+	if timeout <= 0 {
+		timeout = DefaultPollTimeout
+	}
+	return batchSize, time.Duration(timeout) * time.Millisecond
+}
+
+// Acknowledges every number up to the last number the client has received,
+// only the last batch is counted as earlier numbers were acknowledged by previous polls.
+func (s *serverImpl) acknowledgeThrough(setup *sessionSetup, batchSize int) error {
+	lastIndex := setup.lastReceived
+	if lastIndex >= setup.session.Sequence.Len() {
+		lastIndex = setup.session.Sequence.Len() - 1
+	}
+	if lastIndex < 0 {
+		return nil
+	}
+
+	_, err := s.store.AckRanges(setup.clientID, [][2]int{{0, lastIndex + 1}})
+	if err != nil {
+		return err
+	}
+	acknowledged := lastIndex + 1
+	if acknowledged > batchSize {
+		acknowledged = batchSize
+	}
+	s.metrics.acksReceived.Add(float64(acknowledged))
+	return nil
+}
+
+// Collects numbers at the configured message interval until the batch is full,
+// the sequence ends or the poll times out.
+func (s *serverImpl) collectBatch(
+	ctx context.Context,
+	setup *sessionSetup,
+	batchSize int,
+	timeout time.Duration,
+) (*utils.PollResponse, error) {
+	clientID := setup.clientID
+	session := setup.session
+	response := &utils.PollResponse{Numbers: []uint32{}}
+	if setup.generated != nil {
+		response.Handshake = createHandshake(setup)
+	}
+
+	// The store expects the index of the first number the client
+	// has not yet received.
+	offsetOverride := -1
+	if setup.lastReceived > -1 {
+		offsetOverride = setup.lastReceived + 1
+	}
+	pollTimeout := time.After(timeout)
+	interval := time.Millisecond * time.Duration(s.params.SequenceMessageInterval)
+
+	next, index, err := s.store.Next(clientID, offsetOverride, true)
+	for err == nil {
+		if len(response.Numbers) == 0 {
+			response.FromIndex = index
+		}
+		response.Numbers = append(response.Numbers, next)
+		s.metrics.numbersSent.Inc()
+		if s.isCheckpointDue(session, index) {
+			response.Checkpoints = append(
+				response.Checkpoints,
+				createCheckpoint(session, index+1-s.params.CheckpointInterval, index),
+			)
+		}
+
+		if isFinalIndex(session, index) {
+			response.Checksum = sequence.Checksum(session.Sequence)
+			return response, nil
+		}
+		if len(response.Numbers) >= batchSize {
+			return response, nil
+		}
+
+		// The context is also done once the server starts shutting down
+		// or the poll has been taken over.
+		select {
+		case <-ctx.Done():
+			return response, nil
+		case <-pollTimeout:
+			return response, nil
+		case <-time.After(interval):
+		}
+
+		next, index, err = s.store.Next(clientID, -1, false)
+	}
+
+	if !errors.Is(err, sessions.ErrSequenceConsumed) {
+		return nil, err
+	}
+	// The store only reports the sequence as consumed to a fresh request
+	// once every number has been acknowledged.
+	response.Complete = len(response.Numbers) == 0
+	return response, nil
+}
+
+func writePollError(w http.ResponseWriter, code int, reason string) {
+	status := http.StatusBadRequest
+	if code == utils.CloseCodeExpiredSession {
+		status = http.StatusGone
+	} else if code == websocket.CloseGoingAway {
+		status = http.StatusServiceUnavailable
+	} else if code == utils.CloseCodeSessionInUse || code == utils.CloseCodeSessionTakenOver {
+		status = http.StatusConflict
+	} else if code == utils.CloseCodeUnauthorized {
+		status = http.StatusUnauthorized
+	} else if !utils.IsKnownClientErrorCode(code) {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&utils.PollError{Code: code, Reason: reason})
+}
+
+// Stands in for a connection while a poll is in flight, nothing is written to
+// the client until the poll responds so the reason the server closed the
+// connection is held for the poll to respond with.
+type longPollConn struct {
+	mu        sync.Mutex
+	closeWith *utils.PollError
+	done      chan struct{}
+	closed    bool
+}
+
+func newLongPollConn() *longPollConn {
+	return &longPollConn{done: make(chan struct{})}
+}
+
+func (c *longPollConn) WriteMessage(message []byte) error {
+	return errors.New("messages can not be written to a long poll")
+}
+
+func (c *longPollConn) ReadMessage() ([]byte, error) {
+	<-c.done
+	return nil, errors.New("long poll has been closed")
+}
+
+func (c *longPollConn) WriteClose(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closeWith == nil {
+		c.closeWith = &utils.PollError{Code: code, Reason: reason}
+	}
+	return nil
+}
+
+func (c *longPollConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+// Polls are held for no longer than the poll timeout so there is
+// nothing to keep alive.
+func (c *longPollConn) StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams) {}
+
+func (c *longPollConn) ExtendReadDeadline(params *utils.HeartbeatParams) {}
+
+func (c *longPollConn) closing() *utils.PollError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closeWith
+}
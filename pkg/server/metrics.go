@@ -0,0 +1,129 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/metrics"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+)
+
+const (
+	connectionTypeFresh   = "fresh"
+	connectionTypeResumed = "resumed"
+
+	resumeFromLastReceived    = "last_received"
+	resumeFromAcknowledgement = "acknowledgement"
+)
+
+// Upper bounds in seconds for the send to acknowledgement latency histogram.
+var ackLatencyBuckets = []float64{
+	0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type serverMetrics struct {
+	activeConnections *metrics.Gauge
+	connections       *metrics.Counter
+	resumedFrom       *metrics.Counter
+	numbersSent       *metrics.Counter
+	retransmissions   *metrics.Counter
+	acksReceived      *metrics.Counter
+	closeCodes        *metrics.Counter
+	ackLatency        *metrics.Histogram
+}
+
+func newServerMetrics(registry *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		activeConnections: registry.NewGauge(
+			"numseq_active_connections",
+			"The number of WebSocket connections currently being served.",
+		),
+		connections: registry.NewCounter(
+			"numseq_connections_total",
+			"Connections that initialised a session, by whether the session was new or resumed.",
+			"type",
+		),
+		resumedFrom: registry.NewCounter(
+			"numseq_resumed_connections_total",
+			"Resumed sessions by whether delivery continued from the client's last received index"+
+				" or from the first unacknowledged number.",
+			"resume_from",
+		),
+		numbersSent: registry.NewCounter(
+			"numseq_numbers_sent_total",
+			"Numbers sent to clients, excluding retransmissions.",
+		),
+		retransmissions: registry.NewCounter(
+			"numseq_retransmissions_total",
+			"Numbers resent to clients after the retransmit timeout elapsed.",
+		),
+		acksReceived: registry.NewCounter(
+			"numseq_acks_received_total",
+			"Acknowledgements received from clients.",
+		),
+		closeCodes: registry.NewCounter(
+			"numseq_close_codes_total",
+			"Close codes sent to clients.",
+			"code",
+		),
+		ackLatency: registry.NewHistogram(
+			"numseq_ack_latency_seconds",
+			"Time between a number first being sent and the client acknowledging it.",
+			ackLatencyBuckets,
+		),
+	}
+}
+
+// Registers a gauge for the number of sessions in each state, collected from
+// the store and live connections every time metrics are scraped.
+// Sessions in progress are active while a client is connected for them
+// and idle otherwise.
+func (s *serverImpl) registerSessionMetrics(registry *metrics.Registry) {
+	registry.NewGaugeFunc(
+		"numseq_sessions",
+		"Sessions held by the session store by state.",
+		"state",
+		func() map[string]float64 {
+			stats := s.store.Stats()
+			active := s.connectedClients()
+			if active > stats.InProgress {
+				// Clients can remain connected for a short time
+				// after their session has been consumed.
+				active = stats.InProgress
+			}
+			return map[string]float64{
+				"active":   float64(active),
+				"idle":     float64(stats.InProgress - active),
+				"consumed": float64(stats.Consumed),
+				"expired":  float64(stats.Expired),
+			}
+		},
+	)
+}
+
+func (m *serverMetrics) recordConnection(lastReceived int, resumed bool) {
+	if !resumed {
+		m.connections.Inc(connectionTypeFresh)
+		return
+	}
+
+	m.connections.Inc(connectionTypeResumed)
+	if lastReceived > -1 {
+		m.resumedFrom.Inc(resumeFromLastReceived)
+	} else {
+		m.resumedFrom.Inc(resumeFromAcknowledgement)
+	}
+}
+
+func (m *serverMetrics) recordCloseCode(code int) {
+	m.closeCodes.Inc(strconv.Itoa(code))
+}
+
+// Checks whether a live session already exists for the client without treating
+// errors such as an expired session as a reason to reject the connection,
+// the store reports those when the session is initialised.
+// Summaries leave the session untouched whereas Get counts as an access
+// that pushes back its expiry.
+func sessionExists(store sessions.SessionStore, clientID string) bool {
+	summary, err := store.Summary(clientID)
+	return err == nil && !summary.Expired
+}
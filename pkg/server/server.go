@@ -1,15 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/metrics"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
 	"github.com/gorilla/websocket"
@@ -18,10 +23,69 @@ import (
 
 type ServerParams struct {
 	SequenceMessageInterval int
+	// The bounds in milliseconds for the interval between numbers clients can request
+	// for their connection, there is no upper bound when the maximum is 0.
+	MinSequenceMessageInterval int
+	MaxSequenceMessageInterval int
+	// The maximum number of unacknowledged numbers in flight per connection,
+	// delivery pauses when the window is full. The window is unbounded when this is 0.
+	SendWindowSize int
+	// The number of milliseconds to wait for an acknowledgement before resending a number
+	// in the send window, retransmission is disabled when this is 0.
+	RetransmitTimeout int
+	// Optional, heartbeats are disabled when not provided.
+	Heartbeat *utils.HeartbeatParams
+	// The number of numbers between each checkpoint, a checkpoint carries the checksum
+	// of the numbers sent since the previous checkpoint so clients can verify
+	// long sequences incrementally. Checkpoints are disabled when this is 0.
+	CheckpointInterval int
+	// The largest batch of numbers clients can request over WebSockets and raw TCP,
+	// larger batch sizes are reduced to this. Batching is disabled when this is 0.
+	MaxBatchSize int
+	// The maximum number of numbers returned by a long poll, a default
+	// of DefaultPollBatchSize is used when this is 0.
+	PollBatchSize int
+	// The maximum number of milliseconds a long poll waits to fill a batch
+	// before responding, a default of DefaultPollTimeout is used when this is 0.
+	PollTimeout int
+	// Generates sequences for new sessions, a seeded PRNG with a random
+	// seed for each session is used when not provided.
+	SequenceGenerator sequence.SequenceGenerator
+	// Optional, generators clients can choose from by name with the generator
+	// query parameter in addition to the default sequence generator.
+	SelectableGenerators []sequence.SequenceGenerator
+	// Optional, the registry to record server metrics in.
+	// Metrics are still recorded but not exposed when not provided.
+	Metrics *metrics.Registry
+	// What to do when a client connects with a client ID that already has a live
+	// connection, the existing connection is taken over when not provided.
+	SessionConflictPolicy SessionConflictPolicy
+	// Optional, clients must provide a token signed with one of the keys to resume
+	// their session when provided. New tokens are signed with the first key, the rest
+	// are only used to verify tokens signed before the keys were rotated.
+	ClientTokenKeys []TokenKey
 }
 
+// SessionConflictPolicy determines which connection is served when
+// a second connection is made for a client ID.
+type SessionConflictPolicy string
+
+const (
+	// The existing connection is closed and the new connection is served.
+	SessionConflictTakeOver SessionConflictPolicy = "takeover"
+	// The new connection is closed and the existing connection continues to be served.
+	SessionConflictReject SessionConflictPolicy = "reject"
+)
+
 const (
+	// The maximum value of numbers in a sequence.
 	MaxSequenceNumberValue uint32 = 0xffff
+	// The maximum length of a sequence, clients can request
+	// an unbounded sequence with a sequence count of "infinite".
+	MaxSequenceLength uint32 = math.MaxUint32
+	// The sequence count clients provide to request a sequence that is
+	// streamed until the client asks the server to stop.
+	InfiniteSequenceCount = "infinite"
 )
 
 var upgrader = websocket.Upgrader{
@@ -29,204 +93,773 @@ var upgrader = websocket.Upgrader{
 		// No need for strict CORS checking for this implementation.
 		return true
 	},
+	// The first subprotocol in this list that the client requests is selected.
+	Subprotocols: utils.Subprotocols,
 }
 
 type serverImpl struct {
-	params *ServerParams
-	store  sessions.SessionStore
-	logger *logrus.Logger
+	params    *ServerParams
+	store     sessions.SessionStore
+	generator sequence.SequenceGenerator
+	logger    *logrus.Logger
+	metrics   *serverMetrics
+	mu        sync.Mutex
+	// Live connections mapped to the client they are serving.
+	conns map[clientConn]*liveConnection
+	// The connection currently serving each client ID.
+	clientConns  map[string]clientConn
+	shuttingDown bool
+	handlers     sync.WaitGroup
+}
+
+type liveConnection struct {
+	clientID string
+	// Stops delivery of the sequence over the connection.
+	stopSequence context.CancelFunc
+	// Closed once the connection is no longer taking numbers from the session.
+	sequenceDone     chan struct{}
+	sequenceDoneOnce sync.Once
 }
 
-func NewDefaultServer(params *ServerParams, store sessions.SessionStore, logger *logrus.Logger) http.Handler {
-	return &serverImpl{
-		params,
-		store,
-		logger,
+func (l *liveConnection) finishSequence() {
+	l.sequenceDoneOnce.Do(func() {
+		close(l.sequenceDone)
+	})
+}
+
+func NewDefaultServer(params *ServerParams, store sessions.SessionStore, logger *logrus.Logger) Server {
+	registry := params.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+
+	generator := params.SequenceGenerator
+	if generator == nil {
+		generator = sequence.NewSeededGenerator(nil)
+	}
+
+	server := &serverImpl{
+		params:      params,
+		store:       store,
+		generator:   generator,
+		logger:      logger,
+		metrics:     newServerMetrics(registry),
+		conns:       map[clientConn]*liveConnection{},
+		clientConns: map[string]clientConn{},
 	}
+	server.registerSessionMetrics(registry)
+	return server
 }
 
+// Paths of the transports served alongside WebSockets,
+// requests to any other path are upgraded to WebSocket connections.
+const (
+	EventStreamPath         = "/events"
+	EventStreamMessagesPath = "/events/messages"
+	LongPollPath            = "/poll"
+	TokenPath               = "/tokens"
+)
+
 func (s *serverImpl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case EventStreamPath:
+		s.serveEventStream(w, r)
+	case EventStreamMessagesPath:
+		s.serveEventStreamMessage(w, r)
+	case LongPollPath:
+		s.serveLongPoll(w, r)
+	case TokenPath:
+		s.serveToken(w, r)
+	default:
+		s.serveWebSocket(w, r)
+	}
+}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+func (s *serverImpl) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.isShuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.logger.Error("websockets upgrade error: ", err)
 		return
 	}
-
+	conn := &webSocketConn{conn: wsConn}
 	defer conn.Close()
 
+	// Clients that do not request a subprotocol predate versioning
+	// and are served the first version of the protocol.
+	codec, supported := utils.CodecForSubprotocol(wsConn.Subprotocol())
+	if !supported || (wsConn.Subprotocol() == "" && len(websocket.Subprotocols(r)) > 0) {
+		s.logger.Error("Unsupported protocol versions: ", websocket.Subprotocols(r))
+		s.writeCloseMessage(
+			conn,
+			utils.CloseCodeUnsupportedProtocolVersion,
+			"none of the requested protocol versions are supported",
+		)
+		return
+	}
+
 	query := r.URL.Query()
+	s.serveConnection(conn, codec, query, query.Get("lastReceived"))
+}
+
+// A session for a client along with the parameters
+// it was requested with.
+type sessionSetup struct {
+	clientID     string
+	session      sessions.SessionState
+	lastReceived int
+	resumed      bool
+	generator    sequence.SequenceGenerator
+	// Only set when the session was created by this request.
+	generated *sequence.GeneratedSequence
+	// Only set when the session was created by this request and
+	// clients must authenticate to resume their session.
+	token string
+}
+
+// A failure to set up a session, reported to the client with a close code.
+type sessionSetupError struct {
+	code   int
+	reason string
+}
+
+// Validates the query parameters shared by every transport and creates
+// or resumes the session for the client.
+func (s *serverImpl) setupSession(query url.Values, lastReceivedIndexStr string) (*sessionSetup, *sessionSetupError) {
 	clientID := query.Get("clientId")
 	if clientID == "" {
-		conn.WriteControl(
-			websocket.CloseMessage,
-			websocket.FormatCloseMessage(utils.CloseCodeMissingClientID, "missing client id"),
-			// This deadline could be made configurable.
-			time.Now().Add(1*time.Second),
-		)
-		conn.Close()
-		return
+		return nil, &sessionSetupError{code: utils.CloseCodeMissingClientID, reason: "missing client id"}
 	}
 
 	sequenceCountStr := query.Get("sequenceCount")
 	sequenceCount, err := deriveSequenceCount(sequenceCountStr)
 	if err != nil {
 		s.logger.Error("Failed to parse sequenceCount: ", err)
-		conn.WriteControl(
-			websocket.CloseMessage,
-			websocket.FormatCloseMessage(
-				utils.CloseCodeInvalidSequenceCount,
-				"sequence count must be an integer less than or equal to 0xffff",
-			),
-			// This deadline could be made configurable.
-			time.Now().Add(1*time.Second),
-		)
-		conn.Close()
-		return
+		return nil, &sessionSetupError{
+			code:   utils.CloseCodeInvalidSequenceCount,
+			reason: "sequence count must be an integer less than or equal to 0xffffffff or infinite",
+		}
 	}
 
-	lastReceivedIndexStr := query.Get("lastReceived")
 	lastReceived, err := deriveLastReceivedIndex(lastReceivedIndexStr)
 	if err != nil {
 		s.logger.Error("Failed to parse lastReceived: ", err)
-		conn.WriteControl(
-			websocket.CloseMessage,
-			websocket.FormatCloseMessage(
-				utils.CloseCodeInvalidLastReceived,
-				"if provided, last received index must be an integer less than or equal to 0xffff",
-			),
-			// This deadline could be made configurable.
-			time.Now().Add(1*time.Second),
-		)
-		conn.Close()
-		return
+		return nil, &sessionSetupError{
+			code:   utils.CloseCodeInvalidLastReceived,
+			reason: "if provided, last received index must be an integer less than 0xffffffff",
+		}
+	}
+
+	generatorName := query.Get("generator")
+	generator, found := s.selectGenerator(generatorName)
+	if !found {
+		s.logger.Error("Unknown or unavailable sequence generator: ", generatorName)
+		return nil, &sessionSetupError{
+			code:   utils.CloseCodeInvalidGenerator,
+			reason: "sequence generator is unknown or can not be selected by clients",
+		}
 	}
 
-	// An improvement here could be to first check if a session exists before
-	// creating the pseudo-random sequence of numbers.
-	sequence := utils.GeneratePseudoRandomSequence(sequenceCount, MaxSequenceNumberValue)
 	// If a session exists for the given client id, the sequence provided
-	// here will be ignored.
-	session, err := s.store.Initialise(clientID, sequence)
+	// to the store will be ignored so there is no need to generate one.
+	resumed := sessionExists(s.store, clientID)
+	if resumed && !s.verifySessionToken(clientID, query.Get("token")) {
+		s.logger.Error("Missing or invalid token for client: ", clientID)
+		return nil, &sessionSetupError{code: utils.CloseCodeUnauthorized, reason: unauthorizedReason}
+	}
+	var generated *sequence.GeneratedSequence
+	nonce := ""
+	if !resumed {
+		var valid bool
+		nonce, valid, err = s.nonceForNewSession(clientID, query.Get("token"))
+		if err != nil {
+			s.logger.Error("Failed to generate token nonce: ", err)
+			code, reason := closeCodeForError(err)
+			return nil, &sessionSetupError{code: code, reason: reason}
+		}
+		if !valid {
+			s.logger.Error("Invalid token for new session for client: ", clientID)
+			return nil, &sessionSetupError{code: utils.CloseCodeUnauthorized, reason: unauthorizedReason}
+		}
+		generated, err = generator.Generate(sequenceCount, MaxSequenceNumberValue)
+		if err != nil {
+			s.logger.Error("Failed to generate sequence: ", err)
+			code, reason := closeCodeForError(err)
+			return nil, &sessionSetupError{code: code, reason: reason}
+		}
+	}
+	session, err := s.store.Initialise(clientID, generatedSequence(generated), nonce)
 	if err != nil {
 		s.logger.Error("Failed to initialise session: ", err)
-		expiredSession := isExpiredSessionError(err.Error())
-		if expiredSession {
-			conn.WriteControl(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(
-					utils.CloseCodeExpiredSession,
-					"session has expired",
-				),
-				// This deadline could be made configurable.
-				time.Now().Add(1*time.Second),
-			)
+		code, reason := closeCodeForError(err)
+		return nil, &sessionSetupError{code: code, reason: reason}
+	}
+	token := ""
+	if !resumed && s.tokensRequired() {
+		if session.TokenNonce != nonce {
+			// Another connection created the session first, its token
+			// belongs to that connection.
+			s.logger.Error("Session created by another connection for client: ", clientID)
+			return nil, &sessionSetupError{code: utils.CloseCodeUnauthorized, reason: unauthorizedReason}
 		}
+		token = s.issueToken(clientID, nonce)
+	}
+
+	return &sessionSetup{
+		clientID:     clientID,
+		session:      session,
+		lastReceived: lastReceived,
+		resumed:      resumed,
+		generator:    generator,
+		generated:    generated,
+		token:        token,
+	}, nil
+}
+
+// Delivers the sequence for the client identified in the query parameters
+// over a connection of any transport until the connection is closed.
+func (s *serverImpl) serveConnection(
+	conn clientConn,
+	codec utils.Codec,
+	query url.Values,
+	lastReceivedIndexStr string,
+) {
+	ctx, stopSequence := context.WithCancel(context.Background())
+	defer stopSequence()
+
+	clientID := query.Get("clientId")
+	live, evicted, trackErr := s.track(conn, clientID, stopSequence)
+	if trackErr != nil {
+		s.writeCloseMessage(conn, trackErr.code, trackErr.reason)
+		return
+	}
+	defer s.untrack(conn)
+	if evicted != nil {
+		s.waitForEviction(evicted)
+	}
+
+	// Connections to clients that go silent are closed when the read deadline
+	// passes which in turn stops delivery of the sequence.
+	conn.StartHeartbeat(ctx, s.params.Heartbeat)
+
+	setup, setupErr := s.setupSession(query, lastReceivedIndexStr)
+	if setupErr != nil {
+		live.finishSequence()
+		s.writeCloseMessage(conn, setupErr.code, setupErr.reason)
+		conn.Close()
+		return
+	}
+	batch, setupErr := s.negotiateBatching(query)
+	if setupErr != nil {
+		live.finishSequence()
+		s.writeCloseMessage(conn, setupErr.code, setupErr.reason)
 		conn.Close()
+		return
 	}
+	session := setup.session
+	lastReceived := setup.lastReceived
+	s.metrics.recordConnection(lastReceived, setup.resumed)
 
-	go s.initSequence(conn, clientID, session, lastReceived)
+	if setup.generated != nil {
+		err := s.writeHandshake(conn, setup)
+		if err != nil {
+			s.logger.Debug("handshake write error, relying on reconnection: ", err)
+		}
+	}
+	if batch != nil {
+		err := s.writeBatchSettings(conn, batch)
+		if err != nil {
+			s.logger.Debug("batch settings write error, relying on reconnection: ", err)
+		}
+	}
+
+	// The last received index is the last number the client holds and delivery
+	// resumes from the number after it, whereas the store expects the index of
+	// the first number the client has not yet received. Passing it straight
+	// through would resend a number the client already has.
+	offsetOverride := -1
+	if lastReceived > -1 {
+		offsetOverride = lastReceived + 1
+	}
+	window := newSendWindow(
+		s.params.SendWindowSize,
+		time.Duration(s.params.RetransmitTimeout)*time.Millisecond,
+	)
+	// Stop requests are handed over to the goroutine delivering the sequence
+	// as it is the only goroutine that writes data messages to the connection.
+	stopRequests := make(chan int, 1)
+	flow := newFlowControl(s.params.SequenceMessageInterval)
+	go func() {
+		defer live.finishSequence()
+		s.initSequence(ctx, conn, codec, clientID, session, offsetOverride, window, batch, flow, stopRequests)
+	}()
 
 	for {
-		_, message, err := conn.ReadMessage()
+		message, err := conn.ReadMessage()
 		if err != nil {
 			s.logger.Error("read error:", err)
 			break
 		}
-		s.handleMessage(message, clientID, conn)
+		conn.ExtendReadDeadline(s.params.Heartbeat)
+		s.handleMessage(message, clientID, conn, window, flow, stopRequests)
 	}
-
 }
 
-func (s *serverImpl) initSequence(conn *websocket.Conn, clientID string, session sessions.SessionState, lastReceivedIndex int) {
-	next, index, err := s.store.Next(clientID, lastReceivedIndex, true)
-	for !isSequenceConsumedError(err) {
+func (s *serverImpl) initSequence(
+	ctx context.Context,
+	conn clientConn,
+	codec utils.Codec,
+	clientID string,
+	session sessions.SessionState,
+	offsetOverride int,
+	window *sendWindow,
+	batch *numberBatch,
+	flow *flowControl,
+	stopRequests <-chan int,
+) {
+	retransmitTicker := time.NewTicker(window.checkInterval())
+	defer retransmitTicker.Stop()
+
+	// Clients place numbers sent without their index after the previous number sent
+	// without its index (or batch) over the connection, starting from the number
+	// after the last one received.
+	followingIndex := 0
+	if offsetOverride > -1 {
+		followingIndex = offsetOverride
+	}
+	next, index, err := s.store.Next(clientID, offsetOverride, true)
+	for err == nil {
 		s.logger.Debug("client: ", clientID, " next: ", next, " index: ", index, " error: ", err)
-		msg, innerErr := prepareMessage(session, next, index)
-		if innerErr != nil {
-			// todo: implement a mechanism that handles these errors better.
-			s.logger.Error("prepare message error: ", err)
+		if batch != nil && !isFinalIndex(session, index) {
+			s.batchNumber(conn, session, window, batch, index, next)
+			// Batches carry the index of their first number.
+			followingIndex = index + 1
 		} else {
-			conn.WriteMessage(websocket.BinaryMessage, msg)
+			// The final number carries the checksum so is always sent on its own.
+			s.flushBatch(conn, session, window, batch)
+			follows := index == followingIndex
+			s.sendNumber(conn, codec, session, window, index, next, follows)
+			if follows {
+				followingIndex = index + 1
+			}
 		}
 
-		// Only pauses the current goroutine!
-		time.Sleep(time.Millisecond * time.Duration(s.params.SequenceMessageInterval))
+		if !s.waitToSend(ctx, conn, codec, clientID, session, window, batch, flow, retransmitTicker, stopRequests) {
+			return
+		}
 
 		next, index, err = s.store.Next(clientID, -1, false)
 	}
+
+	if !errors.Is(err, sessions.ErrSequenceConsumed) {
+		s.logger.Error("failed to get next number in sequence: ", err)
+		s.writeErrorCloseMessage(conn, err)
+		conn.Close()
+		return
+	}
+
+	// Keep resending numbers that are yet to be acknowledged
+	// once the whole sequence has been sent.
+	s.flushBatch(conn, session, window, batch)
+	for window.enabled() && !window.empty() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-window.acked:
+		case <-flow.changed:
+			s.confirmFlowSettings(conn, flow)
+		case <-retransmitTicker.C:
+			s.retransmit(conn, codec, session, window)
+		case lastReceived := <-stopRequests:
+			s.stopSequence(conn, clientID, session, lastReceived)
+			return
+		}
+	}
 }
 
-func (s *serverImpl) handleMessage(message []byte, clientID string, conn *websocket.Conn) {
+func (s *serverImpl) sendNumber(
+	conn clientConn,
+	codec utils.Codec,
+	session sessions.SessionState,
+	window *sendWindow,
+	index int,
+	number uint32,
+	followsPrevious bool,
+) {
+	var msg []byte
+	var err error
+	if !followsPrevious && !utils.NumbersCarryIndex(codec) && !isFinalIndex(session, index) {
+		// The client would place a number without its index straight after
+		// the previous number, so numbers that do not follow on carry their index.
+		msg = codec.EncodeRetransmission(index, number)
+	} else {
+		msg, err = prepareMessage(codec, session, number, index)
+	}
+	if err != nil {
+		// todo: implement a mechanism that handles these errors better.
+		s.logger.Error("prepare message error: ", err)
+		return
+	}
+
+	err = conn.WriteMessage(msg)
+	if err != nil {
+		s.logger.Debug("write error, relying on retransmission or reconnection: ", err)
+	} else {
+		s.metrics.numbersSent.Inc()
+	}
+	window.add(index, number)
+	s.writeCheckpointIfDue(conn, session, index)
+}
+
+// Blocks until the interval between messages has passed, there is space in the send
+// window and delivery is not paused, retransmitting unacknowledged numbers while waiting.
+// Batched numbers count towards the send window, the batch is sent early
+// when it would fill the window or once its flush interval has passed.
+// Returns false if delivery of the sequence should stop.
+func (s *serverImpl) waitToSend(
+	ctx context.Context,
+	conn clientConn,
+	codec utils.Codec,
+	clientID string,
+	session sessions.SessionState,
+	window *sendWindow,
+	batch *numberBatch,
+	flow *flowControl,
+	retransmitTicker *time.Ticker,
+	stopRequests <-chan int,
+) bool {
+	settings := flow.current()
+	interval := flow.intervalTimer()
+	intervalElapsed := interval == nil
+	for {
+		if batch.pending() > 0 && window.fullWith(batch.pending()) {
+			s.flushBatch(conn, session, window, batch)
+		}
+		if intervalElapsed && !settings.Paused && !window.fullWith(batch.pending()) {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-interval:
+			intervalElapsed = true
+		case <-batch.timer():
+			s.flushBatch(conn, session, window, batch)
+		case <-flow.changed:
+			s.confirmFlowSettings(conn, flow)
+			previousInterval := settings.MessageInterval
+			settings = flow.current()
+			if settings.MessageInterval != previousInterval {
+				// The new interval applies from the time it was requested.
+				interval = flow.intervalTimer()
+				intervalElapsed = interval == nil
+			}
+		case <-window.acked:
+		case <-retransmitTicker.C:
+			s.retransmit(conn, codec, session, window)
+		case lastReceived := <-stopRequests:
+			s.stopSequence(conn, clientID, session, lastReceived)
+			return false
+		}
+	}
+}
+
+// Ends the sequence at the client's request with a checkpoint covering the numbers
+// the client has received since the last full checkpoint, the session is expired
+// as the client has no further use for it.
+func (s *serverImpl) stopSequence(
+	conn clientConn,
+	clientID string,
+	session sessions.SessionState,
+	lastReceived int,
+) {
+	interval := s.params.CheckpointInterval
+	if interval > 0 && lastReceived > -1 && lastReceived < session.Sequence.Len() {
+		fromIndex := (lastReceived + 1) / interval * interval
+		if fromIndex <= lastReceived {
+			err := s.writeCheckpoint(conn, session, fromIndex, lastReceived)
+			if err != nil {
+				s.logger.Debug("checkpoint write error: ", err)
+			}
+		}
+	}
+
+	err := s.store.Expire(clientID)
+	if err != nil {
+		s.logger.Error("failed to expire stopped session: ", err)
+	}
+	s.writeCloseMessage(conn, websocket.CloseNormalClosure, "sequence stopped")
+	conn.Close()
+}
+
+// Writes a checkpoint after the last number of each block of
+// the configured checkpoint interval, the final number in a sequence
+// is not followed by a checkpoint as it carries the checksum of the full sequence.
+func (s *serverImpl) writeCheckpointIfDue(conn clientConn, session sessions.SessionState, index int) {
+	if !s.isCheckpointDue(session, index) {
+		return
+	}
+
+	err := s.writeCheckpoint(conn, session, index+1-s.params.CheckpointInterval, index)
+	if err != nil {
+		s.logger.Debug("checkpoint write error, the client will not be able to verify the block: ", err)
+	}
+}
+
+func (s *serverImpl) isCheckpointDue(session sessions.SessionState, index int) bool {
+	interval := s.params.CheckpointInterval
+	return interval > 0 && (index+1)%interval == 0 && !isFinalIndex(session, index)
+}
+
+func (s *serverImpl) writeCheckpoint(
+	conn clientConn,
+	session sessions.SessionState,
+	fromIndex int,
+	toIndex int,
+) error {
+	checkpoint := createCheckpoint(session, fromIndex, toIndex)
+	checkpointBytes, err := json.Marshal(&checkpoint)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(
+		append([]byte{utils.SequenceCheckpointPrefix}, checkpointBytes...),
+	)
+}
+
+func createCheckpoint(session sessions.SessionState, fromIndex int, toIndex int) utils.SequenceCheckpointMessage {
+	return utils.SequenceCheckpointMessage{
+		FromIndex: fromIndex,
+		ToIndex:   toIndex,
+		Checksum:  sequence.RangeChecksum(session.Sequence, fromIndex, toIndex+1),
+	}
+}
+
+func (s *serverImpl) retransmit(
+	conn clientConn,
+	codec utils.Codec,
+	session sessions.SessionState,
+	window *sendWindow,
+) {
+	for _, message := range window.dueForRetransmission() {
+		s.logger.Debug("retransmitting index: ", message.index)
+		msg, err := prepareRetransmission(codec, session, message.number, message.index)
+		if err != nil {
+			s.logger.Error("prepare retransmission error: ", err)
+			continue
+		}
+		err = conn.WriteMessage(msg)
+		if err == nil {
+			s.metrics.retransmissions.Inc()
+		}
+	}
+}
+
+func (s *serverImpl) handleMessage(
+	message []byte,
+	clientID string,
+	conn clientConn,
+	window *sendWindow,
+	flow *flowControl,
+	stopRequests chan<- int,
+) {
+	if !isWellFormedClientMessage(message) {
+		s.logger.Error("ignoring malformed message from client: ", clientID)
+		return
+	}
+
 	if message[0] == utils.AcknowledgementPrefix {
 		index := binary.LittleEndian.Uint32(message[1:])
 		s.logger.Debug("Received index:", message[1:], index, int(index))
-		final, err := s.store.Ack(clientID, int(index))
+		s.metrics.acksReceived.Inc()
+		latency, inFlight := window.ack(int(index))
+		if inFlight {
+			s.metrics.ackLatency.Observe(latency.Seconds())
+		}
+		s.persistAck(conn, clientID, int(index))
+	} else if message[0] == utils.CumulativeAcknowledgementPrefix {
+		index := int(binary.LittleEndian.Uint32(message[1:]))
+		for _, acked := range window.ackThrough(index) {
+			s.metrics.acksReceived.Inc()
+			s.metrics.ackLatency.Observe(acked.latency.Seconds())
+		}
+		// The client holds every number up to the index, including those sent
+		// over previous connections, so the store is updated in a single step.
+		s.persistAckRanges(conn, clientID, [][2]int{{0, index + 1}})
+	} else if message[0] == utils.SelectiveAcknowledgementPrefix {
+		received, err := utils.DecodeSelectiveAcknowledgement(message[1:])
 		if err != nil {
-			s.logger.Error("failed to persist client acknowledgement: ", err)
+			s.logger.Error("failed to parse selective acknowledgement: ", err)
+			return
 		}
-
-		if final {
-			conn.WriteControl(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(
-					websocket.CloseNormalClosure,
-					"sequence complete",
-				),
-				// This deadline could be made configurable.
-				time.Now().Add(1*time.Second),
-			)
-			conn.Close()
+		ranges := make([][2]int, len(received))
+		lastReceived := 0
+		for i, r := range received {
+			ranges[i] = [2]int{r[0], r[1] + 1}
+			for _, acked := range window.ackRange(r[0], r[1]+1) {
+				s.metrics.acksReceived.Inc()
+				s.metrics.ackLatency.Observe(acked.latency.Seconds())
+			}
+			if r[1] > lastReceived {
+				lastReceived = r[1]
+			}
 		}
+		window.markLostBefore(lastReceived)
+		s.persistAckRanges(conn, clientID, ranges)
+	} else if message[0] == utils.StopSequencePrefix {
+		lastReceived := -1
+		if index := binary.LittleEndian.Uint32(message[1:]); index != utils.NoIndex {
+			lastReceived = int(index)
+		}
+		select {
+		case stopRequests <- lastReceived:
+		default:
+			// The sequence is already being stopped.
+		}
+	} else if message[0] == utils.PauseSequencePrefix {
+		flow.setPaused(true)
+	} else if message[0] == utils.ResumeSequencePrefix {
+		flow.setPaused(false)
+	} else if message[0] == utils.SetRatePrefix {
+		requested := int(binary.LittleEndian.Uint32(message[1:]))
+		flow.setMessageInterval(s.boundMessageInterval(requested))
 	}
 }
 
-func prepareMessage(session sessions.SessionState, next uint32, index int) ([]byte, error) {
-	if index < len(session.Sequence)-1 {
-		numberInBytes := utils.Uint32ToByteArray([]uint32{next})
-		return append([]byte{utils.NumberInSequencePrefix}, numberInBytes...), nil
+// Checks the prefix of a message from a client and that it is the right
+// size for the prefix, messages are read without any further length checks.
+func isWellFormedClientMessage(message []byte) bool {
+	if len(message) == 0 {
+		return false
 	}
 
-	finalMessage := utils.SequenceFinalMessage{
-		Number:   next,
-		Checksum: utils.CreateChecksum(session.Sequence),
+	switch message[0] {
+	case utils.AcknowledgementPrefix,
+		utils.CumulativeAcknowledgementPrefix,
+		utils.StopSequencePrefix,
+		utils.SetRatePrefix:
+		return len(message) == 5
+	case utils.SelectiveAcknowledgementPrefix:
+		return len(message) > 1 && (len(message)-1)%8 == 0
+	case utils.PauseSequencePrefix, utils.ResumeSequencePrefix:
+		return len(message) == 1
+	default:
+		return false
 	}
-	messageBytes, err := json.Marshal(&finalMessage)
+}
+
+func (s *serverImpl) persistAck(conn clientConn, clientID string, index int) {
+	final, err := s.store.Ack(clientID, index)
 	if err != nil {
-		return nil, err
+		s.logger.Error("failed to persist client acknowledgement: ", err)
+	}
+
+	if final {
+		s.writeCloseMessage(conn, websocket.CloseNormalClosure, "sequence complete")
+		conn.Close()
 	}
-	return append([]byte{utils.LastNumberInSequencePrefix}, messageBytes...), nil
 }
 
-func isExpiredSessionError(errMessage string) bool {
-	// todo: make this cleaner by using custom error structs with custom code
-	// properties.
-	return strings.HasPrefix(errMessage, "session has expired for client id")
+func (s *serverImpl) persistAckRanges(conn clientConn, clientID string, ranges [][2]int) {
+	complete, err := s.store.AckRanges(clientID, ranges)
+	if err != nil {
+		s.logger.Error("failed to persist client acknowledgements: ", err)
+	}
+
+	if complete {
+		s.writeCloseMessage(conn, websocket.CloseNormalClosure, "sequence complete")
+		conn.Close()
+	}
 }
 
-func isSequenceConsumedError(err error) bool {
-	if err == nil {
-		return false
+// Selects the generator for a new session from the generator query parameter,
+// the default generator is used when no generator is requested.
+func (s *serverImpl) selectGenerator(name string) (sequence.SequenceGenerator, bool) {
+	if name == "" || name == s.generator.Name() {
+		return s.generator, true
+	}
+
+	for _, generator := range s.params.SelectableGenerators {
+		if generator.Name() == name {
+			return generator, true
+		}
+	}
+	return nil, false
+}
+
+func (s *serverImpl) writeHandshake(conn clientConn, setup *sessionSetup) error {
+	handshakeBytes, err := json.Marshal(createHandshake(setup))
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(
+		append([]byte{utils.SequenceHandshakePrefix}, handshakeBytes...),
+	)
+}
+
+// Must only be called for the request that created the session.
+func createHandshake(setup *sessionSetup) *utils.SequenceHandshakeMessage {
+	return &utils.SequenceHandshakeMessage{
+		Generator: setup.generator.Name(),
+		Seed:      setup.generated.Seed,
+		Token:     setup.token,
+	}
+}
+
+func generatedSequence(generated *sequence.GeneratedSequence) sequence.Sequence {
+	if generated == nil {
+		return nil
 	}
+	return generated.Sequence
+}
+
+// Unbounded sequences have no final number, they are streamed
+// until the client asks the server to stop.
+func isFinalIndex(session sessions.SessionState, index int) bool {
+	return index == session.Sequence.Len()-1 && !sequence.IsUnbounded(session.Sequence)
+}
 
-	// todo: make this cleaner by using custom error structs with custom code
-	// properties.
-	return strings.HasPrefix(err.Error(), "sequence consumed for session with client id")
+func prepareMessage(codec utils.Codec, session sessions.SessionState, next uint32, index int) ([]byte, error) {
+	if !isFinalIndex(session, index) {
+		return codec.EncodeNumber(index, next), nil
+	}
+	return codec.EncodeLastNumber(index, next, sequence.Checksum(session.Sequence))
+}
+
+// Retransmitted numbers carry their index so the client can discard
+// numbers it has already received.
+// The final number is retransmitted as is since the client stops reading
+// from the connection once it has received the complete sequence.
+func prepareRetransmission(
+	codec utils.Codec,
+	session sessions.SessionState,
+	number uint32,
+	index int,
+) ([]byte, error) {
+	if !isFinalIndex(session, index) {
+		return codec.EncodeRetransmission(index, number), nil
+	}
+	return prepareMessage(codec, session, number, index)
 }
 
 func deriveSequenceCount(queryParam string) (int, error) {
 	if queryParam == "" {
 		return rand.Intn(int(MaxSequenceNumberValue)), nil
 	}
+	if queryParam == InfiniteSequenceCount {
+		return sequence.UnboundedLength, nil
+	}
 
-	sequenceCount, err := strconv.Atoi(queryParam)
+	sequenceCount, err := strconv.ParseUint(queryParam, 10, 32)
 	if err != nil {
-		return 0, err
-	}
-	if sequenceCount > int(MaxSequenceNumberValue) {
-		return 0, errors.New("sequenceCount must be less than or equal to 0xffff")
+		return 0, errors.New("sequenceCount must be less than or equal to 0xffffffff")
 	}
-	return sequenceCount, nil
+	return int(sequenceCount), nil
 }
 
 func deriveLastReceivedIndex(queryParam string) (int, error) {
@@ -237,8 +870,8 @@ func deriveLastReceivedIndex(queryParam string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	if lastReceivedIndex > int(MaxSequenceNumberValue) {
-		return 0, errors.New("lastReceivedIndex must be less than or equal to 0xffff")
+	if lastReceivedIndex >= int(MaxSequenceLength) {
+		return 0, errors.New("lastReceivedIndex must be less than 0xffffffff")
 	}
 	return lastReceivedIndex, nil
 }
@@ -1,23 +1,202 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/client"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/metrics"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
 	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 )
 
 func Test_server_produces_sequence_of_numbers_and_client_processes_them_successfully(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
 
+		server := createTestServer()
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         200,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		result := client.Result(context.Background())
+		if result.Error != nil {
+			t.Error("result contained error: ", result.Error)
+			t.FailNow()
+		}
+
+		if !result.Success {
+			t.Error("did not succeed, result.Success was false")
+			t.FailNow()
+		}
+
+		if result.Checksum != result.ServerChecksum {
+			t.Error("expected checksums from client and server to match")
+		}
+	})
+}
+
+func Test_client_streams_each_number_in_order_exactly_once(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		server := createTestServer()
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         200,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		streamed := collectStreamedNumbers(t, client)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		result := client.Result(context.Background())
+		if result.Error != nil {
+			t.Error("result contained error: ", result.Error)
+			t.FailNow()
+		}
+
+		if len(*streamed) != 200 {
+			t.Errorf("expected 200 numbers to be streamed, received %d", len(*streamed))
+		}
+
+		if utils.CreateChecksum(*streamed) != result.ServerChecksum {
+			t.Error("expected checksum of streamed numbers to match the one from the server")
+		}
+	})
+}
+
+func Test_server_produces_sequence_of_numbers_over_tls(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		server := createTLSTestServer()
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		// Verify the self-signed certificate of the test server through a CA bundle file
+		// in the same way the client app is configured.
+		caBundleFile := filepath.Join(t.TempDir(), "ca.pem")
+		err = os.WriteFile(
+			caBundleFile,
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+			0o600,
+		)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		tlsConfig, err := client.NewTLSConfig(caBundleFile, false)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         200,
+			UseTLS:                true,
+			TLSConfig:             tlsConfig,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		result := client.Result(context.Background())
+		if result.Error != nil {
+			t.Error("result contained error: ", result.Error)
+			t.FailNow()
+		}
+
+		if !result.Success {
+			t.Error("did not succeed, result.Success was false")
+			t.FailNow()
+		}
+
+		if result.Checksum != result.ServerChecksum {
+			t.Error("expected checksums from client and server to match")
+		}
+	})
+}
+
+func Test_tls_connection_with_insecure_skip_verify(t *testing.T) {
 	logger := createLogger()
 
-	server := createTestServer()
+	server := createTLSTestServer()
 	defer server.Close()
 
 	serverURL, err := url.Parse(server.URL)
@@ -28,12 +207,20 @@ func Test_server_produces_sequence_of_numbers_and_client_processes_them_successf
 	host := serverURL.Hostname()
 	port, _ := strconv.Atoi(serverURL.Port())
 
+	tlsConfig, err := client.NewTLSConfig("", true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
 	clientParams := &client.ClientParams{
 		ServerHost:            host,
 		ServerPort:            port,
 		SendLastReceivedIndex: true,
 		MaxReconnectAttempts:  100,
-		SequenceCount:         200,
+		SequenceCount:         20,
+		UseTLS:                true,
+		TLSConfig:             tlsConfig,
 	}
 	client := client.NewDefaultClient(clientParams, logger)
 	err = client.Connect()
@@ -42,26 +229,16 @@ func Test_server_produces_sequence_of_numbers_and_client_processes_them_successf
 		t.FailNow()
 	}
 
-	result := client.Result()
-	if result.Error != nil {
-		t.Error("result contained error: ", result.Error)
-		t.FailNow()
-	}
-
-	if !result.Success {
-		t.Error("did not succeed, result.Success was false")
-		t.FailNow()
-	}
-
-	if result.Checksum != result.ServerChecksum {
-		t.Error("expected checksums from client and server to match")
+	result := client.Result(context.Background())
+	if result.Error != nil || !result.Success {
+		t.Error("expected sequence to be received successfully, received error: ", result.Error)
 	}
 }
 
-func Test_failure_due_to_missing_client_id(t *testing.T) {
+func Test_failure_due_to_untrusted_server_certificate(t *testing.T) {
 	logger := createLogger()
 
-	server := createTestServer()
+	server := createTLSTestServer()
 	defer server.Close()
 
 	serverURL, err := url.Parse(server.URL)
@@ -72,209 +249,3364 @@ func Test_failure_due_to_missing_client_id(t *testing.T) {
 	host := serverURL.Hostname()
 	port, _ := strconv.Atoi(serverURL.Port())
 
-	overrideClientID := ""
 	clientParams := &client.ClientParams{
 		ServerHost:            host,
 		ServerPort:            port,
 		SendLastReceivedIndex: true,
-		MaxReconnectAttempts:  100,
-		SequenceCount:         200,
-		OverrideClientID:      &overrideClientID,
+		// Fail on the first attempt.
+		MaxReconnectAttempts: 0,
+		SequenceCount:        20,
+		UseTLS:               true,
 	}
 	client := client.NewDefaultClient(clientParams, logger)
 	err = client.Connect()
-	if err != nil {
-		t.Error(err)
-		t.FailNow()
+	if err == nil {
+		t.Error("expected connecting to a server with a self-signed certificate to fail")
 	}
+}
 
-	result := client.Result()
-	if result.Error == nil {
-		t.Error("result does not contain an error when one was expected")
-		t.FailNow()
-	}
+func Test_failure_due_to_missing_client_id(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
 
-	if !strings.HasSuffix(result.Error.Error(), "code[CloseCodeMissingClientID(4002)] reason: missing client id") {
-		t.Error("expected error to be a 4002 missing client id but received: ", result.Error)
-	}
+		server := createTestServer()
+		defer server.Close()
 
-	if result.Success {
-		t.Error("expected result.Success to be false, received true")
-		t.FailNow()
-	}
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		overrideClientID := ""
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         200,
+			OverrideClientID:      &overrideClientID,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		result := client.Result(context.Background())
+		if result.Error == nil {
+			t.Error("result does not contain an error when one was expected")
+			t.FailNow()
+		}
+
+		if !strings.HasSuffix(result.Error.Error(), "code[CloseCodeMissingClientID(4002)] reason: missing client id") {
+			t.Error("expected error to be a 4002 missing client id but received: ", result.Error)
+		}
+
+		if result.Success {
+			t.Error("expected result.Success to be false, received true")
+			t.FailNow()
+		}
+	})
 }
 
 func Test_failure_due_to_invalid_sequence_count(t *testing.T) {
-	logger := createLogger()
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
 
-	server := createTestServer()
-	defer server.Close()
+		server := createTestServer()
+		defer server.Close()
 
-	serverURL, err := url.Parse(server.URL)
-	if err != nil {
-		t.Error(err)
-		t.FailNow()
-	}
-	host := serverURL.Hostname()
-	port, _ := strconv.Atoi(serverURL.Port())
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
 
-	clientParams := &client.ClientParams{
-		ServerHost:            host,
-		ServerPort:            port,
-		SendLastReceivedIndex: true,
-		MaxReconnectAttempts:  100,
-		// Max size for sequence count is 0xffff.
-		SequenceCount: 0xffff1,
-	}
-	client := client.NewDefaultClient(clientParams, logger)
-	err = client.Connect()
-	if err != nil {
-		t.Error(err)
-		t.FailNow()
-	}
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			// Max size for sequence count is 0xffffffff.
+			SequenceCount: 0xffffffff1,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
 
-	result := client.Result()
-	if result.Error == nil {
-		t.Error("result does not contain an error when one was expected")
-		t.FailNow()
-	}
+		result := client.Result(context.Background())
+		if result.Error == nil {
+			t.Error("result does not contain an error when one was expected")
+			t.FailNow()
+		}
 
-	if !strings.HasSuffix(
-		result.Error.Error(),
-		"code[CloseCodeInvalidSequenceCount(4003)] reason: "+
-			"sequence count must be an integer less than or equal to 0xffff",
-	) {
-		t.Error("expected error to be a 4003 invalid sequence count but received: ", result.Error)
-	}
+		if !strings.HasSuffix(
+			result.Error.Error(),
+			"code[CloseCodeInvalidSequenceCount(4003)] reason: "+
+				"sequence count must be an integer less than or equal to 0xffffffff or infinite",
+		) {
+			t.Error("expected error to be a 4003 invalid sequence count but received: ", result.Error)
+		}
 
-	if result.Success {
-		t.Error("expected result.Success to be false, received true")
-		t.FailNow()
-	}
+		if result.Success {
+			t.Error("expected result.Success to be false, received true")
+			t.FailNow()
+		}
+	})
 }
 
 func Test_failure_due_to_invalid_last_received_index(t *testing.T) {
-	logger := createLogger()
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
 
-	server := createTestServer()
-	defer server.Close()
+		server := createTestServer()
+		defer server.Close()
 
-	serverURL, err := url.Parse(server.URL)
-	if err != nil {
-		t.Error(err)
-		t.FailNow()
-	}
-	host := serverURL.Hostname()
-	port, _ := strconv.Atoi(serverURL.Port())
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
 
-	// Max size for last received index is 0xffff.
-	overrideLastReceivedIndex := 0xffff2
-	clientParams := &client.ClientParams{
-		ServerHost:                host,
-		ServerPort:                port,
-		SendLastReceivedIndex:     true,
-		MaxReconnectAttempts:      100,
-		SequenceCount:             200,
-		OverrideLastReceivedIndex: &overrideLastReceivedIndex,
-	}
-	client := client.NewDefaultClient(clientParams, logger)
-	err = client.Connect()
-	if err != nil {
-		t.Error(err)
-		t.FailNow()
-	}
+		// Last received index must be less than 0xffffffff.
+		overrideLastReceivedIndex := 0xffffffff
+		clientParams := &client.ClientParams{
+			ServerHost:                host,
+			ServerPort:                port,
+			Transport:                 transport,
+			SendLastReceivedIndex:     true,
+			MaxReconnectAttempts:      100,
+			SequenceCount:             200,
+			OverrideLastReceivedIndex: &overrideLastReceivedIndex,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
 
-	result := client.Result()
-	if result.Error == nil {
-		t.Error("result does not contain an error when one was expected")
-		t.FailNow()
-	}
+		result := client.Result(context.Background())
+		if result.Error == nil {
+			t.Error("result does not contain an error when one was expected")
+			t.FailNow()
+		}
 
-	if !strings.HasSuffix(
-		result.Error.Error(),
-		"code[CloseCodeInvalidLastReceived(4004)] reason: if provided, "+
-			"last received index must be an integer less than or equal to 0xffff",
-	) {
-		t.Error("expected error to be a 4003 invalid sequence count but received: ", result.Error)
-	}
+		if !strings.HasSuffix(
+			result.Error.Error(),
+			"code[CloseCodeInvalidLastReceived(4004)] reason: if provided, "+
+				"last received index must be an integer less than 0xffffffff",
+		) {
+			t.Error("expected error to be a 4003 invalid sequence count but received: ", result.Error)
+		}
 
-	if result.Success {
-		t.Error("expected result.Success to be false, received true")
-		t.FailNow()
-	}
+		if result.Success {
+			t.Error("expected result.Success to be false, received true")
+			t.FailNow()
+		}
+	})
 }
 
-func Test_server_handles_concurrent_clients(t *testing.T) {
-	logger := createLogger()
+func Test_client_can_reproduce_sequence_from_handshake_seed(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
 
-	server := createTestServer()
-	defer server.Close()
+		testServer := createTestServerWithParams(&ServerParams{SequenceMessageInterval: 1}, logger)
+		defer testServer.Close()
 
-	serverURL, err := url.Parse(server.URL)
-	if err != nil {
-		t.Error(err)
-		t.FailNow()
-	}
-	host := serverURL.Hostname()
-	port, _ := strconv.Atoi(serverURL.Port())
+		serverURL, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
 
-	resultChan := make(chan client.Result, 60)
-	for i := 0; i < 30; i += 1 {
-		go func(outputChan chan client.Result) {
-			clientParams := &client.ClientParams{
-				ServerHost:            host,
-				ServerPort:            port,
-				SendLastReceivedIndex: true,
-				MaxReconnectAttempts:  100,
-				SequenceCount:         200,
-			}
-			client := client.NewDefaultClient(clientParams, logger)
-			err = client.Connect()
-			if err != nil {
-				t.Error(err)
+		client := client.NewDefaultClient(&client.ClientParams{
+			ServerHost:           host,
+			ServerPort:           port,
+			Transport:            transport,
+			MaxReconnectAttempts: 5,
+			SequenceCount:        50,
+		}, logger)
+		streamed := collectStreamedNumbers(t, client)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		result := client.Result(context.Background())
+		if result.Error != nil || !result.Success {
+			t.Error("expected sequence to be received successfully, received error: ", result.Error)
+			t.FailNow()
+		}
+		if result.Generator != sequence.GeneratorSeeded || result.Seed == nil {
+			t.Fatalf("expected a seeded generator handshake, received generator %q", result.Generator)
+		}
+
+		for i, number := range *streamed {
+			expected := sequence.SeededNumber(*result.Seed, i, MaxSequenceNumberValue)
+			if number != expected {
+				t.Fatalf("expected %d at index %d from the seed, received %d", expected, i, number)
 			}
+		}
+	})
+}
 
-			result := client.Result()
-			outputChan <- result
-		}(resultChan)
-	}
+func Test_client_selects_sequence_generator(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
 
-	collectedResults := []client.Result{}
-	for len(collectedResults) < 30 {
-		select {
-		case result := <-resultChan:
-			collectedResults = append(collectedResults, result)
-		case <-time.After(60 * time.Second):
-			t.Error("timed out waiting for result from concurrent clients")
+		testServer := createTestServerWithParams(&ServerParams{
+			SequenceMessageInterval: 1,
+			SelectableGenerators:    []sequence.SequenceGenerator{sequence.NewCounterGenerator()},
+		}, logger)
+		defer testServer.Close()
+
+		serverURL, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Error(err)
 			t.FailNow()
 		}
-	}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
 
-	for i := 0; i < 30; i += 1 {
-		result := collectedResults[i]
-		if result.Error != nil {
-			t.Error("result contained error: ", result.Error)
+		counterClient := client.NewDefaultClient(&client.ClientParams{
+			ServerHost:           host,
+			ServerPort:           port,
+			Transport:            transport,
+			MaxReconnectAttempts: 5,
+			SequenceCount:        20,
+			Generator:            sequence.GeneratorCounter,
+		}, logger)
+		streamed := collectStreamedNumbers(t, counterClient)
+		err = counterClient.Connect()
+		if err != nil {
+			t.Error(err)
 			t.FailNow()
 		}
 
-		if !result.Success {
-			t.Error("did not succeed, result.Success was false")
+		result := counterClient.Result(context.Background())
+		if result.Error != nil || !result.Success || result.Generator != sequence.GeneratorCounter {
+			t.Fatalf("expected the counter generator to be used, received generator %q error %v", result.Generator, result.Error)
+		}
+		for i, number := range *streamed {
+			if number != uint32(i) {
+				t.Fatalf("expected %d at index %d, received %d", i, i, number)
+			}
+		}
+
+		// Generators that have not been made selectable by the server are rejected.
+		cryptoClient := client.NewDefaultClient(&client.ClientParams{
+			ServerHost:           host,
+			ServerPort:           port,
+			Transport:            transport,
+			MaxReconnectAttempts: 5,
+			SequenceCount:        20,
+			Generator:            sequence.GeneratorCrypto,
+		}, logger)
+		err = cryptoClient.Connect()
+		if err != nil {
+			t.Error(err)
 			t.FailNow()
 		}
 
-		if result.Checksum != result.ServerChecksum {
-			t.Error("expected checksums from client and server to match")
+		result = cryptoClient.Result(context.Background())
+		if result.Error == nil || !strings.Contains(result.Error.Error(), "CloseCodeInvalidGenerator(4005)") {
+			t.Error("expected error to be a 4005 invalid generator but received: ", result.Error)
 		}
-	}
+	})
 }
 
-func createTestServer() *httptest.Server {
+func Test_server_resumes_from_the_number_after_the_last_received_index(t *testing.T) {
 	logger := createLogger()
 
-	storeParams := &sessions.InMemoryStoreParams{
-		ExpireAfterIdleTime: 30,
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "resume-after-last-received"
+	store.Initialise(clientID, sequence.List([]uint32{10, 11, 12, 13, 14}), "")
+	server := createTestServerWithStore(store)
+	defer server.Close()
+
+	// The client holds the numbers at indexes 0 and 1 so the
+	// first number sent must be the one at index 2.
+	conn, _, err := websocket.DefaultDialer.Dial(
+		strings.Replace(server.URL, "http", "ws", 1)+"?clientId="+clientID+"&sequenceCount=5&lastReceived=1",
+		nil,
+	)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
 	}
-	store := sessions.NewInMemoryStore(storeParams, logger)
+	defer conn.Close()
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if message[0] != utils.NumberInSequencePrefix || utils.ByteArrayToSingleUint32(message[1:]) != 12 {
+		t.Errorf("expected the number at index 2 (12) to be sent first, received %v", message)
+	}
+}
+
+func Test_server_handles_concurrent_clients(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		server := createTestServer()
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		resultChan := make(chan client.Result, 60)
+		for i := 0; i < 30; i += 1 {
+			go func(outputChan chan client.Result) {
+				clientParams := &client.ClientParams{
+					ServerHost:            host,
+					ServerPort:            port,
+					Transport:             transport,
+					SendLastReceivedIndex: true,
+					MaxReconnectAttempts:  100,
+					SequenceCount:         200,
+				}
+				client := client.NewDefaultClient(clientParams, logger)
+				err := client.Connect()
+				if err != nil {
+					t.Error(err)
+				}
+
+				result := client.Result(context.Background())
+				outputChan <- result
+			}(resultChan)
+		}
+
+		collectedResults := []client.Result{}
+		for len(collectedResults) < 30 {
+			select {
+			case result := <-resultChan:
+				collectedResults = append(collectedResults, result)
+			case <-time.After(60 * time.Second):
+				t.Error("timed out waiting for result from concurrent clients")
+				t.FailNow()
+			}
+		}
+
+		for i := 0; i < 30; i += 1 {
+			result := collectedResults[i]
+			if result.Error != nil {
+				t.Error("result contained error: ", result.Error)
+				t.FailNow()
+			}
+
+			if !result.Success {
+				t.Error("did not succeed, result.Success was false")
+				t.FailNow()
+			}
+
+			if result.Checksum != result.ServerChecksum {
+				t.Error("expected checksums from client and server to match")
+			}
+		}
+	})
+}
+
+func Test_failure_due_to_expired_session(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		// A negative idle time expires sessions on the next access.
+		store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: -1}, logger)
+		clientID := "expired-client"
+		store.Initialise(clientID, sequence.List([]uint32{1, 2, 3}), "")
+
+		server := createTestServerWithStore(store)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         3,
+			OverrideClientID:      &clientID,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		result := client.Result(context.Background())
+		if result.Error == nil {
+			t.Error("result does not contain an error when one was expected")
+			t.FailNow()
+		}
+
+		if !strings.HasSuffix(result.Error.Error(), "code[CloseCodeExpiredSession(4001)] reason: session has expired") {
+			t.Error("expected error to be a 4001 expired session but received: ", result.Error)
+		}
+	})
+}
+
+func Test_result_stops_waiting_when_context_is_done(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		server := createTestServer()
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			// Long enough that the sequence can not complete before the deadline.
+			SequenceCount: 10000,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		result := client.Result(ctx)
+		if !errors.Is(result.Error, context.DeadlineExceeded) {
+			t.Error("expected result error to be a context deadline exceeded error but received: ", result.Error)
+		}
+
+		if result.Success {
+			t.Error("expected result.Success to be false, received true")
+		}
+	})
+}
+
+func Test_server_closes_connection_to_stalled_client(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	server := NewDefaultServer(
+		&ServerParams{
+			SequenceMessageInterval: 5,
+			Heartbeat:               &utils.HeartbeatParams{PingInterval: 50, PongTimeout: 200},
+		},
+		store,
+		logger,
+	).(*serverImpl)
+	testServer := httptest.NewServer(server)
+	defer testServer.Close()
+
+	// A stalled client never reads from the connection so never
+	// responds to pings or acknowledges numbers.
+	stalledConn, _, err := websocket.DefaultDialer.Dial(
+		strings.Replace(testServer.URL, "http", "ws", 1)+"?clientId=stalled&sequenceCount=1000",
+		nil,
+	)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer stalledConn.Close()
+
+	waitForLiveConnections(t, server, 1)
+	waitForLiveConnections(t, server, 0)
+}
+
+func waitForLiveConnections(t *testing.T, server *serverImpl, expected int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.liveConnections() != expected {
+		if time.Now().After(deadline) {
+			t.Errorf("timed out waiting for the server to have %d live connections", expected)
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_client_reconnects_when_server_goes_silent(t *testing.T) {
+	// Long polls are separate requests so there is no connection to go silent.
+	transports := []string{client.TransportWebSocket, client.TransportEventStream}
+	forTransports(t, transports, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		realServer := NewDefaultServer(
+			&ServerParams{SequenceMessageInterval: 5},
+			sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger),
+			logger,
+		)
+
+		// The first connection is accepted and then left silent to simulate
+		// a half-open connection, subsequent connections are served as normal.
+		release := make(chan struct{})
+		var connections int32
+		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&connections, 1) > 1 {
+				realServer.ServeHTTP(w, r)
+				return
+			}
+			if r.URL.Path == EventStreamPath {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-release
+				return
+			}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			<-release
+		}))
+		defer testServer.Close()
+		defer close(release)
+
+		serverURL, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         50,
+			Heartbeat:             &utils.HeartbeatParams{PingInterval: 50, PongTimeout: 200},
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		result := client.Result(ctx)
+		if result.Error != nil {
+			t.Error("result contained error: ", result.Error)
+			t.FailNow()
+		}
+
+		if !result.Success {
+			t.Error("did not succeed, result.Success was false")
+		}
+
+		if atomic.LoadInt32(&connections) < 2 {
+			t.Error("expected the client to reconnect after the server went silent")
+		}
+	})
+}
+
+func Test_server_pauses_delivery_when_send_window_is_full(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		SendWindowSize:          5,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=slow-consumer&sequenceCount=100")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	expectHandshake(t, messages)
+
+	// Without acknowledgements the server must stop after filling the window.
+	received := collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 5 {
+		t.Fatalf("expected 5 messages before the window was full, received %d", len(received))
+	}
+
+	writeAck(t, conn, 0)
+	received = collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 1 {
+		t.Fatalf("expected 1 message after acknowledging a number, received %d", len(received))
+	}
+}
+
+func Test_server_retransmits_unacknowledged_numbers(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		SendWindowSize:          3,
+		RetransmitTimeout:       100,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=lossy&sequenceCount=100")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	expectHandshake(t, messages)
+
+	received := collectUntilQuiet(messages, 50*time.Millisecond)
+	if len(received) != 3 {
+		t.Fatalf("expected 3 messages before the window was full, received %d", len(received))
+	}
+	firstNumber := utils.ByteArrayToSingleUint32(received[0][1:])
+
+	// Retransmissions are sent in order of index so the unacknowledged
+	// number at index 0 must be the next message.
+	select {
+	case message := <-messages:
+		if message[0] != utils.RetransmittedNumberInSequencePrefix {
+			t.Fatalf("expected a retransmitted number, received message with prefix %d", message[0])
+		}
+		index := utils.ByteArrayToSingleUint32(message[1:5])
+		number := utils.ByteArrayToSingleUint32(message[5:])
+		if index != 0 || number != firstNumber {
+			t.Fatalf("expected %d at index 0 to be retransmitted, received %d at index %d", firstNumber, number, index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the unacknowledged number at index 0 to be retransmitted")
+	}
+}
+
+func Test_server_produces_sequence_with_send_window_and_retransmission(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		// Short enough that some numbers are likely to be retransmitted
+		// before their acknowledgements arrive, acknowledgements for event
+		// streams take longer as each one is sent in a separate request.
+		retransmitTimeout := 2
+		if transport == client.TransportEventStream {
+			retransmitTimeout = 10
+		}
+		testServer := createTestServerWithParams(&ServerParams{
+			SequenceMessageInterval: 1,
+			SendWindowSize:          4,
+			RetransmitTimeout:       retransmitTimeout,
+		}, logger)
+		defer testServer.Close()
+
+		serverURL, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientParams := &client.ClientParams{
+			ServerHost:            host,
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         200,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		result := client.Result(context.Background())
+		if result.Error != nil {
+			t.Error("result contained error: ", result.Error)
+			t.FailNow()
+		}
+
+		if !result.Success || result.Checksum != result.ServerChecksum {
+			t.Error("expected checksums from client and server to match")
+		}
+	})
+}
+
+func Test_server_exposes_metrics_in_prometheus_text_format(t *testing.T) {
+	logger := createLogger()
+	registry := metrics.NewRegistry()
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	server := NewDefaultServer(&ServerParams{
+		SequenceMessageInterval: 1,
+		SendWindowSize:          4,
+		Metrics:                 registry,
+	}, store, logger)
+	router := http.NewServeMux()
+	router.Handle("/metrics", registry)
+	router.Handle("/", server)
+	testServer := httptest.NewServer(router)
+	defer testServer.Close()
+
+	serverURL, err := url.Parse(testServer.URL)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	host := serverURL.Hostname()
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	client := client.NewDefaultClient(&client.ClientParams{
+		ServerHost:           host,
+		ServerPort:           port,
+		MaxReconnectAttempts: 5,
+		SequenceCount:        10,
+	}, logger)
+	err = client.Connect()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	result := client.Result(context.Background())
+	if result.Error != nil {
+		t.Error("result contained error: ", result.Error)
+		t.FailNow()
+	}
+
+	// Resume a session from the last received index with a second connection.
+	conn := dialTestServer(t, testServer, "?clientId=resuming-client&sequenceCount=3")
+	messages := readInBackground(conn)
+	<-messages
+	conn.Close()
+	conn = dialTestServer(t, testServer, "?clientId=resuming-client&lastReceived=0")
+	messages = readInBackground(conn)
+	<-messages
+	conn.Close()
+	waitForLiveConnections(t, server.(*serverImpl), 0)
+
+	resp, err := http.Get(testServer.URL + "/metrics")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	exposition := string(body)
+
+	expectedLines := []string{
+		"# TYPE numseq_numbers_sent_total counter",
+		"numseq_active_connections 0",
+		"numseq_acks_received_total 10",
+		"numseq_ack_latency_seconds_count 10",
+		`numseq_connections_total{type="fresh"} 2`,
+		`numseq_connections_total{type="resumed"} 1`,
+		`numseq_resumed_connections_total{resume_from="last_received"} 1`,
+		`numseq_close_codes_total{code="1000"} 1`,
+		`numseq_sessions{state="consumed"} 1`,
+		`numseq_sessions{state="idle"} 1`,
+		`numseq_sessions{state="active"} 0`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("expected metrics to contain %q, received:\n%s", line, exposition)
+		}
+	}
+}
+
+func Test_checking_for_an_existing_session_does_not_access_it(t *testing.T) {
+	logger := createLogger()
+	store := &accessCountingStore{
+		SessionStore: sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger),
+	}
+	testServer := createTestServerWithStore(store)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=existing-client&sequenceCount=3")
+	messages := readInBackground(conn)
+	<-messages
+	conn.Close()
+	conn = dialTestServer(t, testServer, "?clientId=existing-client&lastReceived=0")
+	messages = readInBackground(conn)
+	<-messages
+	conn.Close()
+
+	if gets := atomic.LoadInt32(&store.gets); gets != 0 {
+		t.Fatalf("expected the session to be checked without accessing it, received %d calls to Get", gets)
+	}
+}
+
+// Counts calls to Get, which update when a session was last accessed.
+type accessCountingStore struct {
+	sessions.SessionStore
+	gets int32
+}
+
+func (s *accessCountingStore) Get(clientID string) (sessions.SessionState, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.SessionStore.Get(clientID)
+}
+
+func Test_server_accepts_sequences_longer_than_0xffff(t *testing.T) {
+	logger := createLogger()
+	logger.SetLevel(logrus.InfoLevel)
+
+	testServer := createTestServerWithParams(&ServerParams{}, logger)
+	defer testServer.Close()
+
+	serverURL, err := url.Parse(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	client := client.NewDefaultClient(&client.ClientParams{
+		ServerHost:            serverURL.Hostname(),
+		ServerPort:            port,
+		SendLastReceivedIndex: true,
+		MaxReconnectAttempts:  100,
+		SequenceCount:         0x10000,
+		ResultTimeout:         60,
+	}, logger)
+	streamed := collectStreamedNumbers(t, client)
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	result := client.Result(context.Background())
+	if result.Error != nil || !result.Success {
+		t.Fatalf("expected the sequence to be received successfully, received %+v", result)
+	}
+	if len(*streamed) != 0x10000 {
+		t.Fatalf("expected 0x10000 numbers to be streamed, received %d", len(*streamed))
+	}
+}
+
+func Test_server_sends_checkpoints_for_each_block_of_numbers(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		CheckpointInterval:      4,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=checkpoints&sequenceCount=10")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	expectHandshake(t, messages)
+
+	numbers := []uint32{}
+	checkpoints := []utils.SequenceCheckpointMessage{}
+	for _, message := range collectUntilQuiet(messages, 200*time.Millisecond) {
+		switch message[0] {
+		case utils.NumberInSequencePrefix:
+			numbers = append(numbers, utils.ByteArrayToSingleUint32(message[1:]))
+		case utils.SequenceCheckpointPrefix:
+			checkpoint := utils.SequenceCheckpointMessage{}
+			err := json.Unmarshal(message[1:], &checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checkpoint.ToIndex != len(numbers)-1 {
+				t.Fatalf("expected checkpoint to follow the number at index %d, received %+v", checkpoint.ToIndex, checkpoint)
+			}
+			checkpoints = append(checkpoints, checkpoint)
+		}
+	}
+
+	// The final number carries the checksum of the full sequence
+	// so there is no checkpoint for the last partial block.
+	if len(checkpoints) != 2 {
+		t.Fatalf("expected 2 checkpoints, received %d", len(checkpoints))
+	}
+	for i, checkpoint := range checkpoints {
+		if checkpoint.FromIndex != i*4 || checkpoint.ToIndex != i*4+3 {
+			t.Fatalf("expected checkpoint %d to cover indexes %d to %d, received %+v", i, i*4, i*4+3, checkpoint)
+		}
+		expected := utils.CreateChecksum(numbers[checkpoint.FromIndex : checkpoint.ToIndex+1])
+		if checkpoint.Checksum != expected {
+			t.Fatalf("expected checkpoint %d checksum %s, received %s", i, expected, checkpoint.Checksum)
+		}
+	}
+}
+
+func Test_client_stops_infinite_sequence_and_verifies_checkpoints(t *testing.T) {
+	// Sequences can not be stopped over long polling.
+	transports := []string{client.TransportWebSocket, client.TransportEventStream}
+	forTransports(t, transports, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		storeParams := &sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}
+		store := sessions.NewInMemoryStore(storeParams, logger)
+		testServer := httptest.NewServer(NewDefaultServer(&ServerParams{
+			SequenceMessageInterval: 1,
+			CheckpointInterval:      10,
+		}, store, logger))
+		defer testServer.Close()
+
+		serverURL, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientID := "infinite"
+		client := client.NewDefaultClient(&client.ClientParams{
+			ServerHost:            serverURL.Hostname(),
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			Infinite:              true,
+			OverrideClientID:      &clientID,
+			ResultTimeout:         10,
+		}, logger)
+		streamed := []uint32{}
+		client.OnNumber(func(index int, number uint32) {
+			streamed = append(streamed, number)
+			if index == 34 {
+				client.Stop()
+			}
+		})
+		err = client.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		result := client.Result(context.Background())
+		if result.Error != nil || !result.Success {
+			t.Fatalf("expected the sequence to be stopped successfully, received %+v", result)
+		}
+		if len(streamed) < 35 {
+			t.Fatalf("expected at least 35 numbers to be streamed, received %d", len(streamed))
+		}
+		if result.Checksum != result.ServerChecksum || result.Checksum == "" {
+			t.Fatalf("expected checkpoint checksums from client and server to match, received %+v", result)
+		}
+
+		// Stopped sessions can not be resumed.
+		_, err = store.Get(clientID)
+		if !errors.Is(err, sessions.ErrSessionExpired) {
+			t.Fatalf("expected the stopped session to be expired, received %v", err)
+		}
+	})
+}
+
+func Test_server_serves_old_and_new_protocol_versions_side_by_side(t *testing.T) {
+	logger := createLogger()
+
+	server := createTestServer()
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	clients := map[string][]string{
+		"latest": nil,
+		"v1":     {utils.SubprotocolV1},
+		"v2":     {utils.SubprotocolV2},
+		// Clients that predate versioning do not request a subprotocol.
+		"unversioned": {},
+	}
+	results := make(chan error, len(clients))
+	for name, subprotocols := range clients {
+		go func(name string, subprotocols []string) {
+			client := client.NewDefaultClient(&client.ClientParams{
+				ServerHost:            serverURL.Hostname(),
+				ServerPort:            port,
+				SendLastReceivedIndex: true,
+				MaxReconnectAttempts:  100,
+				SequenceCount:         50,
+				Subprotocols:          subprotocols,
+			}, logger)
+			err := client.Connect()
+			if err != nil {
+				results <- fmt.Errorf("%s: %w", name, err)
+				return
+			}
+			defer client.Close()
+
+			result := client.Result(context.Background())
+			if result.Error != nil || !result.Success || result.Checksum != result.ServerChecksum {
+				results <- fmt.Errorf("%s: expected a successful result, received %+v", name, result)
+				return
+			}
+			results <- nil
+		}(name, subprotocols)
+	}
+
+	for range clients {
+		err := <-results
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func Test_server_selects_codec_for_negotiated_protocol_version(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{SequenceMessageInterval: 1}, logger)
+	defer testServer.Close()
+
+	for _, subprotocol := range []string{utils.SubprotocolV1, utils.SubprotocolV2} {
+		dialer := *websocket.DefaultDialer
+		dialer.Subprotocols = []string{subprotocol}
+		conn, _, err := dialer.Dial(
+			strings.Replace(testServer.URL, "http", "ws", 1)+"?clientId=codec-"+subprotocol+"&sequenceCount=3",
+			nil,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != subprotocol {
+			t.Fatalf("expected %s to be negotiated, received %q", subprotocol, conn.Subprotocol())
+		}
+		codec, _ := utils.CodecForSubprotocol(subprotocol)
+
+		messages := readInBackground(conn)
+		expectHandshake(t, messages)
+		received := collectUntilQuiet(messages, 200*time.Millisecond)
+		if len(received) != 3 {
+			t.Fatalf("expected 3 messages over %s, received %d", subprotocol, len(received))
+		}
+
+		numbers := []uint32{}
+		for i, message := range received[:2] {
+			index, number, err := codec.DecodeNumber(message[1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subprotocol == utils.SubprotocolV2 && index != i {
+				t.Fatalf("expected number at index %d to carry its index, received %d", i, index)
+			}
+			numbers = append(numbers, number)
+		}
+		_, finalMessage, err := codec.DecodeLastNumber(received[2][1:])
+		if err != nil {
+			t.Fatalf("expected the last number to be decoded with the %s codec: %s", subprotocol, err)
+		}
+		numbers = append(numbers, finalMessage.Number)
+		if utils.CreateChecksum(numbers) != finalMessage.Checksum {
+			t.Fatalf("expected the checksum over %s to match the numbers received", subprotocol)
+		}
+	}
+}
+
+func Test_failure_due_to_unsupported_protocol_version(t *testing.T) {
+	logger := createLogger()
+
+	server := createTestServer()
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	client := client.NewDefaultClient(&client.ClientParams{
+		ServerHost:            serverURL.Hostname(),
+		ServerPort:            port,
+		SendLastReceivedIndex: true,
+		MaxReconnectAttempts:  100,
+		SequenceCount:         50,
+		Subprotocols:          []string{"numseq.v99"},
+	}, logger)
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	result := client.Result(context.Background())
+	if result.Error == nil || !strings.HasSuffix(
+		result.Error.Error(),
+		"code[CloseCodeUnsupportedProtocolVersion(4006)] reason: none of the requested protocol versions are supported",
+	) {
+		t.Fatal("expected error to be a 4006 unsupported protocol version but received: ", result.Error)
+	}
+}
+
+func dialTestServer(t *testing.T, testServer *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(testServer.URL, "http", "ws", 1)+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Reads messages from the connection in the background as a connection
+// can not be read from again once a read deadline has passed.
+func readInBackground(conn *websocket.Conn) <-chan []byte {
+	messages := make(chan []byte, 1024)
+	go func() {
+		defer close(messages)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- message
+		}
+	}()
+	return messages
+}
+
+// Collects messages until none have been received for the given duration.
+func collectUntilQuiet(messages <-chan []byte, quietFor time.Duration) [][]byte {
+	received := [][]byte{}
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return received
+			}
+			received = append(received, message)
+		case <-time.After(quietFor):
+			return received
+		}
+	}
+}
+
+// Collects every message received within the given duration.
+func collectFor(messages <-chan []byte, duration time.Duration) [][]byte {
+	received := [][]byte{}
+	deadline := time.After(duration)
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return received
+			}
+			received = append(received, message)
+		case <-deadline:
+			return received
+		}
+	}
+}
+
+// The handshake is sent before any numbers on the connection that creates a session.
+func expectHandshake(t *testing.T, messages <-chan []byte) {
+	t.Helper()
+	select {
+	case message := <-messages:
+		if message[0] != utils.SequenceHandshakePrefix {
+			t.Fatalf("expected a handshake, received message with prefix %d", message[0])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the handshake")
+	}
+}
+
+func writeAck(t *testing.T, conn *websocket.Conn, index uint32) {
+	t.Helper()
+	err := conn.WriteMessage(
+		websocket.BinaryMessage,
+		append([]byte{utils.AcknowledgementPrefix}, utils.Uint32ToByteArray([]uint32{index})...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_event_stream_resumes_from_last_event_id(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "sse-resume"
+	store.Initialise(clientID, sequence.List([]uint32{10, 11, 12, 13, 14}), "")
+	testServer := createTestServerWithStore(store)
+	defer testServer.Close()
+
+	req, err := http.NewRequest(
+		http.MethodGet,
+		testServer.URL+EventStreamPath+"?clientId="+clientID+"&sequenceCount=5",
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Browsers send the ID of the last event they received when reconnecting.
+	req.Header.Set("Last-Event-ID", "2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected a text/event-stream response, received %q", contentType)
+	}
+	events := bufio.NewReader(resp.Body)
+
+	event, err := utils.ReadEvent(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != utils.EventNumber || event.ID != "3" || event.Data != "13" {
+		t.Fatalf("expected the stream to resume with the number at index 3, received %+v", event)
+	}
+
+	event, err = utils.ReadEvent(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finalMessage := utils.SequenceFinalMessage{}
+	err = json.Unmarshal([]byte(event.Data), &finalMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != utils.EventLastNumber || event.ID != "4" || finalMessage.Number != 14 ||
+		finalMessage.Checksum != utils.CreateChecksum([]uint32{10, 11, 12, 13, 14}) {
+		t.Fatalf("expected the final number with the checksum of the sequence, received %+v", event)
+	}
+
+	postEventStreamMessage(t, testServer, clientID, utils.AcknowledgementPrefix, 4, http.StatusAccepted)
+
+	event, err = utils.ReadEvent(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeMessage := utils.EventStreamClose{}
+	err = json.Unmarshal([]byte(event.Data), &closeMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != utils.EventClose || closeMessage.Code != websocket.CloseNormalClosure ||
+		closeMessage.Reason != "sequence complete" {
+		t.Fatalf("expected the stream to close once the final number was acknowledged, received %+v", event)
+	}
+}
+
+func Test_event_stream_messages_without_a_live_stream(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "sse-offline"
+	store.Initialise(clientID, sequence.List([]uint32{1, 2, 3}), "")
+	testServer := createTestServerWithStore(store)
+	defer testServer.Close()
+
+	// Acknowledgements are persisted directly when the stream has already closed.
+	postEventStreamMessage(t, testServer, clientID, utils.AcknowledgementPrefix, 1, http.StatusNoContent)
+	session, err := store.Get(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Acknowledged != 1 {
+		t.Fatalf("expected 1 acknowledged number, received %d", session.Acknowledged)
+	}
+
+	postEventStreamMessage(t, testServer, clientID, utils.AcknowledgementPrefix, 3, http.StatusBadRequest)
+	postEventStreamMessage(t, testServer, "unknown", utils.AcknowledgementPrefix, 0, http.StatusNotFound)
+	postEventStreamMessage(t, testServer, clientID, utils.StopSequencePrefix, 0, http.StatusNotFound)
+	postEventStreamMessage(t, testServer, clientID, utils.SequenceHandshakePrefix, 0, http.StatusBadRequest)
+}
+
+func postEventStreamMessage(
+	t *testing.T,
+	testServer *httptest.Server,
+	clientID string,
+	prefix uint8,
+	index uint32,
+	expectedStatus int,
+) {
+	t.Helper()
+
+	message := append([]byte{prefix}, utils.Uint32ToByteArray([]uint32{index})...)
+	resp, err := http.Post(
+		testServer.URL+EventStreamMessagesPath+"?clientId="+clientID,
+		"application/octet-stream",
+		bytes.NewReader(message),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("expected status %d for message 0x%x, received %d", expectedStatus, prefix, resp.StatusCode)
+	}
+}
+
+func Test_client_switches_between_websocket_and_long_polling_mid_sequence(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "switch-transport"
+	numbers := []uint32{10, 11, 12, 13, 14, 15}
+	store.Initialise(clientID, sequence.List(numbers), "")
+	server := NewDefaultServer(&ServerParams{
+		SequenceMessageInterval: 1,
+		SendWindowSize:          3,
+		PollBatchSize:           2,
+	}, store, logger)
+	testServer := httptest.NewServer(server)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId="+clientID+"&sequenceCount=6")
+	messages := readInBackground(conn)
+	received := collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 3 {
+		t.Fatalf("expected 3 messages before the window was full, received %d", len(received))
+	}
+	// The acknowledgement of the last number received over the WebSocket
+	// is sent with the first poll.
+	writeAck(t, conn, 0)
+	writeAck(t, conn, 1)
+	// The WebSocket connection must no longer be taking numbers from the session
+	// once the client has switched to long polling.
+	collectUntilQuiet(messages, 100*time.Millisecond)
+	conn.Close()
+	waitForLiveConnections(t, server.(*serverImpl), 0)
+
+	batch := getPoll(t, testServer, "?clientId="+clientID+"&after=2", http.StatusOK)
+	if batch.FromIndex != 3 || !reflect.DeepEqual(batch.Numbers, []uint32{13, 14}) || batch.Checksum != "" {
+		t.Fatalf("expected the poll to continue from index 3, received %+v", batch)
+	}
+
+	batch = getPoll(t, testServer, "?clientId="+clientID+"&after=4", http.StatusOK)
+	if batch.FromIndex != 5 || !reflect.DeepEqual(batch.Numbers, []uint32{15}) ||
+		batch.Checksum != utils.CreateChecksum(numbers) {
+		t.Fatalf("expected the final number with the checksum of the sequence, received %+v", batch)
+	}
+
+	batch = getPoll(t, testServer, "?clientId="+clientID+"&after=5", http.StatusOK)
+	if !batch.Complete || len(batch.Numbers) != 0 {
+		t.Fatalf("expected the sequence to be complete once every number was acknowledged, received %+v", batch)
+	}
+	session, err := store.Get(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Acknowledged != len(numbers) {
+		t.Fatalf("expected %d acknowledged numbers, received %d", len(numbers), session.Acknowledged)
+	}
+}
+
+func Test_long_poll_rejects_invalid_requests(t *testing.T) {
+	testServer := createTestServer()
+	defer testServer.Close()
+
+	pollErr := &utils.PollError{}
+	getPollInto(t, testServer, "?sequenceCount=5", http.StatusBadRequest, pollErr)
+	if pollErr.Code != utils.CloseCodeMissingClientID {
+		t.Errorf("expected code %d, received %d", utils.CloseCodeMissingClientID, pollErr.Code)
+	}
+
+	getPollInto(t, testServer, "?clientId=poll-invalid&after=abc", http.StatusBadRequest, pollErr)
+	if pollErr.Code != utils.CloseCodeInvalidLastReceived {
+		t.Errorf("expected code %d, received %d", utils.CloseCodeInvalidLastReceived, pollErr.Code)
+	}
+}
+
+func getPoll(t *testing.T, testServer *httptest.Server, query string, expectedStatus int) *utils.PollResponse {
+	t.Helper()
+	batch := &utils.PollResponse{}
+	getPollInto(t, testServer, query, expectedStatus, batch)
+	return batch
+}
+
+func getPollInto(t *testing.T, testServer *httptest.Server, query string, expectedStatus int, body interface{}) {
+	t.Helper()
+
+	resp, err := http.Get(testServer.URL + LongPollPath + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("expected status %d for poll %q, received %d", expectedStatus, query, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_server_produces_sequence_of_numbers_over_tcp(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	server := NewDefaultServer(&ServerParams{SequenceMessageInterval: 5}, store, logger)
+	host, port := serveTCPForTest(t, server)
+
+	clientParams := &client.ClientParams{
+		ServerHost:            host,
+		ServerPort:            port,
+		Transport:             client.TransportTCP,
+		SendLastReceivedIndex: true,
+		MaxReconnectAttempts:  100,
+		SequenceCount:         200,
+		Heartbeat:             &utils.HeartbeatParams{PingInterval: 50, PongTimeout: 500},
+	}
+	client := client.NewDefaultClient(clientParams, logger)
+	streamed := collectStreamedNumbers(t, client)
+	err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := client.Result(context.Background())
+	if result.Error != nil {
+		t.Fatal("result contained error: ", result.Error)
+	}
+	if !result.Success {
+		t.Fatal("did not succeed, result.Success was false")
+	}
+	if len(*streamed) != 200 {
+		t.Errorf("expected 200 numbers to be streamed, received %d", len(*streamed))
+	}
+	if utils.CreateChecksum(*streamed) != result.ServerChecksum {
+		t.Error("expected checksum of streamed numbers to match the one from the server")
+	}
+}
+
+func Test_tcp_handshake_resumes_from_last_received_index(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "tcp-resume"
+	store.Initialise(clientID, sequence.List([]uint32{10, 11, 12, 13, 14}), "")
+	server := NewDefaultServer(&ServerParams{SequenceMessageInterval: 5}, store, logger)
+	host, port := serveTCPForTest(t, server)
+
+	conn := dialTCPForTest(t, host, port)
+	writeTCPHandshake(t, conn, &utils.TCPHandshake{
+		ClientID:         clientID,
+		SequenceCount:    5,
+		HasSequenceCount: true,
+		LastReceived:     2,
+	})
+
+	codec, _ := utils.CodecForSubprotocol(utils.SubprotocolV2)
+	message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, codec.EncodeNumber(3, 13)) {
+		t.Fatalf("expected the connection to resume with the number at index 3, received %v", message)
+	}
+
+	message, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message[0] != utils.LastNumberInSequencePrefix {
+		t.Fatalf("expected the final number, received message with prefix %d", message[0])
+	}
+
+	err = conn.WriteMessage(append([]byte{utils.AcknowledgementPrefix}, utils.Uint32ToByteArray([]uint32{4})...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTCPError(t, conn, websocket.CloseNormalClosure, "sequence complete")
+}
+
+func Test_tcp_handshake_errors_are_sent_as_error_frames(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	server := NewDefaultServer(&ServerParams{SequenceMessageInterval: 5}, store, logger)
+	host, port := serveTCPForTest(t, server)
+
+	conn := dialTCPForTest(t, host, port)
+	writeTCPHandshake(t, conn, &utils.TCPHandshake{LastReceived: utils.NoIndex})
+	expectTCPError(t, conn, utils.CloseCodeMissingClientID, "missing client id")
+
+	conn = dialTCPForTest(t, host, port)
+	writeTCPHandshake(t, conn, &utils.TCPHandshake{
+		ClientID:     "tcp-errors",
+		LastReceived: utils.NoIndex,
+		Generator:    "unknown",
+	})
+	expectTCPError(
+		t,
+		conn,
+		utils.CloseCodeInvalidGenerator,
+		"sequence generator is unknown or can not be selected by clients",
+	)
+
+	// Anything other than a handshake as the first frame is a protocol error.
+	conn = dialTCPForTest(t, host, port)
+	err := conn.WriteMessage(append([]byte{utils.AcknowledgementPrefix}, utils.Uint32ToByteArray([]uint32{0})...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTCPError(t, conn, websocket.CloseProtocolError, "expected a handshake frame")
+}
+
+func Test_server_ignores_short_frames_over_tcp(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "tcp-short-frames"
+	store.Initialise(clientID, sequence.List([]uint32{10, 11, 12}), "")
+	server := NewDefaultServer(&ServerParams{SequenceMessageInterval: 5}, store, logger)
+	host, port := serveTCPForTest(t, server)
+
+	conn := dialTCPForTest(t, host, port)
+	writeTCPHandshake(t, conn, &utils.TCPHandshake{
+		ClientID:         clientID,
+		SequenceCount:    3,
+		HasSequenceCount: true,
+		LastReceived:     utils.NoIndex,
+	})
+
+	// Frames that are too short to hold the index or rate for their prefix
+	// must be ignored rather than read past their end.
+	shortFrames := [][]byte{
+		{utils.AcknowledgementPrefix},
+		{utils.CumulativeAcknowledgementPrefix, 0, 0},
+		{utils.StopSequencePrefix, 0},
+		{utils.SelectiveAcknowledgementPrefix},
+		{utils.SelectiveAcknowledgementPrefix, 0, 0, 0, 0},
+		{utils.SetRatePrefix, 1, 0, 0},
+	}
+	for _, frame := range shortFrames {
+		err := conn.WriteMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message[0] == utils.LastNumberInSequencePrefix {
+			break
+		}
+	}
+	err := conn.WriteMessage(append([]byte{utils.AcknowledgementPrefix}, utils.Uint32ToByteArray([]uint32{2})...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTCPError(t, conn, websocket.CloseNormalClosure, "sequence complete")
+}
+
+// Serves the server over TCP on a random port until the test completes.
+func serveTCPForTest(t *testing.T, server Server) (string, int) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.ServeTCP(listener)
+
+	address := listener.Addr().(*net.TCPAddr)
+	return address.IP.String(), address.Port
+}
+
+func dialTCPForTest(t *testing.T, host string, port int) *utils.TCPConn {
+	t.Helper()
+
+	netConn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { netConn.Close() })
+	netConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return utils.NewTCPConn(netConn)
+}
+
+func writeTCPHandshake(t *testing.T, conn *utils.TCPConn, handshake *utils.TCPHandshake) {
+	t.Helper()
+
+	frame, err := utils.EncodeTCPHandshake(handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.WriteMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectTCPError(t *testing.T, conn *utils.TCPConn, expectedCode int, expectedReason string) {
+	t.Helper()
+
+	message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, reason, err := utils.DecodeTCPError(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != expectedCode || reason != expectedReason {
+		t.Fatalf("expected error frame %d %q, received %d %q", expectedCode, expectedReason, code, reason)
+	}
+}
+
+func Test_server_batches_numbers_and_accepts_cumulative_acknowledgements(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "batched"
+	numbers := []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	store.Initialise(clientID, sequence.List(numbers), "")
+	testServer := httptest.NewServer(NewDefaultServer(&ServerParams{
+		SequenceMessageInterval: 1,
+		MaxBatchSize:            4,
+	}, store, logger))
+	defer testServer.Close()
+
+	// The requested batch size is reduced to the maximum allowed by the server.
+	conn := dialTestServer(t, testServer, "?clientId="+clientID+"&sequenceCount=10&batchSize=8&batchInterval=200")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	received := collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 5 {
+		t.Fatalf("expected batch settings, 3 batches and the final number, received %d messages", len(received))
+	}
+
+	settings := utils.BatchSettingsMessage{}
+	err := json.Unmarshal(received[0][1:], &settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received[0][0] != utils.BatchSettingsPrefix || settings.BatchSize != 4 || settings.FlushInterval != 200 {
+		t.Fatalf("expected batch settings with a batch size of 4, received %+v", settings)
+	}
+
+	// The final number carries the checksum so is never batched.
+	expectedBatches := []struct {
+		fromIndex int
+		numbers   []uint32
+	}{
+		{fromIndex: 0, numbers: numbers[0:4]},
+		{fromIndex: 4, numbers: numbers[4:8]},
+		{fromIndex: 8, numbers: numbers[8:9]},
+	}
+	for i, expected := range expectedBatches {
+		message := received[i+1]
+		if message[0] != utils.NumberBatchPrefix {
+			t.Fatalf("expected a batch, received message with prefix %d", message[0])
+		}
+		fromIndex, batch, err := utils.DecodeNumberBatch(message[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fromIndex != expected.fromIndex || !reflect.DeepEqual(batch, expected.numbers) {
+			t.Fatalf("expected batch %v from index %d, received %v from index %d",
+				expected.numbers, expected.fromIndex, batch, fromIndex)
+		}
+	}
+	if received[4][0] != utils.LastNumberInSequencePrefix {
+		t.Fatalf("expected the final number, received message with prefix %d", received[4][0])
+	}
+
+	err = conn.WriteMessage(
+		websocket.BinaryMessage,
+		append([]byte{utils.CumulativeAcknowledgementPrefix}, utils.Uint32ToByteArray([]uint32{9})...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server closes the connection once every number has been acknowledged.
+	collectUntilQuiet(messages, time.Second)
+	session, err := store.Get(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Acknowledged != len(numbers) {
+		t.Fatalf("expected %d acknowledged numbers, received %d", len(numbers), session.Acknowledged)
+	}
+}
+
+func Test_server_resends_gaps_reported_by_selective_acknowledgements(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "selective"
+	numbers := []uint32{10, 11, 12, 13, 14}
+	store.Initialise(clientID, sequence.List(numbers), "")
+	// The retransmit timeout is long enough that only the selective
+	// acknowledgement can cause the missing number to be resent in time.
+	testServer := httptest.NewServer(NewDefaultServer(&ServerParams{
+		SequenceMessageInterval: 1,
+		SendWindowSize:          10,
+		RetransmitTimeout:       5000,
+	}, store, logger))
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId="+clientID+"&sequenceCount=5")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	received := collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 5 {
+		t.Fatalf("expected 5 messages, received %d", len(received))
+	}
+
+	err := conn.WriteMessage(
+		websocket.BinaryMessage,
+		utils.EncodeSelectiveAcknowledgement([][2]int{{0, 1}, {3, 3}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case message := <-messages:
+		if message[0] != utils.RetransmittedNumberInSequencePrefix {
+			t.Fatalf("expected a retransmitted number, received message with prefix %d", message[0])
+		}
+		index := utils.ByteArrayToSingleUint32(message[1:5])
+		number := utils.ByteArrayToSingleUint32(message[5:])
+		if index != 2 || number != numbers[2] {
+			t.Fatalf("expected %d at index 2 to be retransmitted, received %d at index %d", numbers[2], number, index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the number missing at index 2 to be retransmitted")
+	}
+
+	session, err := store.Get(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Acknowledged != 3 {
+		t.Fatalf("expected 3 acknowledged numbers, received %d", session.Acknowledged)
+	}
+
+	err = conn.WriteMessage(
+		websocket.BinaryMessage,
+		utils.EncodeSelectiveAcknowledgement([][2]int{{2, 2}, {4, 4}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server closes the connection once every number has been acknowledged.
+	collectUntilQuiet(messages, time.Second)
+	session, err = store.Get(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Acknowledged != len(numbers) {
+		t.Fatalf("expected %d acknowledged numbers, received %d", len(numbers), session.Acknowledged)
+	}
+}
+
+func Test_server_accepts_cumulative_acknowledgements_without_batching(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	clientID := "cumulative"
+	store.Initialise(clientID, sequence.List([]uint32{10, 11, 12, 13, 14, 15}), "")
+	testServer := httptest.NewServer(NewDefaultServer(&ServerParams{
+		SequenceMessageInterval: 1,
+	}, store, logger))
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId="+clientID+"&sequenceCount=6")
+	messages := readInBackground(conn)
+	received := collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 6 {
+		t.Fatalf("expected 6 messages, received %d", len(received))
+	}
+	err := conn.WriteMessage(
+		websocket.BinaryMessage,
+		append([]byte{utils.CumulativeAcknowledgementPrefix}, utils.Uint32ToByteArray([]uint32{3})...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collectUntilQuiet(messages, 100*time.Millisecond)
+	conn.Close()
+
+	// Acknowledged numbers are skipped when the client reconnects.
+	conn = dialTestServer(t, testServer, "?clientId="+clientID+"&sequenceCount=6")
+	defer conn.Close()
+	messages = readInBackground(conn)
+	received = collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 2 {
+		t.Fatalf("expected the 2 unacknowledged numbers, received %d messages", len(received))
+	}
+	// The client has not said where it is resuming from so the first number carries its index.
+	codec, _ := utils.CodecForSubprotocol(utils.SubprotocolV1)
+	index, number, err := codec.DecodeRetransmission(received[0][1:])
+	if err != nil || received[0][0] != utils.RetransmittedNumberInSequencePrefix || index != 4 || number != 14 ||
+		received[1][0] != utils.LastNumberInSequencePrefix {
+		t.Fatalf("expected 14 at index 4 followed by the final number, received %v", received)
+	}
+}
+
+func Test_unbounded_send_window_only_tracks_a_bounded_number_of_numbers(t *testing.T) {
+	window := newSendWindow(0, 0)
+	for index := 0; index < unboundedWindowTrackingLimit+10; index += 1 {
+		window.add(index, uint32(index))
+	}
+	if len(window.inFlight) != unboundedWindowTrackingLimit {
+		t.Fatalf("expected %d numbers to be tracked, tracked %d", unboundedWindowTrackingLimit, len(window.inFlight))
+	}
+	if window.fullWith(1) {
+		t.Fatal("expected an unbounded window to never be full")
+	}
+
+	// Acknowledgements make room to measure the latency of later numbers.
+	window.ackThrough(9)
+	window.add(unboundedWindowTrackingLimit+10, 0)
+	if _, inFlight := window.ack(unboundedWindowTrackingLimit + 10); !inFlight {
+		t.Fatal("expected the number sent after acknowledgements to be tracked")
+	}
+}
+
+func Test_server_sends_batches_early_when_the_send_window_is_full(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		SendWindowSize:          3,
+		MaxBatchSize:            10,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=batched-window&sequenceCount=100&batchSize=10&batchInterval=1000")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	expectHandshake(t, messages)
+
+	received := collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 2 || received[1][0] != utils.NumberBatchPrefix {
+		t.Fatalf("expected batch settings followed by a batch, received %d messages", len(received))
+	}
+	fromIndex, batch, err := utils.DecodeNumberBatch(received[1][1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromIndex != 0 || len(batch) != 3 {
+		t.Fatalf("expected a batch of 3 numbers from index 0, received %d from index %d", len(batch), fromIndex)
+	}
+
+	err = conn.WriteMessage(
+		websocket.BinaryMessage,
+		append([]byte{utils.CumulativeAcknowledgementPrefix}, utils.Uint32ToByteArray([]uint32{2})...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = collectUntilQuiet(messages, 300*time.Millisecond)
+	if len(received) != 1 {
+		t.Fatalf("expected 1 batch once the window had space, received %d messages", len(received))
+	}
+	fromIndex, batch, err = utils.DecodeNumberBatch(received[0][1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromIndex != 3 || len(batch) != 3 {
+		t.Fatalf("expected a batch of 3 numbers from index 3, received %d from index %d", len(batch), fromIndex)
+	}
+}
+
+func Test_server_rejects_invalid_batch_settings(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{SequenceMessageInterval: 1, MaxBatchSize: 10}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=batched-invalid&sequenceCount=10&batchSize=-1")
+	defer conn.Close()
+	var closeErr *websocket.CloseError
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.As(err, &closeErr) || closeErr.Code != utils.CloseCodeInvalidBatchSettings {
+				t.Fatalf("expected close code %d, received %v", utils.CloseCodeInvalidBatchSettings, err)
+			}
+			return
+		}
+	}
+}
+
+func Test_client_receives_sequence_in_batches(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		// Transports that do not support batching ignore the requested batch size.
+		server := createTestServerWithParams(&ServerParams{
+			SequenceMessageInterval: 1,
+			SendWindowSize:          64,
+			RetransmitTimeout:       1000,
+			MaxBatchSize:            16,
+		}, logger)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		client := client.NewDefaultClient(&client.ClientParams{
+			ServerHost:            serverURL.Hostname(),
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         200,
+			BatchSize:             32,
+			BatchInterval:         20,
+		}, logger)
+		streamed := collectStreamedNumbers(t, client)
+		err = client.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := client.Result(context.Background())
+		if result.Error != nil || !result.Success {
+			t.Fatalf("expected the sequence to complete, received error %v", result.Error)
+		}
+		if len(*streamed) != 200 {
+			t.Errorf("expected 200 numbers to be streamed, received %d", len(*streamed))
+		}
+		if utils.CreateChecksum(*streamed) != result.ServerChecksum {
+			t.Error("expected checksum of streamed numbers to match the one from the server")
+		}
+	})
+}
+
+func Test_server_pauses_and_resumes_delivery(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 5,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=paused&sequenceCount=1000")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	expectHandshake(t, messages)
+
+	writeFlowControl(t, conn, []byte{utils.PauseSequencePrefix})
+	expectFlowSettings(t, messages, utils.FlowSettingsMessage{Paused: true, MessageInterval: 5})
+	received := collectUntilQuiet(messages, 200*time.Millisecond)
+	if len(received) != 0 {
+		t.Fatalf("expected no numbers while paused, received %d messages", len(received))
+	}
+
+	writeFlowControl(t, conn, []byte{utils.ResumeSequencePrefix})
+	expectFlowSettings(t, messages, utils.FlowSettingsMessage{Paused: false, MessageInterval: 5})
+	received = collectFor(messages, 100*time.Millisecond)
+	if len(received) == 0 {
+		t.Fatal("expected numbers once delivery was resumed")
+	}
+}
+
+func Test_server_keeps_requested_rates_within_bounds(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval:    20,
+		MinSequenceMessageInterval: 10,
+		MaxSequenceMessageInterval: 50,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=rate&sequenceCount=1000")
+	defer conn.Close()
+	messages := readInBackground(conn)
+	expectHandshake(t, messages)
+
+	for _, rate := range []struct {
+		requested uint32
+		expected  int
+	}{
+		{requested: 1000, expected: 50},
+		{requested: 0, expected: 10},
+		{requested: 30, expected: 30},
+	} {
+		writeFlowControl(t, conn, append(
+			[]byte{utils.SetRatePrefix},
+			utils.Uint32ToByteArray([]uint32{rate.requested})...,
+		))
+		expectFlowSettings(t, messages, utils.FlowSettingsMessage{MessageInterval: rate.expected})
+	}
+
+	// At 30 milliseconds between numbers, 300 milliseconds is enough time for around 10 numbers.
+	received := collectFor(messages, 300*time.Millisecond)
+	if len(received) < 5 || len(received) > 15 {
+		t.Fatalf("expected around 10 numbers at the requested rate, received %d", len(received))
+	}
+}
+
+func Test_client_pauses_resumes_and_changes_rate(t *testing.T) {
+	forTransports(t, []string{client.TransportWebSocket, client.TransportEventStream}, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		server := createTestServerWithParams(&ServerParams{
+			SequenceMessageInterval:    5,
+			MinSequenceMessageInterval: 1,
+		}, logger)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		testClient := client.NewDefaultClient(&client.ClientParams{
+			ServerHost:            serverURL.Hostname(),
+			ServerPort:            port,
+			Transport:             transport,
+			SendLastReceivedIndex: true,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         100,
+		}, logger)
+		var mu sync.Mutex
+		streamed := 0
+		started := make(chan struct{})
+		testClient.OnNumber(func(index int, number uint32) {
+			mu.Lock()
+			defer mu.Unlock()
+			streamed += 1
+			if index == 5 {
+				close(started)
+			}
+		})
+		streamedCount := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return streamed
+		}
+
+		err = testClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testClient.Close()
+		<-started
+
+		err = testClient.Pause()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Allow numbers in flight to arrive before checking delivery has paused.
+		time.Sleep(100 * time.Millisecond)
+		pausedAt := streamedCount()
+		time.Sleep(200 * time.Millisecond)
+		if streamedCount() != pausedAt {
+			t.Fatalf("expected no numbers while paused, received %d", streamedCount()-pausedAt)
+		}
+
+		err = testClient.SetRate(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = testClient.Resume()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := testClient.Result(context.Background())
+		if result.Error != nil || !result.Success {
+			t.Fatalf("expected the sequence to complete, received error %v", result.Error)
+		}
+		if streamedCount() != 100 {
+			t.Errorf("expected 100 numbers to be streamed, received %d", streamedCount())
+		}
+	})
+}
+
+func Test_client_resumes_session_from_numbers_received_by_a_previous_client(t *testing.T) {
+	forTransports(t, []string{client.TransportWebSocket, client.TransportEventStream}, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		server := createTestServerWithParams(&ServerParams{
+			SequenceMessageInterval: 1,
+		}, logger)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(serverURL.Port())
+		clientID := "resumed-" + transport
+		params := &client.ClientParams{
+			ServerHost:           serverURL.Hostname(),
+			ServerPort:           port,
+			Transport:            transport,
+			MaxReconnectAttempts: 100,
+			SequenceCount:        200,
+			OverrideClientID:     &clientID,
+			// A resumed client that is never sent the numbers it is missing
+			// must fail the test rather than wait forever.
+			ResultTimeout: 10,
+		}
+
+		// The first client exits part way through the sequence having only persisted
+		// the first 50 numbers, the numbers it acknowledged after those are lost with it.
+		var mu sync.Mutex
+		persisted := []uint32{}
+		exited := make(chan struct{})
+		firstClient := client.NewDefaultClient(params, logger)
+		firstClient.OnNumber(func(index int, number uint32) {
+			mu.Lock()
+			defer mu.Unlock()
+			if index < 50 {
+				persisted = append(persisted, number)
+			}
+			if index == 60 {
+				close(exited)
+			}
+		})
+		err = firstClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-exited
+		firstClient.Close()
+		// Allow the server to persist acknowledgements that were in flight.
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		resumeParams := *params
+		resumeParams.ReceivedNumbers = persisted
+		mu.Unlock()
+		secondClient := client.NewDefaultClient(&resumeParams, logger)
+		streamed := []uint32{}
+		secondClient.OnNumber(func(index int, number uint32) {
+			if index != len(persisted)+len(streamed) {
+				t.Errorf("expected number for index %d, received index %d", len(persisted)+len(streamed), index)
+			}
+			streamed = append(streamed, number)
+		})
+		err = secondClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer secondClient.Close()
+
+		result := secondClient.Result(context.Background())
+		if result.Error != nil || !result.Success {
+			t.Fatalf("expected the resumed sequence to complete, received error %v", result.Error)
+		}
+		if len(streamed) != 150 {
+			t.Errorf("expected the remaining 150 numbers to be streamed, received %d", len(streamed))
+		}
+		if utils.CreateChecksum(append(persisted, streamed...)) != result.ServerChecksum {
+			t.Error("expected checksum of the persisted and streamed numbers to match the one from the server")
+		}
+	})
+}
+
+func Test_client_places_each_number_once_when_connections_drop_at_awkward_moments(t *testing.T) {
+	for _, subprotocol := range []string{utils.SubprotocolV1, utils.SubprotocolV2} {
+		for _, acksLost := range []bool{true, false} {
+			name := fmt.Sprintf("%s/acks_lost=%t", subprotocol, acksLost)
+			t.Run(name, func(t *testing.T) {
+				logger := createLogger()
+
+				testServer := createTestServerWithParams(&ServerParams{SequenceMessageInterval: 1}, logger)
+				defer testServer.Close()
+				proxy := createCuttingProxy(testServer, []int{1, 7, 3, 12}, acksLost)
+				defer proxy.Close()
+
+				proxyURL, err := url.Parse(proxy.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				port, _ := strconv.Atoi(proxyURL.Port())
+				// Without the last received index the server resumes from the first
+				// number it has not seen an acknowledgement for.
+				client := client.NewDefaultClient(&client.ClientParams{
+					ServerHost:           proxyURL.Hostname(),
+					ServerPort:           port,
+					MaxReconnectAttempts: 100,
+					SequenceCount:        60,
+					Subprotocols:         []string{subprotocol},
+					ResultTimeout:        10,
+				}, logger)
+				streamed := []int{}
+				client.OnNumber(func(index int, number uint32) {
+					streamed = append(streamed, index)
+				})
+				err = client.Connect()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+
+				result := client.Result(context.Background())
+				if result.Error != nil || !result.Success || result.Checksum != result.ServerChecksum {
+					t.Fatalf("expected a successful result, received %+v", result)
+				}
+				for i, index := range streamed {
+					if index != i {
+						t.Fatalf("expected each number to be streamed once in order, received index %d at %d", index, i)
+					}
+				}
+			})
+		}
+	}
+}
+
+func Test_client_holds_numbers_after_a_gap_and_drops_duplicates(t *testing.T) {
+	logger := createLogger()
+
+	// Stands in for the server so numbers can be sent out of order.
+	conns := make(chan *websocket.Conn, 1)
+	fakeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: []string{utils.SubprotocolV2}}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	defer fakeServer.Close()
+
+	serverURL, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(serverURL.Port())
+	client := client.NewDefaultClient(&client.ClientParams{
+		ServerHost:           serverURL.Hostname(),
+		ServerPort:           port,
+		MaxReconnectAttempts: 1,
+		SequenceCount:        6,
+		Subprotocols:         []string{utils.SubprotocolV2},
+		ResultTimeout:        5,
+	}, logger)
+	streamed := collectStreamedNumbers(t, client)
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn := <-conns
+	defer conn.Close()
+	fromClient := readInBackground(conn)
+	send := func(message []byte) {
+		t.Helper()
+		err := conn.WriteMessage(websocket.BinaryMessage, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	codec, _ := utils.CodecForSubprotocol(utils.SubprotocolV2)
+	numbers := []uint32{10, 11, 12, 13, 14, 15}
+	for _, index := range []int{0, 1, 3, 4} {
+		send(codec.EncodeNumber(index, numbers[index]))
+	}
+	// The client reports the numbers held after the gap so the server
+	// can resend the missing number straight away.
+	var held [][2]int
+	for _, message := range collectUntilQuiet(fromClient, 200*time.Millisecond) {
+		if message[0] == utils.SelectiveAcknowledgementPrefix {
+			held, err = utils.DecodeSelectiveAcknowledgement(message[1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(held, [][2]int{{3, 4}}) {
+		t.Fatalf("expected a selective acknowledgement of the numbers after the gap, received %v", held)
+	}
+
+	send(codec.EncodeRetransmission(2, numbers[2]))
+	// Numbers the client already holds are dropped.
+	send(codec.EncodeNumber(1, numbers[1]))
+	send(codec.EncodeNumber(3, numbers[3]))
+	lastNumber, err := codec.EncodeLastNumber(5, numbers[5], utils.CreateChecksum(numbers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(lastNumber)
+
+	result := client.Result(context.Background())
+	if result.Error != nil || !result.Success || result.Checksum != result.ServerChecksum {
+		t.Fatalf("expected a successful result, received %+v", result)
+	}
+	if !reflect.DeepEqual(*streamed, numbers) {
+		t.Fatalf("expected each number to be streamed once in order, received %v", *streamed)
+	}
+}
+
+func Test_client_ignores_server_frames_too_short_for_their_prefix(t *testing.T) {
+	logger := createLogger()
+
+	// Stands in for the server so malformed frames can be sent.
+	conns := make(chan *websocket.Conn, 1)
+	fakeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: []string{utils.SubprotocolV2}}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	defer fakeServer.Close()
+
+	serverURL, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(serverURL.Port())
+	client := client.NewDefaultClient(&client.ClientParams{
+		ServerHost:           serverURL.Hostname(),
+		ServerPort:           port,
+		MaxReconnectAttempts: 1,
+		SequenceCount:        2,
+		Subprotocols:         []string{utils.SubprotocolV2},
+		ResultTimeout:        5,
+	}, logger)
+	streamed := collectStreamedNumbers(t, client)
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn := <-conns
+	defer conn.Close()
+	send := func(message []byte) {
+		t.Helper()
+		err := conn.WriteMessage(websocket.BinaryMessage, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send([]byte{})
+	send([]byte{utils.NumberInSequencePrefix, 0, 0})
+	send([]byte{utils.RetransmittedNumberInSequencePrefix, 0, 0, 0, 0, 1})
+	send([]byte{utils.NumberBatchPrefix, 0, 0, 0, 0})
+
+	codec, _ := utils.CodecForSubprotocol(utils.SubprotocolV2)
+	numbers := []uint32{10, 11}
+	send(codec.EncodeNumber(0, numbers[0]))
+	lastNumber, err := codec.EncodeLastNumber(1, numbers[1], utils.CreateChecksum(numbers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(lastNumber)
+
+	result := client.Result(context.Background())
+	if result.Error != nil || !result.Success || result.Checksum != result.ServerChecksum {
+		t.Fatalf("expected a successful result, received %+v", result)
+	}
+	if !reflect.DeepEqual(*streamed, numbers) {
+		t.Fatalf("expected the numbers in well-formed frames to be streamed, received %v", *streamed)
+	}
+}
+
+func Test_server_sends_numbers_that_do_not_follow_on_with_their_index(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		SendWindowSize:          3,
+	}, logger)
+	defer testServer.Close()
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{utils.SubprotocolV1}
+	dial := func(query string) <-chan []byte {
+		conn, _, err := dialer.Dial(strings.Replace(testServer.URL, "http", "ws", 1)+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return readInBackground(conn)
+	}
+
+	conn, _, err := dialer.Dial(strings.Replace(testServer.URL, "http", "ws", 1)+"?clientId=unindexed&sequenceCount=20", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := readInBackground(conn)
+	expectHandshake(t, messages)
+	received := collectUntilQuiet(messages, 100*time.Millisecond)
+	if len(received) != 3 {
+		t.Fatalf("expected 3 messages before the window was full, received %d", len(received))
+	}
+	writeAck(t, conn, 0)
+	writeAck(t, conn, 1)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	// Without the last received index the server resumes from the first unacknowledged
+	// number, which the client has no way of placing unless it carries its index.
+	received = collectUntilQuiet(dial("?clientId=unindexed&sequenceCount=20"), 100*time.Millisecond)
+	if len(received) == 0 || received[0][0] != utils.RetransmittedNumberInSequencePrefix {
+		t.Fatalf("expected the first number to be sent with its index, received %v", received)
+	}
+	codec, _ := utils.CodecForSubprotocol(utils.SubprotocolV1)
+	index, _, err := codec.DecodeRetransmission(received[0][1:])
+	if err != nil || index != 2 {
+		t.Fatalf("expected the first number to be sent for index 2, received %d (%v)", index, err)
+	}
+
+	// The client knows numbers follow on from the last received index.
+	received = collectUntilQuiet(dial("?clientId=unindexed&sequenceCount=20&lastReceived=1"), 100*time.Millisecond)
+	if len(received) == 0 || received[0][0] != utils.NumberInSequencePrefix {
+		t.Fatalf("expected the first number to be sent without its index, received %v", received)
+	}
+}
+
+// Proxies WebSocket connections to the test server and cuts each connection in turn after
+// the given number of numbers have been passed on to the client. When acknowledgements
+// are lost the last number reaches the client but its acknowledgement never reaches
+// the server, otherwise the last number never reaches the client.
+func createCuttingProxy(testServer *httptest.Server, cutAfter []int, acksLost bool) *httptest.Server {
+	var connections int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection := int(atomic.AddInt32(&connections, 1)) - 1
+		dialer := *websocket.DefaultDialer
+		dialer.Subprotocols = websocket.Subprotocols(r)
+		serverConn, _, err := dialer.Dial(strings.Replace(testServer.URL, "http", "ws", 1)+"?"+r.URL.RawQuery, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer serverConn.Close()
+		proxyUpgrader := websocket.Upgrader{}
+		if serverConn.Subprotocol() != "" {
+			proxyUpgrader.Subprotocols = []string{serverConn.Subprotocol()}
+		}
+		clientConn, err := proxyUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+
+		var cut int32
+		go func() {
+			for {
+				_, message, err := clientConn.ReadMessage()
+				if err != nil {
+					serverConn.Close()
+					return
+				}
+				if atomic.LoadInt32(&cut) == 0 {
+					serverConn.WriteMessage(websocket.BinaryMessage, message)
+				}
+			}
+		}()
+
+		forwarded := 0
+		for {
+			_, message, err := serverConn.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					clientConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeErr.Code, closeErr.Text))
+				}
+				return
+			}
+			isNumber := message[0] == utils.NumberInSequencePrefix ||
+				message[0] == utils.RetransmittedNumberInSequencePrefix
+			if isNumber && connection < len(cutAfter) && forwarded == cutAfter[connection] {
+				atomic.StoreInt32(&cut, 1)
+				if acksLost {
+					clientConn.WriteMessage(websocket.BinaryMessage, message)
+					// Give the client time to receive and acknowledge the number.
+					time.Sleep(20 * time.Millisecond)
+				}
+				serverConn.Close()
+				clientConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "cut"))
+				return
+			}
+			if isNumber {
+				forwarded += 1
+			}
+			clientConn.WriteMessage(websocket.BinaryMessage, message)
+		}
+	}))
+}
+
+func Test_client_takes_over_session_from_existing_connection(t *testing.T) {
+	forTransports(t, []string{client.TransportWebSocket, client.TransportEventStream}, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		testServer := createTestServerWithParams(&ServerParams{SequenceMessageInterval: 2}, logger)
+		defer testServer.Close()
+
+		serverURL, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(serverURL.Port())
+		clientID := "taken-over-" + transport
+		params := &client.ClientParams{
+			ServerHost:           serverURL.Hostname(),
+			ServerPort:           port,
+			Transport:            transport,
+			MaxReconnectAttempts: 100,
+			SequenceCount:        200,
+			OverrideClientID:     &clientID,
+			ResultTimeout:        10,
+		}
+
+		var mu sync.Mutex
+		received := []uint32{}
+		reachedTen := make(chan struct{})
+		firstClient := client.NewDefaultClient(params, logger)
+		firstClient.OnNumber(func(index int, number uint32) {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, number)
+			if index == 10 {
+				close(reachedTen)
+			}
+		})
+		err = firstClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer firstClient.Close()
+		<-reachedTen
+
+		// A new client process resumes the session while the first client is still connected.
+		mu.Lock()
+		resumeParams := *params
+		resumeParams.ReceivedNumbers = append([]uint32{}, received...)
+		mu.Unlock()
+		secondClient := client.NewDefaultClient(&resumeParams, logger)
+		err = secondClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer secondClient.Close()
+
+		firstResult := firstClient.Result(context.Background())
+		if firstResult.Error == nil || !strings.Contains(firstResult.Error.Error(), "CloseCodeSessionTakenOver(4009)") {
+			t.Fatalf("expected the first client to be told its session was taken over, received %v", firstResult.Error)
+		}
+		secondResult := secondClient.Result(context.Background())
+		if secondResult.Error != nil || !secondResult.Success || secondResult.Checksum != secondResult.ServerChecksum {
+			t.Fatalf("expected the client that took over the session to complete it, received %+v", secondResult)
+		}
+	})
+}
+
+func Test_server_rejects_connection_for_session_in_use(t *testing.T) {
+	forTransports(t, []string{client.TransportWebSocket, client.TransportEventStream}, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		testServer := createTestServerWithParams(&ServerParams{
+			SequenceMessageInterval: 2,
+			SessionConflictPolicy:   SessionConflictReject,
+		}, logger)
+		defer testServer.Close()
+
+		serverURL, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(serverURL.Port())
+		clientID := "in-use-" + transport
+		params := &client.ClientParams{
+			ServerHost:           serverURL.Hostname(),
+			ServerPort:           port,
+			Transport:            transport,
+			MaxReconnectAttempts: 100,
+			SequenceCount:        200,
+			OverrideClientID:     &clientID,
+			ResultTimeout:        10,
+		}
+
+		reachedTen := make(chan struct{})
+		firstClient := client.NewDefaultClient(params, logger)
+		firstClient.OnNumber(func(index int, number uint32) {
+			if index == 10 {
+				close(reachedTen)
+			}
+		})
+		err = firstClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer firstClient.Close()
+		<-reachedTen
+
+		secondClient := client.NewDefaultClient(params, logger)
+		err = secondClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer secondClient.Close()
+
+		secondResult := secondClient.Result(context.Background())
+		if secondResult.Error == nil || !strings.Contains(secondResult.Error.Error(), "CloseCodeSessionInUse(4008)") {
+			t.Fatalf("expected the second client to be told the session is in use, received %v", secondResult.Error)
+		}
+		firstResult := firstClient.Result(context.Background())
+		if firstResult.Error != nil || !firstResult.Success || firstResult.Checksum != firstResult.ServerChecksum {
+			t.Fatalf("expected the first client to complete the sequence, received %+v", firstResult)
+		}
+	})
+}
+
+func Test_session_conflicts_apply_between_long_polls_and_connections(t *testing.T) {
+	for _, policy := range []SessionConflictPolicy{SessionConflictReject, SessionConflictTakeOver} {
+		t.Run(string(policy), func(t *testing.T) {
+			logger := createLogger()
+
+			store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+			server := NewDefaultServer(&ServerParams{
+				SequenceMessageInterval: 20,
+				PollTimeout:             2000,
+				PollBatchSize:           1000,
+				SessionConflictPolicy:   policy,
+			}, store, logger)
+			testServer := httptest.NewServer(server)
+			defer testServer.Close()
+
+			// The poll will be held until the poll timeout as the batch can not fill up before then.
+			query := "?clientId=poll-conflict-" + string(policy) + "&sequenceCount=1000"
+			pollDone := make(chan *http.Response, 1)
+			go func() {
+				resp, err := http.Get(testServer.URL + LongPollPath + query)
+				if err != nil {
+					t.Error(err)
+				}
+				pollDone <- resp
+			}()
+			waitForLiveConnections(t, server.(*serverImpl), 1)
+
+			conn := dialTestServer(t, testServer, query)
+			defer conn.Close()
+
+			if policy == SessionConflictReject {
+				expectCloseCode(t, conn, utils.CloseCodeSessionInUse)
+				resp := <-pollDone
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("expected the poll in flight to be served, received status %d", resp.StatusCode)
+				}
+
+				// Polls are rejected in the same way while a connection is live.
+				conn = dialTestServer(t, testServer, query)
+				defer conn.Close()
+				waitForLiveConnections(t, server.(*serverImpl), 1)
+				pollErr := &utils.PollError{}
+				getPollInto(t, testServer, query, http.StatusConflict, pollErr)
+				if pollErr.Code != utils.CloseCodeSessionInUse {
+					t.Fatalf("expected code %d, received %d", utils.CloseCodeSessionInUse, pollErr.Code)
+				}
+				return
+			}
+
+			resp := <-pollDone
+			defer resp.Body.Close()
+			pollErr := &utils.PollError{}
+			err := json.NewDecoder(resp.Body).Decode(pollErr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusConflict || pollErr.Code != utils.CloseCodeSessionTakenOver {
+				t.Fatalf(
+					"expected the poll in flight to be taken over, received status %d with code %d",
+					resp.StatusCode,
+					pollErr.Code,
+				)
+			}
+			select {
+			case _, ok := <-readInBackground(conn):
+				if !ok {
+					t.Fatal("expected the connection that took over the session to be served")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for the connection that took over the session to be served")
+			}
+		})
+	}
+}
+
+var testTokenKeys = []TokenKey{
+	{ID: "current", Secret: []byte("current-secret-for-tests")},
+	{ID: "previous", Secret: []byte("previous-secret-for-tests")},
+}
+
+func Test_server_requires_token_to_resume_session(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		ClientTokenKeys:         testTokenKeys,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=tokens&sequenceCount=100")
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if message[0] != utils.SequenceHandshakePrefix {
+		t.Fatalf("expected a handshake, received message with prefix %d", message[0])
+	}
+	handshake := &utils.SequenceHandshakeMessage{}
+	err = json.Unmarshal(message[1:], handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(handshake.Token, "current.") {
+		t.Fatalf("expected a token signed with the current key, received %q", handshake.Token)
+	}
+	nonce := tokenNonce(t, handshake.Token)
+
+	rejected := map[string]string{
+		"missing":             "",
+		"for another client":  signToken(testTokenKeys[0], "someone-else", nonce),
+		"for another session": signToken(testTokenKeys[0], "tokens", "another-nonce"),
+		"with an unknown key": signToken(TokenKey{ID: "unknown", Secret: testTokenKeys[0].Secret}, "tokens", nonce),
+		"tampered":            handshake.Token + "a",
+	}
+	for name, token := range rejected {
+		t.Run(name, func(t *testing.T) {
+			conn := dialTestServer(t, testServer, "?clientId=tokens&sequenceCount=100&token="+token)
+			defer conn.Close()
+			expectCloseCode(t, conn, utils.CloseCodeUnauthorized)
+		})
+	}
+
+	// Tokens signed before the keys were rotated are accepted until the previous key is removed.
+	for _, token := range []string{handshake.Token, signToken(testTokenKeys[1], "tokens", nonce)} {
+		conn := dialTestServer(t, testServer, "?clientId=tokens&sequenceCount=100&token="+token)
+		_, message, err := conn.ReadMessage()
+		conn.Close()
+		if err != nil {
+			t.Fatalf("expected the session to resume with token %q, received %v", token, err)
+		}
+		if message[0] != utils.NumberInSequencePrefix {
+			t.Fatalf("expected a number, received message with prefix %d", message[0])
+		}
+	}
+}
+
+func Test_event_stream_messages_require_token(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		ClientTokenKeys:         testTokenKeys,
+	}, logger)
+	defer testServer.Close()
+
+	conn := dialTestServer(t, testServer, "?clientId=sse-tokens&sequenceCount=100")
+	token := readHandshake(t, readInBackground(conn)).Token
+	conn.Close()
+	nonce := tokenNonce(t, token)
+
+	postEventStreamMessage(t, testServer, "sse-tokens", utils.AcknowledgementPrefix, 0, http.StatusUnauthorized)
+	postEventStreamMessage(
+		t, testServer, "sse-tokens&token="+signToken(testTokenKeys[0], "another-client", nonce),
+		utils.AcknowledgementPrefix, 0, http.StatusUnauthorized,
+	)
+	postEventStreamMessage(
+		t, testServer, "sse-tokens&token="+token,
+		utils.AcknowledgementPrefix, 0, http.StatusNoContent,
+	)
+}
+
+func Test_server_issues_tokens_for_client_ids_without_a_session(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	testServer := httptest.NewServer(NewDefaultServer(&ServerParams{ClientTokenKeys: testTokenKeys}, store, logger))
+	defer testServer.Close()
+
+	token := postForToken(t, testServer, "issued", http.StatusOK)
+	if token != signToken(testTokenKeys[0], "issued", tokenNonce(t, token)) {
+		t.Fatalf("expected a token signed with the current key, received %q", token)
+	}
+	if postForToken(t, testServer, "issued", http.StatusOK) == token {
+		t.Fatal("expected each token to be signed with a new nonce")
+	}
+
+	// The session is created with the nonce of the token the client connects with.
+	conn := dialTestServer(t, testServer, "?clientId=issued&sequenceCount=10&token="+token)
+	handshake := readHandshake(t, readInBackground(conn))
+	conn.Close()
+	if handshake.Token != token {
+		t.Fatalf("expected the session to be created for the requested token %q, received %q", token, handshake.Token)
+	}
+	postForToken(t, testServer, "issued", http.StatusConflict)
+	postForToken(t, testServer, "", http.StatusBadRequest)
+
+	// Sessions can not be created with a token the server did not issue.
+	conn = dialTestServer(t, testServer, "?clientId=forged&sequenceCount=10&token=current.nonce.signature")
+	defer conn.Close()
+	expectCloseCode(t, conn, utils.CloseCodeUnauthorized)
+
+	err := store.Expire("issued")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postForToken(t, testServer, "issued", http.StatusGone)
+
+	withoutTokens := createTestServerWithParams(&ServerParams{}, logger)
+	defer withoutTokens.Close()
+	postForToken(t, withoutTokens, "issued", http.StatusNotFound)
+}
+
+func Test_client_resumes_session_with_token(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+
+		server := createTestServerWithParams(&ServerParams{
+			SequenceMessageInterval: 1,
+			ClientTokenKeys:         testTokenKeys,
+		}, logger)
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, _ := strconv.Atoi(serverURL.Port())
+		clientID := "token-" + transport
+		params := &client.ClientParams{
+			ServerHost:           serverURL.Hostname(),
+			ServerPort:           port,
+			Transport:            transport,
+			MaxReconnectAttempts: 100,
+			SequenceCount:        100,
+			OverrideClientID:     &clientID,
+			ResultTimeout:        10,
+		}
+		token, err := client.RequestToken(params, clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.Token = token
+
+		var mu sync.Mutex
+		persisted := []uint32{}
+		exited := make(chan struct{})
+		firstClient := client.NewDefaultClient(params, logger)
+		firstClient.OnNumber(func(index int, number uint32) {
+			mu.Lock()
+			defer mu.Unlock()
+			if index < 20 {
+				persisted = append(persisted, number)
+			}
+			if index == 30 {
+				close(exited)
+			}
+		})
+		err = firstClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-exited
+		firstClient.Close()
+		// Allow the server to persist acknowledgements that were in flight.
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		resumeParams := *params
+		resumeParams.ReceivedNumbers = persisted
+		resumeParams.Token = ""
+		mu.Unlock()
+
+		withoutToken := client.NewDefaultClient(&resumeParams, logger)
+		err = withoutToken.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer withoutToken.Close()
+		rejected := withoutToken.Result(context.Background())
+		if rejected.Error == nil || !strings.Contains(rejected.Error.Error(), "CloseCodeUnauthorized(4010)") {
+			t.Fatalf("expected a client without a token to be rejected, received %v", rejected.Error)
+		}
+
+		resumeParams.Token = token
+		secondClient := client.NewDefaultClient(&resumeParams, logger)
+		err = secondClient.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer secondClient.Close()
+		result := secondClient.Result(context.Background())
+		if result.Error != nil || !result.Success || result.Checksum != result.ServerChecksum {
+			t.Fatalf("expected the resumed sequence to complete, received %+v", result)
+		}
+	})
+}
+
+func Test_token_requested_before_the_session_existed_is_rejected(t *testing.T) {
+	logger := createLogger()
+
+	testServer := createTestServerWithParams(&ServerParams{
+		SequenceMessageInterval: 1,
+		ClientTokenKeys:         testTokenKeys,
+	}, logger)
+	defer testServer.Close()
+
+	// Anyone who knows the client ID can request a token before the owner connects.
+	requested := postForToken(t, testServer, "prefetched", http.StatusOK)
+
+	conn := dialTestServer(t, testServer, "?clientId=prefetched&sequenceCount=100")
+	handshake := readHandshake(t, readInBackground(conn))
+	conn.Close()
+	if handshake.Token == requested {
+		t.Fatal("expected the session to be issued its own token")
+	}
+
+	conn = dialTestServer(t, testServer, "?clientId=prefetched&sequenceCount=100&token="+requested)
+	defer conn.Close()
+	expectCloseCode(t, conn, utils.CloseCodeUnauthorized)
+	pollErr := &utils.PollError{}
+	getPollInto(t, testServer, "?clientId=prefetched&after=0&token="+requested, http.StatusUnauthorized, pollErr)
+
+	conn = dialTestServer(t, testServer, "?clientId=prefetched&sequenceCount=100&token="+handshake.Token)
+	defer conn.Close()
+	message, ok := <-readInBackground(conn)
+	if !ok || message[0] != utils.NumberInSequencePrefix {
+		t.Fatal("expected the session to resume with the token issued in the handshake")
+	}
+}
+
+func readHandshake(t *testing.T, messages <-chan []byte) *utils.SequenceHandshakeMessage {
+	t.Helper()
+	select {
+	case message := <-messages:
+		if message[0] != utils.SequenceHandshakePrefix {
+			t.Fatalf("expected a handshake, received message with prefix %d", message[0])
+		}
+		handshake := &utils.SequenceHandshakeMessage{}
+		err := json.Unmarshal(message[1:], handshake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handshake
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the handshake")
+	}
+	return nil
+}
+
+func tokenNonce(t *testing.T, token string) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a token made up of a key ID, nonce and signature, received %q", token)
+	}
+	return parts[1]
+}
+
+func postForToken(t *testing.T, testServer *httptest.Server, clientID string, expectedStatus int) string {
+	t.Helper()
+
+	resp, err := http.Post(testServer.URL+TokenPath+"?clientId="+clientID, "application/json", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("expected status %d for token request, received %d", expectedStatus, resp.StatusCode)
+	}
+	if expectedStatus != http.StatusOK {
+		return ""
+	}
+	tokenResponse := &utils.TokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(tokenResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenResponse.Token
+}
+
+func expectCloseCode(t *testing.T, conn *websocket.Conn, expectedCode int) {
+	t.Helper()
+
+	var closeErr *websocket.CloseError
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.As(err, &closeErr) || closeErr.Code != expectedCode {
+				t.Fatalf("expected close code %d, received %v", expectedCode, err)
+			}
+			return
+		}
+	}
+}
+
+func Benchmark_delivery_of_individual_numbers(b *testing.B) {
+	benchmarkDelivery(b, 0)
+}
+
+func Benchmark_delivery_of_batched_numbers(b *testing.B) {
+	benchmarkDelivery(b, 1000)
+}
+
+// Delivers a sequence of the maximum number value in length without any
+// interval between numbers so the cost of framing and acknowledgements dominates.
+func benchmarkDelivery(b *testing.B, batchSize int) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.ErrorLevel)
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	testServer := httptest.NewServer(NewDefaultServer(&ServerParams{
+		SendWindowSize:    4096,
+		RetransmitTimeout: 5000,
+		MaxBatchSize:      1000,
+	}, store, logger))
+	defer testServer.Close()
+
+	serverURL, err := url.Parse(testServer.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := client.NewDefaultClient(&client.ClientParams{
+			ServerHost:           serverURL.Hostname(),
+			ServerPort:           port,
+			MaxReconnectAttempts: 5,
+			SequenceCount:        int(MaxSequenceNumberValue),
+			BatchSize:            batchSize,
+			BatchInterval:        10,
+		}, logger)
+		err = client.Connect()
+		if err != nil {
+			b.Fatal(err)
+		}
+		result := client.Result(context.Background())
+		if result.Error != nil || !result.Success {
+			b.Fatalf("expected the sequence to complete, received error %v", result.Error)
+		}
+		client.Close()
+	}
+}
+
+func Test_session_store_errors_map_to_close_codes(t *testing.T) {
+	// Third-party stores may wrap the sentinel errors with their own context.
+	err := fmt.Errorf("redis lookup: %w", sessions.NewSessionError("client-1", sessions.ErrSessionExpired))
+	code, _ := closeCodeForError(err)
+	if code != utils.CloseCodeExpiredSession {
+		t.Errorf("expected close code %d, received %d", utils.CloseCodeExpiredSession, code)
+	}
+
+	code, _ = closeCodeForError(errors.New("connection refused"))
+	if code != websocket.CloseInternalServerErr {
+		t.Errorf("expected close code %d, received %d", websocket.CloseInternalServerErr, code)
+	}
+}
+
+func Test_clients_resume_against_new_server_instance_after_graceful_shutdown(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, transport string) {
+		logger := createLogger()
+		storePath := filepath.Join(t.TempDir(), "sessions.wal")
+
+		firstStore, err := sessions.NewFileStore(
+			&sessions.FileStoreParams{ExpireAfterIdleTime: 30, Path: storePath},
+			logger,
+		)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		firstServer := NewDefaultServer(&ServerParams{SequenceMessageInterval: 5}, firstStore, logger)
+		firstTestServer := httptest.NewServer(firstServer)
+
+		serverURL, err := url.Parse(firstTestServer.URL)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		host := serverURL.Hostname()
+		port, _ := strconv.Atoi(serverURL.Port())
+
+		clientParams := &client.ClientParams{
+			ServerHost: host,
+			ServerPort: port,
+			Transport:  transport,
+			// Rely on acknowledgements drained during shutdown
+			// to determine where to resume from.
+			SendLastReceivedIndex: false,
+			MaxReconnectAttempts:  100,
+			SequenceCount:         200,
+		}
+		client := client.NewDefaultClient(clientParams, logger)
+		streamed := collectStreamedNumbers(t, client)
+		err = client.Connect()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		// Let part of the sequence be delivered before shutting down.
+		time.Sleep(300 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = firstServer.Shutdown(ctx)
+		if err != nil {
+			t.Error("expected connections to drain within the grace period: ", err)
+			t.FailNow()
+		}
+		firstTestServer.Close()
+		firstStore.Close()
+
+		secondStore, err := sessions.NewFileStore(
+			&sessions.FileStoreParams{ExpireAfterIdleTime: 30, Path: storePath},
+			logger,
+		)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer secondStore.Close()
+		secondServer := NewDefaultServer(&ServerParams{SequenceMessageInterval: 5}, secondStore, logger)
+		secondTestServer := httptest.NewUnstartedServer(secondServer)
+		// Serve the new instance from the same address so the client can reconnect.
+		secondTestServer.Listener.Close()
+		secondTestServer.Listener, err = net.Listen("tcp", serverURL.Host)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		secondTestServer.Start()
+		defer secondTestServer.Close()
+
+		result := client.Result(context.Background())
+		if result.Error != nil {
+			t.Error("result contained error: ", result.Error)
+			t.FailNow()
+		}
+
+		if !result.Success {
+			t.Error("did not succeed, result.Success was false")
+			t.FailNow()
+		}
+
+		if result.Checksum != result.ServerChecksum {
+			t.Error("expected checksums from client and server to match")
+		}
+
+		if utils.CreateChecksum(*streamed) != result.ServerChecksum {
+			t.Error("expected checksum of numbers streamed across the reconnection to match the one from the server")
+		}
+	})
+}
+
+// Runs an end-to-end test against every transport the client supports.
+func Test_shutdown_writes_close_messages_without_holding_the_server_lock(t *testing.T) {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	server := NewDefaultServer(&ServerParams{}, store, logger).(*serverImpl)
+	conn := &blockingCloseConn{writingClose: make(chan struct{}), release: make(chan struct{})}
+	_, _, trackErr := server.track(conn, "slow-client", func() {})
+	if trackErr != nil {
+		t.Fatal(trackErr.reason)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-conn.writingClose:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the close message to be written")
+	}
+	// A client that is slow to take the close message must not
+	// hold up anything else that needs the server lock.
+	counted := make(chan int, 1)
+	go func() {
+		counted <- server.liveConnections()
+	}()
+	select {
+	case live := <-counted:
+		if live != 1 {
+			t.Fatalf("expected 1 live connection, received %d", live)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the server lock was held while writing the close message")
+	}
+
+	close(conn.release)
+	server.untrack(conn)
+	err := <-shutdownErr
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A connection that blocks writing a close message until released.
+type blockingCloseConn struct {
+	writingClose chan struct{}
+	release      chan struct{}
+}
+
+func (c *blockingCloseConn) WriteMessage(message []byte) error {
+	return nil
+}
+
+func (c *blockingCloseConn) ReadMessage() ([]byte, error) {
+	<-c.release
+	return nil, io.EOF
+}
+
+func (c *blockingCloseConn) WriteClose(code int, reason string) error {
+	close(c.writingClose)
+	<-c.release
+	return nil
+}
+
+func (c *blockingCloseConn) Close() error {
+	return nil
+}
+
+func (c *blockingCloseConn) StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams) {}
+
+func (c *blockingCloseConn) ExtendReadDeadline(params *utils.HeartbeatParams) {}
+
+func writeFlowControl(t *testing.T, conn *websocket.Conn, message []byte) {
+	t.Helper()
+	err := conn.WriteMessage(websocket.BinaryMessage, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Skips numbers in flight until the flow settings confirmed by the server arrive.
+func expectFlowSettings(t *testing.T, messages <-chan []byte, expected utils.FlowSettingsMessage) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				t.Fatalf("connection closed while waiting for flow settings %+v", expected)
+			}
+			if message[0] != utils.FlowSettingsPrefix {
+				continue
+			}
+			settings := utils.FlowSettingsMessage{}
+			err := json.Unmarshal(message[1:], &settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if settings != expected {
+				t.Fatalf("expected flow settings %+v, received %+v", expected, settings)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("timed out waiting for flow settings %+v", expected)
+		}
+	}
+}
+
+func forEachTransport(t *testing.T, test func(t *testing.T, transport string)) {
+	forTransports(t, []string{
+		client.TransportWebSocket,
+		client.TransportEventStream,
+		client.TransportLongPoll,
+	}, test)
+}
+
+func forTransports(t *testing.T, transports []string, test func(t *testing.T, transport string)) {
+	for _, transport := range transports {
+		t.Run(transport, func(t *testing.T) {
+			test(t, transport)
+		})
+	}
+}
+
+// Registers a number handler on the client that fails the test if numbers
+// are not delivered in order exactly once.
+func collectStreamedNumbers(t *testing.T, client client.Client) *[]uint32 {
+	streamed := []uint32{}
+	client.OnNumber(func(index int, number uint32) {
+		if index != len(streamed) {
+			t.Errorf("expected number for index %d, received index %d", len(streamed), index)
+		}
+		streamed = append(streamed, number)
+	})
+	return &streamed
+}
+
+func createTestServer() *httptest.Server {
+	logger := createLogger()
+
+	storeParams := &sessions.InMemoryStoreParams{
+		ExpireAfterIdleTime: 30,
+	}
+	store := sessions.NewInMemoryStore(storeParams, logger)
+	return createTestServerWithStore(store)
+}
+
+func createTLSTestServer() *httptest.Server {
+	logger := createLogger()
+
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	serverParams := &ServerParams{
+		SequenceMessageInterval: 5,
+	}
+	return httptest.NewTLSServer(NewDefaultServer(serverParams, store, logger))
+}
+
+func createTestServerWithParams(params *ServerParams, logger *logrus.Logger) *httptest.Server {
+	store := sessions.NewInMemoryStore(&sessions.InMemoryStoreParams{ExpireAfterIdleTime: 30}, logger)
+	return httptest.NewServer(NewDefaultServer(params, store, logger))
+}
+
+func createTestServerWithStore(store sessions.SessionStore) *httptest.Server {
+	logger := createLogger()
+
 	serverParams := &ServerParams{
 		// 5 milliseconds interval to send each number
 		// in the sequence to speed up tests.
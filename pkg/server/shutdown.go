@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+const goingAwayReason = "server shutting down, reconnect later"
+
+func (s *serverImpl) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	draining := s.trackedConnections()
+	s.mu.Unlock()
+
+	// Close frames are written without the server lock held as a slow client
+	// would otherwise hold up every other connection, new connections
+	// are turned away by track from here on.
+	for _, tracked := range draining {
+		// Stop sending numbers but keep reading from the connection so
+		// acknowledgements for numbers already in flight are persisted
+		// before the client completes the closing handshake.
+		tracked.live.stopSequence()
+		s.writeCloseMessage(tracked.conn, websocket.CloseGoingAway, goingAwayReason)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		remaining := s.trackedConnections()
+		s.mu.Unlock()
+
+		s.logger.Warn("grace period elapsed, closing ", len(remaining), " remaining connections")
+		for _, tracked := range remaining {
+			tracked.conn.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+type trackedConnection struct {
+	conn clientConn
+	live *liveConnection
+}
+
+// Must be called with the server lock held.
+func (s *serverImpl) trackedConnections() []trackedConnection {
+	tracked := make([]trackedConnection, 0, len(s.conns))
+	for conn, live := range s.conns {
+		tracked = append(tracked, trackedConnection{conn: conn, live: live})
+	}
+	return tracked
+}
+
+// Registers a live connection, returns an error to close the connection with if the
+// server is shutting down or the session is in use and the connection should not be served.
+// A connection taken over by the new connection is returned so the caller can wait
+// for it to stop delivering the sequence.
+func (s *serverImpl) track(
+	conn clientConn,
+	clientID string,
+	stopSequence context.CancelFunc,
+) (*liveConnection, *liveConnection, *sessionSetupError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return nil, nil, &sessionSetupError{code: websocket.CloseGoingAway, reason: goingAwayReason}
+	}
+
+	var evicted *liveConnection
+	if existing, inUse := s.clientConns[clientID]; inUse && clientID != "" {
+		if s.params.SessionConflictPolicy == SessionConflictReject {
+			return nil, nil, &sessionSetupError{
+				code:   utils.CloseCodeSessionInUse,
+				reason: "session is in use by another connection",
+			}
+		}
+		evicted = s.conns[existing]
+		s.evict(existing, evicted)
+	}
+
+	live := &liveConnection{
+		clientID:     clientID,
+		stopSequence: stopSequence,
+		sequenceDone: make(chan struct{}),
+	}
+	s.conns[conn] = live
+	if clientID != "" {
+		s.clientConns[clientID] = conn
+	}
+	s.handlers.Add(1)
+	s.metrics.activeConnections.Inc()
+	return live, evicted, nil
+}
+
+func (s *serverImpl) untrack(conn clientConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	live := s.conns[conn]
+	if s.clientConns[live.clientID] == conn {
+		delete(s.clientConns, live.clientID)
+	}
+	delete(s.conns, conn)
+	s.handlers.Done()
+	s.metrics.activeConnections.Dec()
+}
+
+func (s *serverImpl) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shuttingDown
+}
+
+func (s *serverImpl) liveConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
+
+// The number of distinct clients with at least one live connection.
+func (s *serverImpl) connectedClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientIDs := map[string]struct{}{}
+	for _, live := range s.conns {
+		if live.clientID != "" {
+			clientIDs[live.clientID] = struct{}{}
+		}
+	}
+	return len(clientIDs)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+// How long a client has to send its handshake frame once connected.
+// This could be made configurable.
+const tcpHandshakeTimeout = 5 * time.Second
+
+// Accepts connections from the listener until it is closed, clients identify
+// the session to create or resume with a handshake frame in place of query string parameters.
+func (s *serverImpl) ServeTCP(listener net.Listener) error {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveTCPConn(netConn)
+	}
+}
+
+func (s *serverImpl) serveTCPConn(netConn net.Conn) {
+	conn := &tcpConn{TCPConn: utils.NewTCPConn(netConn)}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout))
+	message, err := conn.ReadMessage()
+	if err != nil {
+		s.logger.Error("tcp handshake read error: ", err)
+		return
+	}
+	handshake, err := utils.DecodeTCPHandshake(message)
+	if err != nil {
+		s.logger.Error("tcp handshake error: ", err)
+		s.writeCloseMessage(conn, websocket.CloseProtocolError, "expected a handshake frame")
+		return
+	}
+	// Heartbeats set their own read deadline once started.
+	conn.SetReadDeadline(time.Time{})
+
+	// Connections over TCP have no means of negotiating a protocol
+	// version so always use the second version.
+	codec, _ := utils.CodecForSubprotocol(utils.SubprotocolV2)
+	query, lastReceived := handshake.Query()
+	s.serveConnection(conn, codec, query, lastReceived)
+}
+
+type tcpConn struct {
+	*utils.TCPConn
+}
+
+// The client closes the connection once it has read the error frame,
+// which completes the closing handshake.
+func (c *tcpConn) WriteClose(code int, reason string) error {
+	return c.WriteMessage(utils.EncodeTCPError(code, reason))
+}
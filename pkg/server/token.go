@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sessions"
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+)
+
+// TokenKey signs and verifies the tokens that authenticate clients as the owners
+// of their sessions. Tokens name the key they were signed with so keys can be
+// rotated without invalidating tokens signed with previous keys.
+type TokenKey struct {
+	ID     string
+	Secret []byte
+}
+
+const unauthorizedReason = "missing or invalid client token"
+
+func (s *serverImpl) tokensRequired() bool {
+	return len(s.params.ClientTokenKeys) > 0
+}
+
+// The number of random bytes in the nonce signed into the tokens for a session.
+const tokenNonceSize = 16
+
+// New tokens are always signed with the first key.
+func (s *serverImpl) issueToken(clientID string, nonce string) string {
+	return signToken(s.params.ClientTokenKeys[0], clientID, nonce)
+}
+
+// Reports whether the token was signed for the client and nonce with any of the keys,
+// every token is valid when tokens are not required.
+func (s *serverImpl) verifyToken(clientID string, nonce string, token string) bool {
+	if !s.tokensRequired() {
+		return true
+	}
+
+	keyID, _, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	for _, key := range s.params.ClientTokenKeys {
+		if key.ID == keyID {
+			return hmac.Equal([]byte(token), []byte(signToken(key, clientID, nonce)))
+		}
+	}
+	return false
+}
+
+// Reports whether the token was issued for the client's existing session, tokens
+// for client IDs without a live session are never valid.
+// The session is looked up without affecting its expiry so requests with an
+// invalid token do not keep the session alive.
+func (s *serverImpl) verifySessionToken(clientID string, token string) bool {
+	if !s.tokensRequired() {
+		return true
+	}
+
+	summary, err := s.store.Summary(clientID)
+	if err != nil || summary.Expired {
+		return false
+	}
+	return s.verifyToken(clientID, summary.TokenNonce, token)
+}
+
+// Determines the nonce to create a new session with, a client that requested its
+// token before connecting creates the session with the nonce from that token so the
+// token is valid for the session, otherwise a new nonce is generated.
+// The returned bool is false when the client provided a token that was not issued for it.
+func (s *serverImpl) nonceForNewSession(clientID string, token string) (string, bool, error) {
+	if !s.tokensRequired() {
+		return "", true, nil
+	}
+	if token == "" {
+		nonce, err := newTokenNonce()
+		return nonce, true, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !s.verifyToken(clientID, parts[1], token) {
+		return "", false, nil
+	}
+	return parts[1], true, nil
+}
+
+func newTokenNonce() (string, error) {
+	nonceBytes := make([]byte, tokenNonceSize)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(nonceBytes), nil
+}
+
+// Tokens are the ID of the key followed by the nonce of the session and the
+// HMAC-SHA256 of the client ID and the nonce. The nonce is generated by the server
+// for each session so a token can not be obtained for a session created by another client.
+func signToken(key TokenKey, clientID string, nonce string) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(clientID + "." + nonce))
+	return key.ID + "." + nonce + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issues a token for a client ID that does not yet have a session so the client can
+// hold on to the token before it connects, the token is only valid for the session if
+// the client provides it on the connection that creates the session.
+// Tokens for existing sessions are only issued to the connection that creates the session.
+func (s *serverImpl) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.tokensRequired() {
+		http.Error(w, "client tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	clientID := r.URL.Query().Get("clientId")
+	if clientID == "" {
+		http.Error(w, "missing client id", http.StatusBadRequest)
+		return
+	}
+	summary, err := s.store.Summary(clientID)
+	if err == nil && summary.Expired {
+		// Expired client IDs can not be used for a new session.
+		code, reason := closeCodeForError(sessions.NewSessionError(clientID, sessions.ErrSessionExpired))
+		writePollError(w, code, reason)
+		return
+	}
+	if err == nil {
+		http.Error(w, "a session already exists for the client id", http.StatusConflict)
+		return
+	}
+	nonce, err := newTokenNonce()
+	if err != nil {
+		s.logger.Error("failed to generate token nonce: ", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&utils.TokenResponse{Token: s.issueToken(clientID, nonce)})
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+// A connection to a client over one of the transports the server supports,
+// messages are exchanged in the format of the codec negotiated for the connection.
+type clientConn interface {
+	WriteMessage(message []byte) error
+	// Blocks until the next message from the client is received,
+	// returns an error once the connection has been closed.
+	ReadMessage() ([]byte, error)
+	// Tells the client why the connection is being closed,
+	// this is safe to call concurrently with WriteMessage.
+	WriteClose(code int, reason string) error
+	Close() error
+	// Keeps the connection alive and detects a silent client
+	// until the context is done.
+	StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams)
+	// Called for every message read from the client.
+	ExtendReadDeadline(params *utils.HeartbeatParams)
+}
+
+type webSocketConn struct {
+	conn *websocket.Conn
+}
+
+func (c *webSocketConn) WriteMessage(message []byte) error {
+	return c.conn.WriteMessage(websocket.BinaryMessage, message)
+}
+
+func (c *webSocketConn) ReadMessage() ([]byte, error) {
+	_, message, err := c.conn.ReadMessage()
+	return message, err
+}
+
+func (c *webSocketConn) WriteClose(code int, reason string) error {
+	return c.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		// This deadline could be made configurable.
+		time.Now().Add(1*time.Second),
+	)
+}
+
+func (c *webSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *webSocketConn) StartHeartbeat(ctx context.Context, params *utils.HeartbeatParams) {
+	utils.StartHeartbeat(ctx, c.conn, params)
+}
+
+func (c *webSocketConn) ExtendReadDeadline(params *utils.HeartbeatParams) {
+	utils.ExtendReadDeadline(c.conn, params)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A sliding window of numbers that have been sent to a client over a single
+// connection but have not yet been acknowledged.
+type sendWindow struct {
+	mu sync.Mutex
+	// The maximum number of unacknowledged numbers in flight,
+	// the window is unbounded and nothing is retransmitted when this is 0.
+	// Numbers in flight are tracked regardless to measure acknowledgement latency,
+	// up to unboundedWindowTrackingLimit when the window is unbounded.
+	size              int
+	retransmitTimeout time.Duration
+	inFlight          map[int]*inFlightMessage
+	// Signalled whenever an acknowledgement frees up space in the window.
+	acked chan struct{}
+}
+
+type inFlightMessage struct {
+	index  int
+	number uint32
+	// When the number was last sent, reset on each retransmission.
+	sentAt time.Time
+	// When the number was first sent over the connection.
+	firstSentAt time.Time
+}
+
+// Without retransmission numbers whose acknowledgements are lost are never removed
+// from an unbounded window, so only this many are tracked to measure latency.
+const unboundedWindowTrackingLimit = 1024
+
+func newSendWindow(size int, retransmitTimeout time.Duration) *sendWindow {
+	return &sendWindow{
+		size:              size,
+		retransmitTimeout: retransmitTimeout,
+		inFlight:          map[int]*inFlightMessage{},
+		acked:             make(chan struct{}, 1),
+	}
+}
+
+func (w *sendWindow) enabled() bool {
+	return w.size > 0
+}
+
+func (w *sendWindow) add(index int, number uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.enabled() && len(w.inFlight) >= unboundedWindowTrackingLimit {
+		return
+	}
+	now := time.Now()
+	w.inFlight[index] = &inFlightMessage{
+		index:       index,
+		number:      number,
+		sentAt:      now,
+		firstSentAt: now,
+	}
+}
+
+// Removes an acknowledged number from the window, returns the time
+// elapsed since the number was first sent and whether it was in flight.
+func (w *sendWindow) ack(index int) (time.Duration, bool) {
+	w.mu.Lock()
+	message, exists := w.inFlight[index]
+	delete(w.inFlight, index)
+	w.mu.Unlock()
+
+	if !exists {
+		return 0, false
+	}
+
+	select {
+	case w.acked <- struct{}{}:
+	default:
+	}
+	return time.Since(message.firstSentAt), true
+}
+
+// An acknowledged number along with the time elapsed since it was first sent.
+type ackedMessage struct {
+	index   int
+	latency time.Duration
+}
+
+// Removes every number up to and including the index from the window,
+// returns the numbers that were in flight in order.
+func (w *sendWindow) ackThrough(index int) []ackedMessage {
+	return w.ackRange(0, index+1)
+}
+
+// Removes every number from start (inclusive) to end (exclusive) from the window,
+// returns the numbers that were in flight in order.
+func (w *sendWindow) ackRange(start int, end int) []ackedMessage {
+	w.mu.Lock()
+	acked := []ackedMessage{}
+	for inFlightIndex, message := range w.inFlight {
+		if inFlightIndex >= start && inFlightIndex < end {
+			acked = append(acked, ackedMessage{index: inFlightIndex, latency: time.Since(message.firstSentAt)})
+			delete(w.inFlight, inFlightIndex)
+		}
+	}
+	w.mu.Unlock()
+
+	if len(acked) == 0 {
+		return acked
+	}
+	sort.Slice(acked, func(i, j int) bool {
+		return acked[i].index < acked[j].index
+	})
+	select {
+	case w.acked <- struct{}{}:
+	default:
+	}
+	return acked
+}
+
+// Numbers are sent in order so any number still in flight before one the client
+// has received was lost, these are made due for retransmission straight away
+// instead of waiting for the retransmit timeout.
+func (w *sendWindow) markLostBefore(index int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for inFlightIndex, message := range w.inFlight {
+		if inFlightIndex < index {
+			message.sentAt = time.Time{}
+		}
+	}
+}
+
+// Whether the window would be full with the given number of
+// numbers that are waiting to be sent.
+func (w *sendWindow) fullWith(pending int) bool {
+	if !w.enabled() {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.inFlight)+pending >= w.size
+}
+
+func (w *sendWindow) empty() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.inFlight) == 0
+}
+
+// Collects the messages that have not been acknowledged within the retransmit
+// timeout, resetting their timers as the caller is expected to resend them.
+func (w *sendWindow) dueForRetransmission() []*inFlightMessage {
+	if !w.enabled() || w.retransmitTimeout <= 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	due := []*inFlightMessage{}
+	for _, message := range w.inFlight {
+		if now.Sub(message.sentAt) >= w.retransmitTimeout {
+			message.sentAt = now
+			due = append(due, message)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].index < due[j].index
+	})
+	return due
+}
+
+// How often to check for messages that are due for retransmission.
+func (w *sendWindow) checkInterval() time.Duration {
+	if !w.enabled() || w.retransmitTimeout <= 0 {
+		// Retransmission is disabled so there is never anything to check for.
+		return time.Hour
+	}
+
+	interval := w.retransmitTimeout / 4
+	if interval < time.Millisecond {
+		return time.Millisecond
+	}
+	return interval
+}
@@ -0,0 +1,129 @@
+package sessions
+
+import "sort"
+
+// A set of acknowledged indexes stored as sorted, non-overlapping ranges.
+// Clients acknowledge numbers roughly in order so a session's acknowledgements
+// typically collapse into a single range regardless of the sequence length.
+type ackRanges struct {
+	ranges []ackRange
+	count  int
+}
+
+// A range of acknowledged indexes from start (inclusive) to end (exclusive).
+type ackRange struct {
+	start int
+	end   int
+}
+
+// Adds an index to the set, returns false if it was already present.
+func (a *ackRanges) add(index int) bool {
+	// The position of the first range that starts after the index.
+	pos := sort.Search(len(a.ranges), func(i int) bool {
+		return a.ranges[i].start > index
+	})
+	if pos > 0 && a.ranges[pos-1].end > index {
+		return false
+	}
+
+	extendsPrevious := pos > 0 && a.ranges[pos-1].end == index
+	extendsNext := pos < len(a.ranges) && a.ranges[pos].start == index+1
+	switch {
+	case extendsPrevious && extendsNext:
+		a.ranges[pos-1].end = a.ranges[pos].end
+		a.ranges = append(a.ranges[:pos], a.ranges[pos+1:]...)
+	case extendsPrevious:
+		a.ranges[pos-1].end = index + 1
+	case extendsNext:
+		a.ranges[pos].start = index
+	default:
+		a.ranges = append(a.ranges, ackRange{})
+		copy(a.ranges[pos+1:], a.ranges[pos:])
+		a.ranges[pos] = ackRange{start: index, end: index + 1}
+	}
+	a.count += 1
+	return true
+}
+
+// Adds every index from start (inclusive) to end (exclusive) to the set.
+func (a *ackRanges) addRange(start int, end int) {
+	if start >= end {
+		return
+	}
+	merged := make([]ackRange, 0, len(a.ranges)+1)
+	inserted := false
+	for _, r := range a.ranges {
+		switch {
+		case r.end < start:
+			merged = append(merged, r)
+		case r.start > end:
+			if !inserted {
+				merged = append(merged, ackRange{start: start, end: end})
+				inserted = true
+			}
+			merged = append(merged, r)
+		default:
+			// Overlapping or adjacent ranges are folded into the new range.
+			if r.start < start {
+				start = r.start
+			}
+			if r.end > end {
+				end = r.end
+			}
+		}
+	}
+	if !inserted {
+		merged = append(merged, ackRange{start: start, end: end})
+	}
+
+	a.ranges = merged
+	a.count = 0
+	for _, r := range a.ranges {
+		a.count += r.end - r.start
+	}
+}
+
+// The acknowledged ranges as [start, end) pairs.
+func (a *ackRanges) pairs() [][2]int {
+	pairs := make([][2]int, len(a.ranges))
+	for i, r := range a.ranges {
+		pairs[i] = [2]int{r.start, r.end}
+	}
+	return pairs
+}
+
+func (a *ackRanges) contains(index int) bool {
+	pos := sort.Search(len(a.ranges), func(i int) bool {
+		return a.ranges[i].start > index
+	})
+	return pos > 0 && a.ranges[pos-1].end > index
+}
+
+// The lowest index that has not been acknowledged,
+// this is equal to the length of the sequence once every index is acknowledged.
+func (a *ackRanges) firstMissing() int {
+	if len(a.ranges) == 0 || a.ranges[0].start > 0 {
+		return 0
+	}
+	return a.ranges[0].end
+}
+
+// The lowest index from the given index onwards that has not been acknowledged.
+func (a *ackRanges) nextMissing(from int) int {
+	pos := sort.Search(len(a.ranges), func(i int) bool {
+		return a.ranges[i].start > from
+	})
+	if pos > 0 && a.ranges[pos-1].end > from {
+		return a.ranges[pos-1].end
+	}
+	return from
+}
+
+func (a *ackRanges) len() int {
+	return a.count
+}
+
+func (a *ackRanges) clear() {
+	a.ranges = nil
+	a.count = 0
+}
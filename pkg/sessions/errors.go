@@ -0,0 +1,37 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by session stores, these are always wrapped in a
+// SessionError so callers should use errors.Is to check for them.
+var (
+	ErrSessionExpired   = errors.New("session has expired")
+	ErrSequenceConsumed = errors.New("sequence consumed")
+	ErrSessionNotFound  = errors.New("session not found")
+	ErrIndexOutOfRange  = errors.New("index out of range")
+)
+
+// SessionError provides the client ID of the session
+// that a store operation failed for.
+type SessionError struct {
+	ClientID string
+	Err      error
+}
+
+func NewSessionError(clientID string, err error) *SessionError {
+	return &SessionError{
+		ClientID: clientID,
+		Err:      err,
+	}
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("%s for client id (%s)", e.Err, e.ClientID)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,404 @@
+package sessions
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
+	"github.com/sirupsen/logrus"
+)
+
+type FileStoreParams struct {
+	ExpireAfterIdleTime int
+	// The path of the write-ahead log file, parent directories
+	// will be created if they do not exist.
+	Path string
+	// The number of seconds between each compaction of the write-ahead log.
+	CompactionInterval int
+	// See InMemoryStoreParams.
+	CleanupInterval int
+	TombstoneTTL    int
+}
+
+// Write-ahead log operations.
+const (
+	walOpCreate    = "create"
+	walOpAck       = "ack"
+	walOpAckRanges = "ackRanges"
+	walOpExpire    = "expire"
+	walOpDelete    = "delete"
+	walOpReset     = "reset"
+)
+
+// A single entry in the write-ahead log, stored as a line of JSON.
+type walRecord struct {
+	Op       string `json:"op"`
+	ClientID string `json:"clientId"`
+	Time     int    `json:"time"`
+	// The specification used to reproduce the session's sequence,
+	// for seeded sequences this is a handful of bytes.
+	Spec  *sequence.Spec `json:"spec,omitempty"`
+	Index int            `json:"index"`
+	// Populated for create records, see SessionState.
+	TokenNonce string `json:"tokenNonce,omitempty"`
+	// Populated for create records written during compaction and for
+	// ackRanges records, each pair is a range of acknowledged indexes [start, end).
+	AckedRanges [][2]int `json:"ackedRanges,omitempty"`
+	// Logs written before sequences were stored as specifications
+	// hold the full sequence and a list of acknowledged indexes,
+	// these are only read during replay.
+	Sequence     []uint32 `json:"sequence,omitempty"`
+	Acknowledged []int    `json:"acknowledged,omitempty"`
+}
+
+// NewFileStore creates a session store that keeps session state in memory
+// and appends every change to a write-ahead log on disk.
+// Any existing log at the configured path is replayed so sessions
+// survive server restarts.
+func NewFileStore(params *FileStoreParams, logger *logrus.Logger) (SessionStore, error) {
+	store := &fileStore{
+		inMemoryStore: newInMemoryStore(
+			&InMemoryStoreParams{
+				ExpireAfterIdleTime: params.ExpireAfterIdleTime,
+				CleanupInterval:     params.CleanupInterval,
+				TombstoneTTL:        params.TombstoneTTL,
+			},
+			logger,
+		),
+		params: params,
+	}
+	store.journal = store
+
+	err := os.MkdirAll(filepath.Dir(params.Path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	// Compacting on startup leaves us with a clean log to append to,
+	// discarding anything partially written before a crash.
+	store.mu.Lock()
+	err = store.compact()
+	store.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if params.CompactionInterval > 0 {
+		store.wg.Add(1)
+		go store.compactPeriodically()
+	}
+	store.startJanitor()
+
+	return store, nil
+}
+
+type fileStore struct {
+	*inMemoryStore
+	params *FileStoreParams
+	// The log file is only written to while the in-memory
+	// store lock is held.
+	file *os.File
+}
+
+func (s *fileStore) recordCreate(session *internalSessionState) error {
+	spec := session.sequence.Spec()
+	return s.append(&walRecord{
+		Op:         walOpCreate,
+		ClientID:   session.clientID,
+		Time:       session.lastAccessed,
+		Spec:       &spec,
+		TokenNonce: session.tokenNonce,
+	})
+}
+
+func (s *fileStore) recordAck(clientID string, index int, at int) error {
+	return s.append(&walRecord{
+		Op:       walOpAck,
+		ClientID: clientID,
+		Time:     at,
+		Index:    index,
+	})
+}
+
+func (s *fileStore) recordAckRanges(clientID string, ranges [][2]int, at int) error {
+	return s.append(&walRecord{
+		Op:          walOpAckRanges,
+		ClientID:    clientID,
+		Time:        at,
+		AckedRanges: ranges,
+	})
+}
+
+func (s *fileStore) recordExpire(clientID string, at int) error {
+	return s.append(&walRecord{
+		Op:       walOpExpire,
+		ClientID: clientID,
+		Time:     at,
+	})
+}
+
+func (s *fileStore) recordDelete(clientID string) error {
+	return s.append(&walRecord{
+		Op:       walOpDelete,
+		ClientID: clientID,
+	})
+}
+
+func (s *fileStore) recordResetAcks(clientID string, at int) error {
+	return s.append(&walRecord{
+		Op:       walOpReset,
+		ClientID: clientID,
+		Time:     at,
+	})
+}
+
+func (s *fileStore) append(record *walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileStore) replay() error {
+	file, err := os.Open(s.params.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				s.logger.Warn("discarding partially written record at the end of the session log")
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		record := &walRecord{}
+		err = json.Unmarshal(line, record)
+		if err != nil {
+			// A corrupt record can only be the result of a crash mid-write,
+			// nothing after it can be trusted.
+			s.logger.Warn("discarding corrupt record and remainder of the session log: ", err)
+			break
+		}
+		s.apply(record)
+	}
+
+	for _, session := range s.sessions {
+		session.nextIndex = session.acknowledged.firstMissing()
+		if session.nextIndex > session.sequence.Len() {
+			session.nextIndex = session.sequence.Len()
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStore) apply(record *walRecord) {
+	session := s.sessions[record.ClientID]
+
+	switch record.Op {
+	case walOpCreate:
+		seq, err := recordSequence(record)
+		if err != nil {
+			s.logger.Warn("skipping session in session log with an invalid sequence: ", record.ClientID, ": ", err)
+			return
+		}
+		session = &internalSessionState{
+			clientID:     record.ClientID,
+			sequence:     seq,
+			lastAccessed: record.Time,
+			tokenNonce:   record.TokenNonce,
+		}
+		for _, pair := range record.AckedRanges {
+			session.acknowledged.addRange(clampIndex(pair[0], seq), clampIndex(pair[1], seq))
+		}
+		for _, index := range record.Acknowledged {
+			if index >= 0 && index < seq.Len() {
+				session.acknowledged.add(index)
+			}
+		}
+		s.sessions[record.ClientID] = session
+	case walOpAck:
+		if session == nil || record.Index < 0 || record.Index >= session.sequence.Len() {
+			s.logger.Warn("skipping acknowledgement in session log for unknown session or index: ", record.ClientID)
+			return
+		}
+		session.acknowledged.add(record.Index)
+		session.lastAccessed = record.Time
+	case walOpAckRanges:
+		if session == nil {
+			s.logger.Warn("skipping acknowledged ranges in session log for unknown session: ", record.ClientID)
+			return
+		}
+		for _, pair := range record.AckedRanges {
+			session.acknowledged.addRange(clampIndex(pair[0], session.sequence), clampIndex(pair[1], session.sequence))
+		}
+		session.lastAccessed = record.Time
+	case walOpExpire:
+		delete(s.sessions, record.ClientID)
+		s.tombstones[record.ClientID] = record.Time
+	case walOpDelete:
+		delete(s.sessions, record.ClientID)
+		delete(s.tombstones, record.ClientID)
+	case walOpReset:
+		if session == nil {
+			s.logger.Warn("skipping reset in session log for unknown session: ", record.ClientID)
+			return
+		}
+		session.acknowledged.clear()
+		session.lastAccessed = record.Time
+	}
+}
+
+func recordSequence(record *walRecord) (sequence.Sequence, error) {
+	if record.Spec != nil {
+		return sequence.FromSpec(*record.Spec)
+	}
+	return sequence.List(record.Sequence), nil
+}
+
+func clampIndex(index int, seq sequence.Sequence) int {
+	if index < 0 {
+		return 0
+	}
+	if index > seq.Len() {
+		return seq.Len()
+	}
+	return index
+}
+
+// Rewrites the log as the minimal set of records needed to
+// reproduce current session state.
+// Must be called with the store lock held.
+func (s *fileStore) compact() error {
+	tmpPath := s.params.Path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, session := range s.sessions {
+		line, err := json.Marshal(snapshotRecord(session))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	for clientID, expiredAt := range s.tombstones {
+		line, err := json.Marshal(&walRecord{
+			Op:       walOpExpire,
+			ClientID: clientID,
+			Time:     expiredAt,
+		})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	err = os.Rename(tmpPath, s.params.Path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.params.Path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	return nil
+}
+
+func snapshotRecord(session *internalSessionState) *walRecord {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.expired {
+		return &walRecord{
+			Op:       walOpExpire,
+			ClientID: session.clientID,
+			Time:     session.lastAccessed,
+		}
+	}
+
+	spec := session.sequence.Spec()
+	return &walRecord{
+		Op:          walOpCreate,
+		ClientID:    session.clientID,
+		Time:        session.lastAccessed,
+		Spec:        &spec,
+		AckedRanges: session.acknowledged.pairs(),
+		TokenNonce:  session.tokenNonce,
+	}
+}
+
+func (s *fileStore) compactPeriodically() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(s.params.CompactionInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.compact()
+			s.mu.Unlock()
+			if err != nil {
+				s.logger.Error("failed to compact session log: ", err)
+			}
+		}
+	}
+}
+
+func (s *fileStore) Close() error {
+	s.inMemoryStore.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -1,9 +1,12 @@
 package sessions
 
+import "github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
+
 type SessionStore interface {
 	// Initialises a session and returns a read-only copy of
-	// session state.
-	Initialise(clientID string, sequence []uint32) (SessionState, error)
+	// session state. The token nonce is only stored for a new session,
+	// an existing session keeps the nonce it was created with.
+	Initialise(clientID string, sequence sequence.Sequence, tokenNonce string) (SessionState, error)
 	// Should produce a read-only copy of session state.
 	Get(clientID string) (SessionState, error)
 	// Gets the next number in the sequence to send to the client.
@@ -13,9 +16,61 @@ type SessionStore interface {
 	// The first return value is whether or not the acknowledged
 	// index is the final one in the sequence.
 	Ack(clientID string, index int) (bool, error)
+	// Registers acknowledgements for every index in each of the given
+	// [start, end) ranges in a single update.
+	// The first return value is whether or not every number in the
+	// sequence has now been acknowledged.
+	AckRanges(clientID string, ranges [][2]int) (bool, error)
+	// Counts the sessions held by the store in each state
+	// without affecting their expiry.
+	Stats() SessionStats
+	// Lists summaries of sessions ordered by client ID, starting after
+	// the given client ID. An empty client ID starts from the beginning.
+	List(after string, limit int) ([]SessionSummary, error)
+	// Summarises the progress of a single session without affecting its expiry.
+	Summary(clientID string) (SessionSummary, error)
+	// Forces a session to expire so clients can no longer resume it.
+	Expire(clientID string) error
+	// Removes all record of a session, freeing up its client ID for a new session.
+	Delete(clientID string) error
+	// Clears all acknowledgements for a session so its sequence
+	// is delivered again from the start.
+	ResetAcks(clientID string) error
+	// Releases any resources held by the store such as
+	// files and background goroutines.
+	Close() error
 }
 
 type SessionState struct {
-	Sequence     []uint32
-	Acknowledged []bool
+	Sequence sequence.Sequence
+	// The number of numbers in the sequence that have been acknowledged.
+	Acknowledged int
+	// Generated by the server when the session is created and signed into
+	// the client tokens for the session, empty when tokens are not required.
+	TokenNonce string
+}
+
+type SessionStats struct {
+	// Sessions with numbers that are yet to be acknowledged.
+	InProgress int
+	// Sessions where every number in the sequence has been acknowledged.
+	Consumed int
+	// Sessions that have expired, including those that have been evicted
+	// and are only held as tombstones.
+	Expired int
+}
+
+type SessionSummary struct {
+	ClientID string `json:"clientId"`
+	// The number of numbers in the sequence, 0 for expired sessions
+	// that are only held as tombstones.
+	Length int `json:"length"`
+	// The index of the next number to be sent.
+	NextIndex    int `json:"nextIndex"`
+	Acknowledged int `json:"acknowledged"`
+	// Unix time in seconds, the time of expiry for expired sessions.
+	LastAccessed int  `json:"lastAccessed"`
+	Expired      bool `json:"expired"`
+	// See SessionState, it is not listed by the admin API.
+	TokenNonce string `json:"-"`
 }
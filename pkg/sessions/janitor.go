@@ -0,0 +1,80 @@
+package sessions
+
+import "time"
+
+func (s *inMemoryStore) startJanitor() {
+	if s.params.CleanupInterval <= 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go s.runJanitor()
+}
+
+func (s *inMemoryStore) runJanitor() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(s.params.CleanupInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			evicted, purged := s.reap()
+			s.mu.Unlock()
+			s.logger.Debug("janitor evicted ", evicted, " sessions and purged ", purged, " tombstones")
+		}
+	}
+}
+
+// Evicts sessions that have expired or have been idle for longer than the
+// configured expiry, replacing them with tombstones, and purges tombstones
+// that have outlived their TTL.
+// Must be called with the store lock held.
+func (s *inMemoryStore) reap() (int, int) {
+	now := s.now()
+
+	evicted := 0
+	for clientID, session := range s.sessions {
+		expiredAt, expired := s.expiredAt(session, now)
+		if !expired {
+			continue
+		}
+
+		if !session.expired && s.journal != nil {
+			err := s.journal.recordExpire(clientID, expiredAt)
+			if err != nil {
+				s.logger.Error("failed to record session expiry: ", err)
+				continue
+			}
+		}
+		delete(s.sessions, clientID)
+		s.tombstones[clientID] = expiredAt
+		evicted += 1
+	}
+
+	purged := 0
+	for clientID, expiredAt := range s.tombstones {
+		if expiredAt+s.params.TombstoneTTL < now {
+			delete(s.tombstones, clientID)
+			purged += 1
+		}
+	}
+
+	return evicted, purged
+}
+
+func (s *inMemoryStore) expiredAt(session *internalSessionState, now int) (int, bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.expired {
+		return session.lastAccessed, true
+	}
+
+	expiresAt := session.lastAccessed + s.params.ExpireAfterIdleTime
+	return expiresAt, expiresAt < now
+}
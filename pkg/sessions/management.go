@@ -0,0 +1,150 @@
+package sessions
+
+import "sort"
+
+func (s *inMemoryStore) List(after string, limit int) ([]SessionSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientIDs := make([]string, 0, len(s.sessions)+len(s.tombstones))
+	for clientID := range s.sessions {
+		if clientID > after {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	for clientID := range s.tombstones {
+		if clientID > after {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	sort.Strings(clientIDs)
+	if limit > 0 && len(clientIDs) > limit {
+		clientIDs = clientIDs[:limit]
+	}
+
+	now := s.now()
+	summaries := make([]SessionSummary, len(clientIDs))
+	for i, clientID := range clientIDs {
+		summaries[i] = s.summarise(clientID, now)
+	}
+	return summaries, nil
+}
+
+func (s *inMemoryStore) Summary(clientID string) (SessionSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.exists(clientID) {
+		return SessionSummary{}, NewSessionError(clientID, ErrSessionNotFound)
+	}
+	return s.summarise(clientID, s.now()), nil
+}
+
+func (s *inMemoryStore) Expire(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, hasTombstone := s.tombstones[clientID]; hasTombstone {
+		return nil
+	}
+	session := s.sessions[clientID]
+	if session == nil {
+		return NewSessionError(clientID, ErrSessionNotFound)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.expired {
+		return nil
+	}
+	now := s.now()
+	if s.journal != nil {
+		err := s.journal.recordExpire(clientID, now)
+		if err != nil {
+			return err
+		}
+	}
+	session.expired = true
+	session.lastAccessed = now
+	return nil
+}
+
+func (s *inMemoryStore) Delete(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.exists(clientID) {
+		return NewSessionError(clientID, ErrSessionNotFound)
+	}
+	if s.journal != nil {
+		err := s.journal.recordDelete(clientID)
+		if err != nil {
+			return err
+		}
+	}
+	delete(s.sessions, clientID)
+	delete(s.tombstones, clientID)
+	return nil
+}
+
+func (s *inMemoryStore) ResetAcks(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := s.loadExisting(clientID)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		return NewSessionError(clientID, ErrSessionNotFound)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if s.journal != nil {
+		err = s.journal.recordResetAcks(clientID, session.lastAccessed)
+		if err != nil {
+			return err
+		}
+	}
+	session.acknowledged.clear()
+	session.nextIndex = 0
+	return nil
+}
+
+// Whether the store holds a session or tombstone for the client ID.
+// Must be called with the store lock held.
+func (s *inMemoryStore) exists(clientID string) bool {
+	_, hasSession := s.sessions[clientID]
+	_, hasTombstone := s.tombstones[clientID]
+	return hasSession || hasTombstone
+}
+
+// Must be called with the store lock held.
+func (s *inMemoryStore) summarise(clientID string, now int) SessionSummary {
+	session := s.sessions[clientID]
+	if session == nil {
+		return SessionSummary{
+			ClientID:     clientID,
+			LastAccessed: s.tombstones[clientID],
+			Expired:      true,
+		}
+	}
+
+	_, expired := s.expiredAt(session, now)
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return SessionSummary{
+		ClientID:     clientID,
+		Length:       session.sequence.Len(),
+		NextIndex:    session.nextIndex,
+		Acknowledged: session.acknowledged.len(),
+		LastAccessed: session.lastAccessed,
+		Expired:      expired,
+		TokenNonce:   session.tokenNonce,
+	}
+}
@@ -1,22 +1,40 @@
 package sessions
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
+
 	"github.com/sirupsen/logrus"
 )
 
 type InMemoryStoreParams struct {
 	ExpireAfterIdleTime int
+	// The number of seconds between each scan for sessions to evict,
+	// the background cleanup is disabled when this is 0.
+	CleanupInterval int
+	// The number of seconds a record of an evicted session is kept for
+	// so clients reconnecting with its client ID are told the session has expired.
+	TombstoneTTL int
 }
 
 func NewInMemoryStore(params *InMemoryStoreParams, logger *logrus.Logger) SessionStore {
+	store := newInMemoryStore(params, logger)
+	store.startJanitor()
+	return store
+}
+
+func newInMemoryStore(params *InMemoryStoreParams, logger *logrus.Logger) *inMemoryStore {
 	return &inMemoryStore{
-		params:   params,
-		sessions: map[string]*internalSessionState{},
-		logger:   logger,
+		params:     params,
+		sessions:   map[string]*internalSessionState{},
+		tombstones: map[string]int{},
+		logger:     logger,
+		now: func() int {
+			return int(time.Now().Unix())
+		},
+		stop: make(chan struct{}),
 	}
 }
 
@@ -24,27 +42,57 @@ type inMemoryStore struct {
 	mu       sync.Mutex
 	params   *InMemoryStoreParams
 	sessions map[string]*internalSessionState
-	logger   *logrus.Logger
+	// Client IDs of evicted sessions mapped to the unix time
+	// at which they expired.
+	tombstones map[string]int
+	// An optional journal that is notified of changes to session state
+	// before they are applied, this allows durable stores to build on top
+	// of the in-memory store.
+	journal sessionJournal
+	logger  *logrus.Logger
+	// Current unix time in seconds, overridden in tests.
+	now func() int
+	// Signals background goroutines owned by the store to exit.
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// sessionJournal records changes to session state.
+// All methods are called while the store lock is held.
+type sessionJournal interface {
+	recordCreate(session *internalSessionState) error
+	recordAck(clientID string, index int, at int) error
+	recordAckRanges(clientID string, ranges [][2]int, at int) error
+	recordExpire(clientID string, at int) error
+	recordDelete(clientID string) error
+	recordResetAcks(clientID string, at int) error
 }
 
 type internalSessionState struct {
-	clientID     string
-	sequence     []uint32
+	clientID string
+	// Sequences are derived from a seed where possible
+	// so they take up very little memory.
+	sequence     sequence.Sequence
 	lastAccessed int
 	// We hold an expired property as a soft delete property
 	// to prevent clients trying to re-connect for the same client ID
 	// after an expiry time has passed.
 	// This is to distinguish between a client session that has not yet been
 	// created and one that has been discarded.
-	// In the future a clean up mechanism should be put in place to free up memory
-	// as discarded sessions build up over time.
+	// Expired sessions are periodically replaced with tombstones by the janitor
+	// to free up memory.
 	expired      bool
 	nextIndex    int
-	acknowledged []bool
-	mu           sync.Mutex
+	acknowledged ackRanges
+	// Set when the client provided the offset for its connection, numbers after the offset
+	// are sent even if they have been acknowledged as the client may no longer hold them,
+	// such as when a restarted client resumes from numbers it persisted itself.
+	resendAcknowledged bool
+	tokenNonce         string
+	mu                 sync.Mutex
 }
 
-func (s *inMemoryStore) Initialise(clientID string, sequence []uint32) (SessionState, error) {
+func (s *inMemoryStore) Initialise(clientID string, sequence sequence.Sequence, tokenNonce string) (SessionState, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -54,22 +102,25 @@ func (s *inMemoryStore) Initialise(clientID string, sequence []uint32) (SessionS
 	}
 
 	if internalSession == nil {
-		now := int(time.Now().Unix())
+		now := s.now()
 		internalSession = &internalSessionState{
 			clientID:     clientID,
 			sequence:     sequence,
 			lastAccessed: now,
 			expired:      false,
 			nextIndex:    0,
-			acknowledged: make([]bool, len(sequence)),
+			tokenNonce:   tokenNonce,
+		}
+		if s.journal != nil {
+			err = s.journal.recordCreate(internalSession)
+			if err != nil {
+				return SessionState{}, err
+			}
 		}
 		s.sessions[clientID] = internalSession
 	}
 
-	return SessionState{
-		Sequence:     internalSession.sequence,
-		Acknowledged: internalSession.acknowledged,
-	}, nil
+	return internalSession.state(), nil
 }
 
 func (s *inMemoryStore) Get(clientID string) (SessionState, error) {
@@ -82,13 +133,10 @@ func (s *inMemoryStore) Get(clientID string) (SessionState, error) {
 	}
 
 	if internalSession == nil {
-		return SessionState{}, fmt.Errorf("no session exists for client id (%s)", clientID)
+		return SessionState{}, NewSessionError(clientID, ErrSessionNotFound)
 	}
 
-	return SessionState{
-		Sequence:     internalSession.sequence,
-		Acknowledged: internalSession.acknowledged,
-	}, nil
+	return internalSession.state(), nil
 }
 
 func (s *inMemoryStore) Next(clientID string, offsetOverride int, freshConnection bool) (uint32, int, error) {
@@ -99,6 +147,9 @@ func (s *inMemoryStore) Next(clientID string, offsetOverride int, freshConnectio
 	if err != nil {
 		return 0, 0, err
 	}
+	if session == nil {
+		return 0, 0, NewSessionError(clientID, ErrSessionNotFound)
+	}
 
 	session.mu.Lock()
 	defer session.mu.Unlock()
@@ -106,10 +157,14 @@ func (s *inMemoryStore) Next(clientID string, offsetOverride int, freshConnectio
 	// offset override takes precedence, this is the client provided
 	// offset for the index of the number in the sequence it has not
 	// yet received.
-	if offsetOverride > -1 && offsetOverride < len(session.sequence) {
+	if freshConnection {
+		session.resendAcknowledged = false
+	}
+	if offsetOverride > -1 && offsetOverride < session.sequence.Len() {
 		s.logger.Debug("choosing offset override")
 		session.nextIndex = offsetOverride + 1
-		return session.sequence[offsetOverride], offsetOverride, nil
+		session.resendAcknowledged = true
+		return session.sequence.At(offsetOverride), offsetOverride, nil
 	}
 
 	// For resilience when clients disconnect and reconnect,
@@ -119,25 +174,30 @@ func (s *inMemoryStore) Next(clientID string, offsetOverride int, freshConnectio
 	// the server believes it has sent a message but the client has not received it,
 	// this can occur in the time inbetween updating state in the server and sending
 	// the message to the client.
-	firstNotAcknowledgedIndex := findFirstFalseIndex(session.acknowledged)
+	firstNotAcknowledgedIndex := session.firstUnacknowledged()
 	if freshConnection && firstNotAcknowledgedIndex != session.nextIndex &&
 		firstNotAcknowledgedIndex > -1 {
 		s.logger.Debug("choosing first not acknowledged index, session.nextIndex: ", session.nextIndex, " firstNotAcknowledgedIndex: ", firstNotAcknowledgedIndex)
-		number := session.sequence[firstNotAcknowledgedIndex]
+		number := session.sequence.At(firstNotAcknowledgedIndex)
 		session.nextIndex = firstNotAcknowledgedIndex + 1
 		return number, firstNotAcknowledgedIndex, nil
 	}
 
-	if session.nextIndex < len(session.sequence) {
+	// Numbers the client has acknowledged ahead of a gap are skipped,
+	// there is no need to send them again.
+	if !session.resendAcknowledged {
+		session.nextIndex = session.acknowledged.nextMissing(session.nextIndex)
+	}
+	if session.nextIndex < session.sequence.Len() {
 		s.logger.Debug("choosing session.nextIndex + 1")
 		index := session.nextIndex
-		number := session.sequence[index]
+		number := session.sequence.At(index)
 		session.nextIndex += 1
 		return number, index, nil
 	}
 
 	s.logger.Debug("sequence consumed")
-	return 0, 0, fmt.Errorf("sequence consumed for session with client id (%s)", clientID)
+	return 0, 0, NewSessionError(clientID, ErrSequenceConsumed)
 }
 
 func (s *inMemoryStore) Ack(clientID string, index int) (bool, error) {
@@ -146,15 +206,94 @@ func (s *inMemoryStore) Ack(clientID string, index int) (bool, error) {
 
 	session, err := s.loadExisting(clientID)
 	if err != nil {
-		return index == len(session.sequence)-1, err
+		return false, err
+	}
+	if session == nil {
+		return false, NewSessionError(clientID, ErrSessionNotFound)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if index < 0 || index >= session.sequence.Len() {
+		return false, NewSessionError(clientID, ErrIndexOutOfRange)
+	}
+
+	if s.journal != nil {
+		err = s.journal.recordAck(clientID, index, session.lastAccessed)
+		if err != nil {
+			return false, err
+		}
+	}
+	session.acknowledged.add(index)
+
+	return index == session.sequence.Len()-1, nil
+}
+
+func (s *inMemoryStore) AckRanges(clientID string, ranges [][2]int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := s.loadExisting(clientID)
+	if err != nil {
+		return false, err
+	}
+	if session == nil {
+		return false, NewSessionError(clientID, ErrSessionNotFound)
 	}
 
 	session.mu.Lock()
 	defer session.mu.Unlock()
 
-	session.acknowledged[index] = true
+	for _, r := range ranges {
+		if r[0] < 0 || r[0] >= r[1] || r[1] > session.sequence.Len() {
+			return false, NewSessionError(clientID, ErrIndexOutOfRange)
+		}
+	}
+
+	if s.journal != nil {
+		err = s.journal.recordAckRanges(clientID, ranges, session.lastAccessed)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, r := range ranges {
+		session.acknowledged.addRange(r[0], r[1])
+	}
+
+	return session.firstUnacknowledged() == -1, nil
+}
+
+func (s *inMemoryStore) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	stats := SessionStats{Expired: len(s.tombstones)}
+	for _, session := range s.sessions {
+		_, expired := s.expiredAt(session, now)
+		if expired {
+			stats.Expired += 1
+		} else if isConsumed(session) {
+			stats.Consumed += 1
+		} else {
+			stats.InProgress += 1
+		}
+	}
+	return stats
+}
+
+func isConsumed(session *internalSessionState) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
 
-	return index == len(session.sequence)-1, nil
+	return session.firstUnacknowledged() == -1
+}
+
+func (s *inMemoryStore) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+	return nil
 }
 
 func (s *inMemoryStore) loadExisting(clientID string) (*internalSessionState, error) {
@@ -162,12 +301,17 @@ func (s *inMemoryStore) loadExisting(clientID string) (*internalSessionState, er
 	if session != nil {
 		expired := s.checkExpiredAndUpdateIfNeeded(session)
 		if expired {
-			return nil, fmt.Errorf("session has expired for client id (%s)", clientID)
+			return nil, NewSessionError(clientID, ErrSessionExpired)
 		}
 
 		return session, nil
 	}
 
+	_, hasTombstone := s.tombstones[clientID]
+	if hasTombstone {
+		return nil, NewSessionError(clientID, ErrSessionExpired)
+	}
+
 	// Indicates a session has not yet been created for a given client ID.
 	return nil, nil
 }
@@ -180,30 +324,42 @@ func (s *inMemoryStore) checkExpiredAndUpdateIfNeeded(session *internalSessionSt
 		return true
 	}
 
-	now := int(time.Now().Unix())
+	now := s.now()
 
 	if session.lastAccessed+s.params.ExpireAfterIdleTime < now {
 		s.logger.Debug("Setting session to expired", session.lastAccessed, s.params.ExpireAfterIdleTime, now)
 		session.expired = true
+		if s.journal != nil {
+			err := s.journal.recordExpire(session.clientID, now)
+			if err != nil {
+				s.logger.Error("failed to record session expiry: ", err)
+			}
+		}
 	}
 	session.lastAccessed = now
 
 	return session.expired
 }
 
-// todo: move into a reusable util function.
-func findFirstFalseIndex(list []bool) int {
-	i := 0
-	found := false
-	for !found && i < len(list) {
-		found = !list[i]
-		if !found {
-			i += 1
-		}
+// Produces a read-only copy of session state.
+func (s *internalSessionState) state() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SessionState{
+		Sequence:     s.sequence,
+		Acknowledged: s.acknowledged.len(),
+		TokenNonce:   s.tokenNonce,
 	}
+}
 
-	if found {
-		return i
+// The index of the first number that has not been acknowledged,
+// -1 when every number has been acknowledged.
+// Must be called with the session lock held.
+func (s *internalSessionState) firstUnacknowledged() int {
+	index := s.acknowledged.firstMissing()
+	if index >= s.sequence.Len() {
+		return -1
 	}
-	return -1
+	return index
 }
@@ -0,0 +1,778 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/fr3shw3b/ably-protocol-exercise/pkg/sequence"
+	"github.com/sirupsen/logrus"
+)
+
+type storeFactory func(t *testing.T, expireAfterIdleTime int) SessionStore
+
+func Test_in_memory_store(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, expireAfterIdleTime int) SessionStore {
+		return NewInMemoryStore(
+			&InMemoryStoreParams{ExpireAfterIdleTime: expireAfterIdleTime},
+			createLogger(),
+		)
+	})
+}
+
+func Test_file_store(t *testing.T) {
+	runStoreSuite(t, func(t *testing.T, expireAfterIdleTime int) SessionStore {
+		store, err := NewFileStore(
+			&FileStoreParams{
+				ExpireAfterIdleTime: expireAfterIdleTime,
+				Path:                filepath.Join(t.TempDir(), "sessions.wal"),
+			},
+			createLogger(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func runStoreSuite(t *testing.T, newStore storeFactory) {
+	t.Run("initialise keeps the sequence of an existing session", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		_, err := store.Initialise("client-1", sequence.List([]uint32{1, 2, 3}), "nonce-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := store.Initialise("client-1", sequence.List([]uint32{4, 5}), "nonce-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSequence(t, sequence.Numbers(session.Sequence), []uint32{1, 2, 3})
+		if session.TokenNonce != "nonce-1" {
+			t.Fatalf("expected the token nonce the session was created with, received %q", session.TokenNonce)
+		}
+	})
+
+	t.Run("get fails for unknown session", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		_, err := store.Get("unknown")
+		if !errors.Is(err, ErrSessionNotFound) {
+			t.Fatal("expected a session not found error, received: ", err)
+		}
+		var sessionErr *SessionError
+		if !errors.As(err, &sessionErr) || sessionErr.ClientID != "unknown" {
+			t.Fatal("expected a session error carrying the client id, received: ", err)
+		}
+	})
+
+	t.Run("next walks the sequence until consumed", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20, 30}), "")
+		received := []uint32{}
+		next, index, err := store.Next("client-1", -1, true)
+		for err == nil {
+			if index != len(received) {
+				t.Fatalf("expected index %d, received %d", len(received), index)
+			}
+			received = append(received, next)
+			next, index, err = store.Next("client-1", -1, false)
+		}
+		if !errors.Is(err, ErrSequenceConsumed) {
+			t.Fatal("expected a sequence consumed error, received: ", err)
+		}
+		assertSequence(t, received, []uint32{10, 20, 30})
+	})
+
+	t.Run("next honours the offset override", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20, 30}), "")
+		next, index, err := store.Next("client-1", 1, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != 20 || index != 1 {
+			t.Fatalf("expected 20 at index 1, received %d at index %d", next, index)
+		}
+	})
+
+	t.Run("next resumes from the first unacknowledged index on a fresh connection", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20, 30, 40}), "")
+		for i := 0; i < 3; i += 1 {
+			store.Next("client-1", -1, i == 0)
+		}
+		store.Ack("client-1", 0)
+
+		next, index, err := store.Next("client-1", -1, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != 20 || index != 1 {
+			t.Fatalf("expected 20 at index 1, received %d at index %d", next, index)
+		}
+	})
+
+	t.Run("ack reports the final index", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		final, err := store.Ack("client-1", 0)
+		if err != nil || final {
+			t.Fatalf("expected non-final ack without error, received final=%v err=%v", final, err)
+		}
+		final, err = store.Ack("client-1", 1)
+		if err != nil || !final {
+			t.Fatalf("expected final ack without error, received final=%v err=%v", final, err)
+		}
+	})
+
+	t.Run("ack rejects indexes outside of the sequence", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		_, err := store.Ack("client-1", 2)
+		if !errors.Is(err, ErrIndexOutOfRange) {
+			t.Fatal("expected an index out of range error, received: ", err)
+		}
+	})
+
+	t.Run("ack ranges acknowledge in bulk and next fills the gaps", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20, 30, 40, 50, 60}), "")
+		for i := 0; i < 6; i += 1 {
+			store.Next("client-1", -1, i == 0)
+		}
+		complete, err := store.AckRanges("client-1", [][2]int{{0, 2}, {3, 5}})
+		if err != nil || complete {
+			t.Fatalf("expected incomplete acks without error, received complete=%v err=%v", complete, err)
+		}
+
+		received := []uint32{}
+		next, _, err := store.Next("client-1", -1, true)
+		for err == nil {
+			received = append(received, next)
+			next, _, err = store.Next("client-1", -1, false)
+		}
+		if !errors.Is(err, ErrSequenceConsumed) {
+			t.Fatal("expected a sequence consumed error, received: ", err)
+		}
+		assertSequence(t, received, []uint32{30, 60})
+
+		complete, err = store.AckRanges("client-1", [][2]int{{2, 3}, {5, 6}})
+		if err != nil || !complete {
+			t.Fatalf("expected complete acks without error, received complete=%v err=%v", complete, err)
+		}
+		state, _ := store.Get("client-1")
+		if state.Acknowledged != 6 {
+			t.Fatalf("expected 6 acknowledged numbers, received %d", state.Acknowledged)
+		}
+	})
+
+	t.Run("next resends acknowledged numbers after the offset override", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20, 30, 40}), "")
+		store.AckRanges("client-1", [][2]int{{0, 4}})
+
+		received := []uint32{}
+		next, _, err := store.Next("client-1", 1, true)
+		for err == nil {
+			received = append(received, next)
+			next, _, err = store.Next("client-1", -1, false)
+		}
+		assertSequence(t, received, []uint32{20, 30, 40})
+	})
+
+	t.Run("ack ranges rejects ranges outside of the sequence", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		for _, ranges := range [][][2]int{{{0, 3}}, {{-1, 1}}, {{1, 1}}} {
+			_, err := store.AckRanges("client-1", ranges)
+			if !errors.Is(err, ErrIndexOutOfRange) {
+				t.Fatalf("expected an index out of range error for %v, received: %v", ranges, err)
+			}
+		}
+		state, _ := store.Get("client-1")
+		if state.Acknowledged != 0 {
+			t.Fatalf("expected nothing to be acknowledged, received %d", state.Acknowledged)
+		}
+	})
+
+	t.Run("next and ack fail for unknown session", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		_, _, err := store.Next("unknown", -1, true)
+		if !errors.Is(err, ErrSessionNotFound) {
+			t.Fatal("expected a session not found error from next, received: ", err)
+		}
+		_, err = store.Ack("unknown", 0)
+		if !errors.Is(err, ErrSessionNotFound) {
+			t.Fatal("expected a session not found error from ack, received: ", err)
+		}
+	})
+
+	t.Run("idle sessions expire", func(t *testing.T) {
+		// A negative idle time expires the session on the next access.
+		store := newStore(t, -1)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		_, err := store.Get("client-1")
+		if !errors.Is(err, ErrSessionExpired) {
+			t.Fatal("expected a session expired error, received: ", err)
+		}
+		_, err = store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		if !errors.Is(err, ErrSessionExpired) {
+			t.Fatal("expected initialise to fail for an expired session, received: ", err)
+		}
+	})
+
+	t.Run("stats count sessions in each state", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("in-progress", sequence.List([]uint32{10, 20}), "")
+		store.Ack("in-progress", 0)
+		store.Initialise("consumed", sequence.List([]uint32{10}), "")
+		store.Ack("consumed", 0)
+
+		stats := store.Stats()
+		expected := SessionStats{InProgress: 1, Consumed: 1, Expired: 0}
+		if stats != expected {
+			t.Fatalf("expected stats %+v, received %+v", expected, stats)
+		}
+	})
+
+	t.Run("list pages through sessions ordered by client id", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		for _, clientID := range []string{"client-c", "client-a", "client-b"} {
+			store.Initialise(clientID, sequence.List([]uint32{10, 20}), "")
+		}
+
+		page, err := store.List("", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 2 || page[0].ClientID != "client-a" || page[1].ClientID != "client-b" {
+			t.Fatalf("expected the first page to contain client-a and client-b, received %+v", page)
+		}
+		page, err = store.List(page[1].ClientID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 1 || page[0].ClientID != "client-c" {
+			t.Fatalf("expected the second page to contain client-c, received %+v", page)
+		}
+	})
+
+	t.Run("summary reports session progress", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20, 30}), "")
+		store.Next("client-1", -1, true)
+		store.Next("client-1", -1, false)
+		store.Ack("client-1", 0)
+
+		summary, err := store.Summary("client-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.Length != 3 || summary.NextIndex != 2 || summary.Acknowledged != 1 || summary.Expired {
+			t.Fatalf("unexpected summary %+v", summary)
+		}
+
+		_, err = store.Summary("unknown")
+		if !errors.Is(err, ErrSessionNotFound) {
+			t.Fatal("expected a session not found error, received: ", err)
+		}
+	})
+
+	t.Run("expired sessions can not be resumed", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		err := store.Expire("client-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = store.Next("client-1", -1, true)
+		if !errors.Is(err, ErrSessionExpired) {
+			t.Fatal("expected a session expired error, received: ", err)
+		}
+		summary, _ := store.Summary("client-1")
+		if !summary.Expired {
+			t.Fatal("expected the summary to report the session as expired")
+		}
+	})
+
+	t.Run("deleted sessions free up the client id", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		store.Expire("client-1")
+		err := store.Delete("client-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := store.Initialise("client-1", sequence.List([]uint32{30}), "")
+		if err != nil {
+			t.Fatal("expected initialise to succeed after the session was deleted: ", err)
+		}
+		assertSequence(t, sequence.Numbers(session.Sequence), []uint32{30})
+
+		err = store.Delete("unknown")
+		if !errors.Is(err, ErrSessionNotFound) {
+			t.Fatal("expected a session not found error, received: ", err)
+		}
+	})
+
+	t.Run("reset acks delivers the sequence from the start", func(t *testing.T) {
+		store := newStore(t, 30)
+		defer store.Close()
+
+		store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+		store.Next("client-1", -1, true)
+		store.Ack("client-1", 0)
+		err := store.ResetAcks("client-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next, index, err := store.Next("client-1", -1, true)
+		if err != nil || next != 10 || index != 0 {
+			t.Fatalf("expected the first number after reset, received next=%d index=%d err=%v", next, index, err)
+		}
+	})
+}
+
+func Test_file_store_resumes_sessions_after_restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.wal")
+	params := &FileStoreParams{
+		ExpireAfterIdleTime: 30,
+		Path:                path,
+	}
+
+	store, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Initialise("client-1", sequence.List([]uint32{10, 20, 30}), "nonce-1")
+	store.Ack("client-1", 0)
+	store.Ack("client-1", 1)
+	store.Close()
+
+	restarted, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	session, err := restarted.Initialise("client-1", sequence.List([]uint32{1}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSequence(t, sequence.Numbers(session.Sequence), []uint32{10, 20, 30})
+	if session.TokenNonce != "nonce-1" {
+		t.Fatalf("expected the token nonce to survive the restart, received %q", session.TokenNonce)
+	}
+
+	next, index, err := restarted.Next("client-1", -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 30 || index != 2 {
+		t.Fatalf("expected 30 at index 2, received %d at index %d", next, index)
+	}
+}
+
+func Test_file_store_replays_acknowledged_ranges_after_restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.wal")
+	params := &FileStoreParams{
+		ExpireAfterIdleTime: 30,
+		Path:                path,
+	}
+
+	store, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Initialise("client-1", sequence.List([]uint32{10, 20, 30, 40}), "")
+	store.AckRanges("client-1", [][2]int{{0, 1}, {2, 4}})
+	store.Close()
+
+	restarted, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	next, index, err := restarted.Next("client-1", -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 20 || index != 1 {
+		t.Fatalf("expected 20 at index 1, received %d at index %d", next, index)
+	}
+	_, _, err = restarted.Next("client-1", -1, false)
+	if !errors.Is(err, ErrSequenceConsumed) {
+		t.Fatal("expected the acknowledged numbers to be skipped, received: ", err)
+	}
+}
+
+func Test_file_store_replays_admin_changes_after_restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.wal")
+	params := &FileStoreParams{
+		ExpireAfterIdleTime: 30,
+		Path:                path,
+	}
+
+	store, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Initialise("expired", sequence.List([]uint32{10}), "")
+	store.Initialise("deleted", sequence.List([]uint32{20}), "")
+	store.Initialise("reset", sequence.List([]uint32{30, 40}), "")
+	store.Ack("reset", 0)
+	store.Expire("expired")
+	store.Delete("deleted")
+	store.ResetAcks("reset")
+	store.Close()
+
+	restarted, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	_, err = restarted.Get("expired")
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Fatal("expected the expired session to remain expired, received: ", err)
+	}
+	_, err = restarted.Summary("deleted")
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatal("expected the deleted session to remain deleted, received: ", err)
+	}
+	summary, err := restarted.Summary("reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Acknowledged != 0 || summary.NextIndex != 0 {
+		t.Fatalf("expected the session to have no acknowledgements after reset, received %+v", summary)
+	}
+}
+
+func Test_file_store_remembers_expired_sessions_after_restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.wal")
+
+	store, err := NewFileStore(&FileStoreParams{ExpireAfterIdleTime: -1, Path: path}, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+	store.Get("client-1")
+	store.Close()
+
+	restarted, err := NewFileStore(&FileStoreParams{ExpireAfterIdleTime: 30, Path: path}, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	_, err = restarted.Initialise("client-1", sequence.List([]uint32{10, 20}), "")
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Fatal("expected initialise to fail for a session that expired before restart")
+	}
+}
+
+func Test_janitor_replaces_idle_sessions_with_tombstones(t *testing.T) {
+	store := newInMemoryStore(
+		&InMemoryStoreParams{ExpireAfterIdleTime: 30, TombstoneTTL: 60},
+		createLogger(),
+	)
+	defer store.Close()
+
+	now := 1000
+	store.now = func() int { return now }
+
+	store.Initialise("idle", sequence.List([]uint32{10, 20}), "")
+	now = 1020
+	store.Initialise("active", sequence.List([]uint32{30, 40}), "")
+
+	now = 1040
+	store.mu.Lock()
+	evicted, _ := store.reap()
+	store.mu.Unlock()
+
+	if evicted != 1 {
+		t.Fatalf("expected 1 session to be evicted, %d were evicted", evicted)
+	}
+	if _, exists := store.sessions["idle"]; exists {
+		t.Fatal("expected idle session to be evicted")
+	}
+	if _, exists := store.sessions["active"]; !exists {
+		t.Fatal("expected active session to be kept")
+	}
+	stats := store.Stats()
+	if stats.Expired != 1 || stats.InProgress != 1 {
+		t.Fatalf("expected the tombstone to be counted as expired, received %+v", stats)
+	}
+
+	_, err := store.Initialise("idle", sequence.List([]uint32{10, 20}), "")
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Fatal("expected initialise to fail for an evicted session")
+	}
+
+	// Tombstones are purged once they outlive their TTL
+	// which frees the client ID up for a new session.
+	now = 1040 + 30 + 61
+	store.mu.Lock()
+	store.reap()
+	store.mu.Unlock()
+
+	if _, exists := store.tombstones["idle"]; exists {
+		t.Fatal("expected tombstone for idle session to be purged")
+	}
+	_, err = store.Initialise("idle", sequence.List([]uint32{10, 20}), "")
+	if err != nil {
+		t.Fatal("expected initialise to succeed after the tombstone was purged: ", err)
+	}
+}
+
+func Test_janitor_stops_on_close(t *testing.T) {
+	store := NewInMemoryStore(
+		&InMemoryStoreParams{ExpireAfterIdleTime: 30, CleanupInterval: 1, TombstoneTTL: 60},
+		createLogger(),
+	)
+
+	closed := make(chan struct{})
+	go func() {
+		store.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the janitor to stop")
+	}
+}
+
+func Test_file_store_restores_seeded_sessions_after_compaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.wal")
+	params := &FileStoreParams{
+		ExpireAfterIdleTime: 30,
+		Path:                path,
+	}
+
+	store, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded := sequence.Seeded(42, 5, 0xffff)
+	store.Initialise("client-1", seeded, "")
+	store.Ack("client-1", 0)
+	store.Ack("client-1", 1)
+	store.Ack("client-1", 3)
+	err = store.(*fileStore).compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	restarted, err := NewFileStore(params, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	session, err := restarted.Get("client-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Sequence.Spec().Kind != sequence.KindSeeded || session.Acknowledged != 3 {
+		t.Fatalf("expected a seeded sequence with 3 acknowledgements, received %+v", session)
+	}
+	assertSequence(t, sequence.Numbers(session.Sequence), sequence.Numbers(seeded))
+
+	next, index, err := restarted.Next("client-1", -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != seeded.At(2) || index != 2 {
+		t.Fatalf("expected the number at index 2, received %d at index %d", next, index)
+	}
+}
+
+func Test_file_store_replays_logs_holding_full_sequences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.wal")
+	now := time.Now().Unix()
+	log := fmt.Sprintf(
+		`{"op":"create","clientId":"client-1","time":%d,"sequence":[10,20,30],"index":0,"acknowledged":[0]}
+{"op":"ack","clientId":"client-1","time":%d,"index":1}
+`,
+		now,
+		now,
+	)
+	err := os.WriteFile(path, []byte(log), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(&FileStoreParams{ExpireAfterIdleTime: 30, Path: path}, createLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	session, err := store.Get("client-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSequence(t, sequence.Numbers(session.Sequence), []uint32{10, 20, 30})
+	if session.Acknowledged != 2 {
+		t.Fatalf("expected 2 acknowledgements, received %d", session.Acknowledged)
+	}
+}
+
+func Test_ack_ranges_merge_adjacent_indexes(t *testing.T) {
+	acks := ackRanges{}
+	for _, index := range []int{0, 2, 4, 1, 3} {
+		if !acks.add(index) {
+			t.Fatalf("expected index %d to be added", index)
+		}
+	}
+	if acks.add(2) {
+		t.Fatal("expected index 2 to already be present")
+	}
+	if len(acks.ranges) != 1 || acks.len() != 5 || acks.firstMissing() != 5 {
+		t.Fatalf("expected a single range of 5 indexes, received %+v", acks)
+	}
+
+	acks.clear()
+	acks.addRange(5, 10)
+	acks.addRange(0, 2)
+	acks.addRange(8, 12)
+	if acks.len() != 9 || acks.firstMissing() != 2 || acks.contains(3) || !acks.contains(11) {
+		t.Fatalf("expected indexes 0-1 and 5-11 to be acknowledged, received %+v", acks.pairs())
+	}
+	acks.addRange(2, 5)
+	if len(acks.ranges) != 1 || acks.len() != 12 {
+		t.Fatalf("expected a single range of 12 indexes, received %+v", acks.pairs())
+	}
+}
+
+// Reports the memory held per session for a sequence of 0xffff numbers
+// with half of the numbers acknowledged.
+// "full-sequence" reproduces the layout sessions used before sequences
+// were derived from a seed, a slice of numbers and a slice of acknowledgements.
+func Benchmark_session_memory(b *testing.B) {
+	const length = 0xffff
+
+	b.Run("full-sequence", func(b *testing.B) {
+		type fullSession struct {
+			sequence     []uint32
+			acknowledged []bool
+		}
+		sessions := make([]*fullSession, 0, b.N)
+		reportMemoryPerSession(b, func() {
+			for i := 0; i < b.N; i++ {
+				session := &fullSession{
+					sequence:     make([]uint32, length),
+					acknowledged: make([]bool, length),
+				}
+				for index := 0; index < length/2; index++ {
+					session.acknowledged[index] = true
+				}
+				sessions = append(sessions, session)
+			}
+		})
+		runtime.KeepAlive(sessions)
+	})
+
+	b.Run("list", func(b *testing.B) {
+		benchmarkStoreMemory(b, func() sequence.Sequence {
+			return sequence.List(make([]uint32, length))
+		})
+	})
+
+	b.Run("seeded", func(b *testing.B) {
+		benchmarkStoreMemory(b, func() sequence.Sequence {
+			return sequence.Seeded(42, length, 0xffff)
+		})
+	})
+}
+
+func benchmarkStoreMemory(b *testing.B, createSequence func() sequence.Sequence) {
+	store := NewInMemoryStore(&InMemoryStoreParams{ExpireAfterIdleTime: 3600}, createLogger())
+	defer store.Close()
+
+	reportMemoryPerSession(b, func() {
+		for i := 0; i < b.N; i++ {
+			clientID := fmt.Sprintf("client-%d", i)
+			session, _ := store.Initialise(clientID, createSequence(), "")
+			for index := 0; index < session.Sequence.Len()/2; index++ {
+				store.Ack(clientID, index)
+			}
+		}
+	})
+}
+
+func reportMemoryPerSession(b *testing.B, createSessions func()) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+
+	createSessions()
+
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "B/session")
+}
+
+func assertSequence(t *testing.T, actual []uint32, expected []uint32) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected sequence %v, received %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected sequence %v, received %v", expected, actual)
+		}
+	}
+}
+
+func createLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	return logger
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"errors"
+)
+
+// EncodeSelectiveAcknowledgement encodes each range of received indexes as
+// the first and last index in the range (inclusive) as little-endian uint32s.
+func EncodeSelectiveAcknowledgement(ranges [][2]int) []byte {
+	message := make([]byte, 1, 1+8*len(ranges))
+	message[0] = SelectiveAcknowledgementPrefix
+	for _, r := range ranges {
+		message = append(message, Uint32ToByteArray([]uint32{uint32(r[0]), uint32(r[1])})...)
+	}
+	return message
+}
+
+// DecodeSelectiveAcknowledgement decodes the payload of a selective acknowledgement
+// without its prefix into ranges of received indexes, both ends of each range are inclusive.
+func DecodeSelectiveAcknowledgement(payload []byte) ([][2]int, error) {
+	if len(payload) < 8 || len(payload)%8 != 0 {
+		return nil, errors.New("selective acknowledgement must contain at least one range")
+	}
+
+	ranges := make([][2]int, 0, len(payload)/8)
+	for offset := 0; offset < len(payload); offset += 8 {
+		first := int(ByteArrayToSingleUint32(payload[offset : offset+4]))
+		last := int(ByteArrayToSingleUint32(payload[offset+4 : offset+8]))
+		if first > last {
+			return nil, errors.New("selective acknowledgement range must not end before it starts")
+		}
+		ranges = append(ranges, [2]int{first, last})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"errors"
+)
+
+// The batch settings in effect for a connection, the server sends a batch once it
+// holds BatchSize numbers or FlushInterval milliseconds after the first number
+// in the batch, whichever comes first.
+type BatchSettingsMessage struct {
+	BatchSize     int `json:"batchSize"`
+	FlushInterval int `json:"flushInterval"`
+}
+
+// EncodeNumberBatch encodes the index of the first number followed by
+// the numbers as little-endian uint32s.
+func EncodeNumberBatch(fromIndex int, numbers []uint32) []byte {
+	message := make([]byte, 1, 5+4*len(numbers))
+	message[0] = NumberBatchPrefix
+	message = append(message, Uint32ToByteArray([]uint32{uint32(fromIndex)})...)
+	return append(message, Uint32ToByteArray(numbers)...)
+}
+
+// DecodeNumberBatch decodes the payload of a batch without its prefix.
+func DecodeNumberBatch(payload []byte) (int, []uint32, error) {
+	if len(payload) < 8 || len(payload)%4 != 0 {
+		return 0, nil, errors.New("batch must contain an index and at least one number")
+	}
+
+	numbers := make([]uint32, 0, len(payload)/4-1)
+	for offset := 4; offset < len(payload); offset += 4 {
+		numbers = append(numbers, ByteArrayToSingleUint32(payload[offset:offset+4]))
+	}
+	return int(ByteArrayToSingleUint32(payload[:4])), numbers, nil
+}
@@ -2,14 +2,60 @@ package utils
 
 import (
 	"crypto/sha1"
+	"encoding"
 	"encoding/hex"
-	"encoding/json"
+	"hash"
+	"strconv"
 )
 
+// CreateChecksum creates a SHA1 checksum of the serialised JSON
+// array representation of the sequence.
 func CreateChecksum(sequence []uint32) string {
+	checksum := NewChecksum()
+	for _, number := range sequence {
+		checksum.Add(number)
+	}
+	return checksum.Sum()
+}
+
+// Checksum incrementally computes the same checksum as CreateChecksum
+// one number at a time, so the checksum of a sequence can be produced
+// without holding the whole sequence in memory.
+type Checksum struct {
+	hasher hash.Hash
+	count  int
+	buf    []byte
+}
+
+func NewChecksum() *Checksum {
 	hasher := sha1.New()
-	// todo: improve with explicit error handling.
-	bytes, _ := json.Marshal(sequence)
-	hasher.Write(bytes)
-	return hex.EncodeToString(hasher.Sum(nil))
+	hasher.Write([]byte{'['})
+	return &Checksum{hasher: hasher, buf: make([]byte, 0, 11)}
+}
+
+func (c *Checksum) Add(number uint32) {
+	c.buf = c.buf[:0]
+	if c.count > 0 {
+		c.buf = append(c.buf, ',')
+	}
+	c.buf = strconv.AppendUint(c.buf, uint64(number), 10)
+	c.hasher.Write(c.buf)
+	c.count += 1
+}
+
+// Sum produces the checksum of the numbers added so far,
+// more numbers can be added afterwards.
+func (c *Checksum) Sum() string {
+	// Close the JSON array on a copy of the hash state
+	// so the checksum can continue to be built on.
+	state, err := c.hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		// The SHA1 implementation in the standard library
+		// always supports marshalling its state.
+		panic(err)
+	}
+	closed := sha1.New()
+	closed.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	closed.Write([]byte{']'})
+	return hex.EncodeToString(closed.Sum(nil))
 }
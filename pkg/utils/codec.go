@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Versions of the protocol negotiated through the WebSocket subprotocol.
+const (
+	// Numbers are sent without their index and the final number carries
+	// its checksum as JSON, this is used for clients that do not request a subprotocol.
+	SubprotocolV1 = "numseq.v1"
+	// Every number carries its index and the final number carries
+	// its checksum as raw bytes.
+	SubprotocolV2 = "numseq.v2"
+)
+
+// Subprotocols supported by this implementation in order of preference.
+var Subprotocols = []string{SubprotocolV2, SubprotocolV1}
+
+// Codec encodes and decodes the messages that carry numbers in a sequence
+// for a version of the protocol, all other messages share the same format
+// across versions.
+type Codec interface {
+	Subprotocol() string
+	EncodeNumber(index int, number uint32) []byte
+	EncodeLastNumber(index int, number uint32, checksum string) ([]byte, error)
+	EncodeRetransmission(index int, number uint32) []byte
+	// Decodes the payload of a number message without its prefix,
+	// the index is -1 for versions that do not send the index.
+	DecodeNumber(payload []byte) (int, uint32, error)
+	// Decodes the payload of a last number message without its prefix,
+	// the index is -1 for versions that do not send the index.
+	DecodeLastNumber(payload []byte) (int, *SequenceFinalMessage, error)
+	DecodeRetransmission(payload []byte) (int, uint32, error)
+}
+
+// CodecForSubprotocol provides the codec for a negotiated subprotocol,
+// connections without a subprotocol use the first version of the protocol.
+func CodecForSubprotocol(subprotocol string) (Codec, bool) {
+	switch subprotocol {
+	case SubprotocolV1, "":
+		return v1Codec{}, true
+	case SubprotocolV2:
+		return v2Codec{}, true
+	default:
+		return nil, false
+	}
+}
+
+// NumbersCarryIndex reports whether numbers encoded with the codec carry their index,
+// numbers without an index are placed by the client after the previous number
+// sent over the same connection.
+func NumbersCarryIndex(codec Codec) bool {
+	return codec.Subprotocol() != SubprotocolV1
+}
+
+var errMessageTooShort = errors.New("message is too short")
+
+type v1Codec struct{}
+
+func (c v1Codec) Subprotocol() string {
+	return SubprotocolV1
+}
+
+func (c v1Codec) EncodeNumber(index int, number uint32) []byte {
+	return append([]byte{NumberInSequencePrefix}, Uint32ToByteArray([]uint32{number})...)
+}
+
+func (c v1Codec) EncodeLastNumber(index int, number uint32, checksum string) ([]byte, error) {
+	finalMessage := SequenceFinalMessage{
+		Number:   number,
+		Checksum: checksum,
+	}
+	messageBytes, err := json.Marshal(&finalMessage)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{LastNumberInSequencePrefix}, messageBytes...), nil
+}
+
+func (c v1Codec) EncodeRetransmission(index int, number uint32) []byte {
+	return append(
+		[]byte{RetransmittedNumberInSequencePrefix},
+		Uint32ToByteArray([]uint32{uint32(index), number})...,
+	)
+}
+
+func (c v1Codec) DecodeNumber(payload []byte) (int, uint32, error) {
+	if len(payload) < 4 {
+		return 0, 0, errMessageTooShort
+	}
+	return -1, ByteArrayToSingleUint32(payload), nil
+}
+
+func (c v1Codec) DecodeLastNumber(payload []byte) (int, *SequenceFinalMessage, error) {
+	finalMessage := &SequenceFinalMessage{}
+	err := json.Unmarshal(payload, finalMessage)
+	if err != nil {
+		return 0, nil, err
+	}
+	return -1, finalMessage, nil
+}
+
+func (c v1Codec) DecodeRetransmission(payload []byte) (int, uint32, error) {
+	if len(payload) < 8 {
+		return 0, 0, errMessageTooShort
+	}
+	return int(ByteArrayToSingleUint32(payload[:4])), ByteArrayToSingleUint32(payload[4:8]), nil
+}
+
+// The size of a SHA1 checksum in bytes.
+const checksumSize = 20
+
+// Retransmissions share the format of the first version.
+type v2Codec struct {
+	v1Codec
+}
+
+func (c v2Codec) Subprotocol() string {
+	return SubprotocolV2
+}
+
+func (c v2Codec) EncodeNumber(index int, number uint32) []byte {
+	return append([]byte{NumberInSequencePrefix}, Uint32ToByteArray([]uint32{uint32(index), number})...)
+}
+
+func (c v2Codec) EncodeLastNumber(index int, number uint32, checksum string) ([]byte, error) {
+	checksumBytes, err := hex.DecodeString(checksum)
+	if err != nil {
+		return nil, err
+	}
+	if len(checksumBytes) != checksumSize {
+		return nil, fmt.Errorf("expected a %d byte checksum, received %d bytes", checksumSize, len(checksumBytes))
+	}
+	message := append([]byte{LastNumberInSequencePrefix}, Uint32ToByteArray([]uint32{uint32(index), number})...)
+	return append(message, checksumBytes...), nil
+}
+
+func (c v2Codec) DecodeNumber(payload []byte) (int, uint32, error) {
+	return c.DecodeRetransmission(payload)
+}
+
+func (c v2Codec) DecodeLastNumber(payload []byte) (int, *SequenceFinalMessage, error) {
+	if len(payload) < 8+checksumSize {
+		return 0, nil, errMessageTooShort
+	}
+	return int(ByteArrayToSingleUint32(payload[:4])), &SequenceFinalMessage{
+		Number:   ByteArrayToSingleUint32(payload[4:8]),
+		Checksum: hex.EncodeToString(payload[8 : 8+checksumSize]),
+	}, nil
+}
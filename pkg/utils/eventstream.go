@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Names of the events sent over the Server-Sent Events transport,
+// each event carries one server message in the format of the second
+// version of the protocol.
+const (
+	EventNumber         = "number"
+	EventLastNumber     = "last"
+	EventRetransmission = "retransmit"
+	EventHandshake      = "handshake"
+	EventCheckpoint     = "checkpoint"
+	EventFlowSettings   = "flow"
+	// Sent in place of a WebSocket close frame,
+	// the server ends the stream after a close event.
+	EventClose = "close"
+)
+
+// Event is a single event in a text/event-stream response.
+type Event struct {
+	// Only set for numbers sent for the first time and the final number
+	// so the last event ID held by a client is always the index of the
+	// last number it received in order.
+	ID   string
+	Name string
+	Data string
+}
+
+// Bytes formats the event as it is written to the stream.
+func (e Event) Bytes() []byte {
+	var buf bytes.Buffer
+	if e.ID != "" {
+		fmt.Fprintf(&buf, "id: %s\n", e.ID)
+	}
+	fmt.Fprintf(&buf, "event: %s\n", e.Name)
+	for _, line := range strings.Split(e.Data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// The data of a retransmission event.
+type EventStreamNumber struct {
+	Index  int    `json:"index"`
+	Number uint32 `json:"number"`
+}
+
+// The data of a close event.
+type EventStreamClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+var eventStreamCodec = v2Codec{}
+
+// EventStreamCodec provides the codec for messages translated
+// to and from events on the Server-Sent Events transport.
+func EventStreamCodec() Codec {
+	return eventStreamCodec
+}
+
+// MessageToEvent translates a server message encoded with the
+// event stream codec into the event that carries it.
+func MessageToEvent(message []byte) (Event, error) {
+	if len(message) == 0 {
+		return Event{}, errMessageTooShort
+	}
+
+	payload := message[1:]
+	switch message[0] {
+	case NumberInSequencePrefix:
+		index, number, err := eventStreamCodec.DecodeNumber(payload)
+		if err != nil {
+			return Event{}, err
+		}
+		return Event{
+			ID:   strconv.Itoa(index),
+			Name: EventNumber,
+			Data: strconv.FormatUint(uint64(number), 10),
+		}, nil
+	case LastNumberInSequencePrefix:
+		index, finalMessage, err := eventStreamCodec.DecodeLastNumber(payload)
+		if err != nil {
+			return Event{}, err
+		}
+		return jsonEvent(strconv.Itoa(index), EventLastNumber, finalMessage)
+	case RetransmittedNumberInSequencePrefix:
+		index, number, err := eventStreamCodec.DecodeRetransmission(payload)
+		if err != nil {
+			return Event{}, err
+		}
+		return jsonEvent("", EventRetransmission, &EventStreamNumber{Index: index, Number: number})
+	case SequenceHandshakePrefix:
+		return Event{Name: EventHandshake, Data: string(payload)}, nil
+	case SequenceCheckpointPrefix:
+		return Event{Name: EventCheckpoint, Data: string(payload)}, nil
+	case FlowSettingsPrefix:
+		return Event{Name: EventFlowSettings, Data: string(payload)}, nil
+	default:
+		return Event{}, fmt.Errorf("message with prefix 0x%x can not be sent as an event", message[0])
+	}
+}
+
+// CloseEvent creates the event that tells the client
+// why the stream is being closed.
+func CloseEvent(code int, reason string) (Event, error) {
+	return jsonEvent("", EventClose, &EventStreamClose{Code: code, Reason: reason})
+}
+
+// EventToMessage translates an event back into the server message it carries
+// in the format of the event stream codec, close events are not messages
+// and must be handled by the caller.
+func EventToMessage(event Event) ([]byte, error) {
+	switch event.Name {
+	case EventNumber:
+		index, err := strconv.Atoi(event.ID)
+		if err != nil {
+			return nil, err
+		}
+		number, err := strconv.ParseUint(event.Data, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return eventStreamCodec.EncodeNumber(index, uint32(number)), nil
+	case EventLastNumber:
+		index, err := strconv.Atoi(event.ID)
+		if err != nil {
+			return nil, err
+		}
+		finalMessage := &SequenceFinalMessage{}
+		err = json.Unmarshal([]byte(event.Data), finalMessage)
+		if err != nil {
+			return nil, err
+		}
+		return eventStreamCodec.EncodeLastNumber(index, finalMessage.Number, finalMessage.Checksum)
+	case EventRetransmission:
+		retransmitted := &EventStreamNumber{}
+		err := json.Unmarshal([]byte(event.Data), retransmitted)
+		if err != nil {
+			return nil, err
+		}
+		return eventStreamCodec.EncodeRetransmission(retransmitted.Index, retransmitted.Number), nil
+	case EventHandshake:
+		return append([]byte{SequenceHandshakePrefix}, event.Data...), nil
+	case EventCheckpoint:
+		return append([]byte{SequenceCheckpointPrefix}, event.Data...), nil
+	case EventFlowSettings:
+		return append([]byte{FlowSettingsPrefix}, event.Data...), nil
+	default:
+		return nil, fmt.Errorf("unknown event %q", event.Name)
+	}
+}
+
+// ReadEvent reads the next event from a text/event-stream,
+// comments and fields other than id, event and data are skipped.
+func ReadEvent(reader *bufio.Reader) (Event, error) {
+	event := Event{}
+	dataLines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return Event{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if event.Name == "" && len(dataLines) == 0 {
+				// A blank line after a comment or another blank line.
+				continue
+			}
+			event.Data = strings.Join(dataLines, "\n")
+			return event, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			event.ID = value
+		case "event":
+			event.Name = value
+		case "data":
+			dataLines = append(dataLines, value)
+		}
+	}
+}
+
+func jsonEvent(id string, name string, data interface{}) (Event, error) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{ID: id, Name: name, Data: string(dataBytes)}, nil
+}
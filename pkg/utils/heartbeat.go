@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Heartbeat configuration shared by the server and client,
+// both values are in milliseconds.
+type HeartbeatParams struct {
+	// How often to send a ping to the peer, heartbeats are disabled when this is 0.
+	PingInterval int
+	// How long to wait for any message, ping or pong from the peer before
+	// considering it dead, this should be greater than the ping interval.
+	PongTimeout int
+}
+
+func (p *HeartbeatParams) Enabled() bool {
+	return p != nil && p.PingInterval > 0
+}
+
+// StartHeartbeat sends pings to the peer at the configured interval until the
+// context is done and sets a read deadline on the connection that is extended
+// whenever a ping or pong is received.
+// Callers should call ExtendReadDeadline for every message read from the connection.
+// Once the deadline passes, reads from the connection fail so a silent peer is
+// detected even when the underlying TCP connection is half-open.
+func StartHeartbeat(ctx context.Context, conn *websocket.Conn, params *HeartbeatParams) {
+	if !params.Enabled() {
+		return
+	}
+
+	ExtendReadDeadline(conn, params)
+	conn.SetPongHandler(func(string) error {
+		ExtendReadDeadline(conn, params)
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		ExtendReadDeadline(conn, params)
+		// Mirror the default ping handler, failing to send a pong
+		// is not a reason to stop reading from the connection.
+		conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(params.PingInterval) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func ExtendReadDeadline(conn *websocket.Conn, params *HeartbeatParams) {
+	if !params.Enabled() {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Duration(params.PongTimeout) * time.Millisecond))
+}
@@ -0,0 +1,23 @@
+package utils
+
+// The response to a long poll, numbers are contiguous from FromIndex.
+type PollResponse struct {
+	// Only provided in the response to the poll that created the session.
+	Handshake *SequenceHandshakeMessage `json:"handshake,omitempty"`
+	FromIndex int                       `json:"fromIndex"`
+	Numbers   []uint32                  `json:"numbers"`
+	// Checkpoints for blocks of numbers that end in this batch.
+	Checkpoints []SequenceCheckpointMessage `json:"checkpoints,omitempty"`
+	// The checksum of the full sequence, only provided in the batch
+	// that contains the final number.
+	Checksum string `json:"checksum,omitempty"`
+	// Set once every number in the sequence has been acknowledged.
+	Complete bool `json:"complete"`
+}
+
+// The body of an unsuccessful long poll, the code is
+// the close code a WebSocket connection would be closed with.
+type PollError struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
@@ -7,6 +7,17 @@ const (
 	CloseCodeMissingClientID      int = 4002
 	CloseCodeInvalidSequenceCount int = 4003
 	CloseCodeInvalidLastReceived  int = 4004
+	CloseCodeInvalidGenerator     int = 4005
+	// None of the subprotocols requested by the client are supported by the server.
+	CloseCodeUnsupportedProtocolVersion int = 4006
+	// The requested batch size or flush interval is not a valid integer.
+	CloseCodeInvalidBatchSettings int = 4007
+	// Another connection is already being served for the client ID.
+	CloseCodeSessionInUse int = 4008
+	// A newer connection for the client ID has taken over the session.
+	CloseCodeSessionTakenOver int = 4009
+	// The client token is missing or was not signed for the client ID by the server.
+	CloseCodeUnauthorized int = 4010
 )
 
 // Message prefixes.
@@ -14,25 +25,112 @@ const (
 	NumberInSequencePrefix     uint8 = 0x1
 	AcknowledgementPrefix      uint8 = 0x2
 	LastNumberInSequencePrefix uint8 = 0x3
+	// A number resent by the server as it was not acknowledged in time,
+	// followed by the index of the number and the number itself.
+	RetransmittedNumberInSequencePrefix uint8 = 0x4
+	// Sent by the server before the first number on the connection
+	// that creates a session, describing how the sequence was generated.
+	SequenceHandshakePrefix uint8 = 0x5
+	// Sent by the server after every configured number of numbers with the checksum
+	// of the numbers since the previous checkpoint.
+	SequenceCheckpointPrefix uint8 = 0x6
+	// Sent by the client to stop the sequence, followed by the index
+	// of the last number the client has received or NoIndex.
+	StopSequencePrefix uint8 = 0x7
+	// Only used over raw TCP connections where there are no query string parameters,
+	// close frames or control frames, see TCPConn.
+	// The first frame sent by the client identifying the session to create or resume.
+	TCPHandshakePrefix uint8 = 0x8
+	// Sent by the server in place of a WebSocket close frame,
+	// followed by the close code and reason.
+	TCPErrorPrefix uint8 = 0x9
+	TCPPingPrefix  uint8 = 0xa
+	TCPPongPrefix  uint8 = 0xb
+	// Sent by the server in place of individual numbers when the client has requested
+	// batching, followed by the index of the first number and the numbers themselves.
+	NumberBatchPrefix uint8 = 0xc
+	// Sent by the client to acknowledge every number up to and including the index
+	// that follows.
+	CumulativeAcknowledgementPrefix uint8 = 0xd
+	// Sent by the server before any numbers to confirm the batch settings
+	// for the connection.
+	BatchSettingsPrefix uint8 = 0xe
+	// Sent by the client to acknowledge the numbers it holds after a gap, followed
+	// by pairs of the first and last index of each range of received numbers.
+	SelectiveAcknowledgementPrefix uint8 = 0xf
+	// Sent by the client to pause delivery of new numbers until it resumes delivery.
+	PauseSequencePrefix  uint8 = 0x10
+	ResumeSequencePrefix uint8 = 0x11
+	// Sent by the client to change the pace of delivery, followed by the
+	// requested number of milliseconds between numbers.
+	SetRatePrefix uint8 = 0x12
+	// Sent by the server whenever the client pauses, resumes or changes the pace
+	// of delivery, confirming the settings in effect for the connection.
+	FlowSettingsPrefix uint8 = 0x13
 )
 
+// Used in place of an index when the client has not received any numbers.
+const NoIndex uint32 = 0xffffffff
+
 type SequenceFinalMessage struct {
 	Number   uint32 `json:"number"`
 	Checksum string `json:"checksum"`
 }
 
+// Covers the numbers from FromIndex to ToIndex inclusive,
+// the checksum is created the same way as the checksum of a full sequence.
+type SequenceCheckpointMessage struct {
+	FromIndex int    `json:"fromIndex"`
+	ToIndex   int    `json:"toIndex"`
+	Checksum  string `json:"checksum"`
+}
+
+// The pace of delivery in effect for a connection, the server may
+// have adjusted the interval requested by the client to be within its bounds.
+type FlowSettingsMessage struct {
+	Paused          bool `json:"paused"`
+	MessageInterval int  `json:"messageInterval"`
+}
+
+type SequenceHandshakeMessage struct {
+	Generator string `json:"generator"`
+	// Only provided for generators that can reproduce
+	// a sequence from a seed.
+	Seed *int64 `json:"seed,omitempty"`
+	// Only provided when the server requires clients to authenticate
+	// with a token to resume their session.
+	Token string `json:"token,omitempty"`
+}
+
+// TokenResponse is the body of a response from the token issuing endpoint.
+type TokenResponse struct {
+	Token string `json:"token"`
+}
+
 func IsKnownClientErrorCode(code int) bool {
 	return code == CloseCodeExpiredSession ||
 		code == CloseCodeMissingClientID ||
 		code == CloseCodeInvalidSequenceCount ||
-		code == CloseCodeInvalidLastReceived
+		code == CloseCodeInvalidLastReceived ||
+		code == CloseCodeInvalidGenerator ||
+		code == CloseCodeUnsupportedProtocolVersion ||
+		code == CloseCodeInvalidBatchSettings ||
+		code == CloseCodeSessionInUse ||
+		code == CloseCodeSessionTakenOver ||
+		code == CloseCodeUnauthorized
 }
 
 var codeNameMap = map[int]string{
-	CloseCodeExpiredSession:       "CloseCodeExpiredSession",
-	CloseCodeMissingClientID:      "CloseCodeMissingClientID",
-	CloseCodeInvalidSequenceCount: "CloseCodeInvalidSequenceCount",
-	CloseCodeInvalidLastReceived:  "CloseCodeInvalidLastReceived",
+	CloseCodeExpiredSession:             "CloseCodeExpiredSession",
+	CloseCodeMissingClientID:            "CloseCodeMissingClientID",
+	CloseCodeInvalidSequenceCount:       "CloseCodeInvalidSequenceCount",
+	CloseCodeInvalidLastReceived:        "CloseCodeInvalidLastReceived",
+	CloseCodeInvalidGenerator:           "CloseCodeInvalidGenerator",
+	CloseCodeUnsupportedProtocolVersion: "CloseCodeUnsupportedProtocolVersion",
+	CloseCodeInvalidBatchSettings:       "CloseCodeInvalidBatchSettings",
+	CloseCodeSessionInUse:               "CloseCodeSessionInUse",
+	CloseCodeSessionTakenOver:           "CloseCodeSessionTakenOver",
+	CloseCodeUnauthorized:               "CloseCodeUnauthorized",
 }
 
 func CloseCodeName(code int) string {
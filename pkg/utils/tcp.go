@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The largest frame accepted from a peer, frames are small
+// so anything larger means the stream is corrupt.
+const MaxTCPFrameSize = 1 << 20
+
+// Flags in the handshake frame.
+const (
+	tcpHandshakeHasSequenceCount uint8 = 0x1
+	tcpHandshakeInfinite         uint8 = 0x2
+)
+
+var ErrInvalidTCPFrameLength = errors.New("frame is empty or exceeds the maximum frame size")
+
+// WriteFrame writes a message prefixed with its length as
+// a little-endian uint32.
+func WriteFrame(w io.Writer, message []byte) error {
+	frame := make([]byte, 4+len(message))
+	binary.LittleEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[4:], message)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads the next length-prefixed message, empty frames are
+// rejected as every message starts with a prefix.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	_, err := io.ReadFull(r, lengthBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(lengthBytes)
+	if length == 0 || length > MaxTCPFrameSize {
+		return nil, ErrInvalidTCPFrameLength
+	}
+	message := make([]byte, length)
+	_, err = io.ReadFull(r, message)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// The binary equivalent of the query string parameters used to connect
+// over the other transports.
+type TCPHandshake struct {
+	ClientID string
+	// Ignored when Infinite is set, the server picks a random
+	// sequence count when neither is set.
+	SequenceCount    uint32
+	HasSequenceCount bool
+	Infinite         bool
+	// NoIndex when the client has not received any numbers.
+	LastReceived uint32
+	// Optional, the server's default generator is used when empty.
+	Generator string
+	// Optional, numbers are sent individually when the batch size is 0.
+	BatchSize     uint32
+	BatchInterval uint32
+	// Optional, the token authenticating the client as the owner of the session.
+	Token string
+}
+
+// TCPHandshakeFromQuery creates a handshake from the query string parameters
+// a client would connect with over the other transports.
+func TCPHandshakeFromQuery(query url.Values, lastReceived string) (*TCPHandshake, error) {
+	handshake := &TCPHandshake{
+		ClientID:     query.Get("clientId"),
+		LastReceived: NoIndex,
+		Generator:    query.Get("generator"),
+		Token:        query.Get("token"),
+	}
+
+	sequenceCount := query.Get("sequenceCount")
+	if sequenceCount == "infinite" {
+		handshake.Infinite = true
+	} else if sequenceCount != "" {
+		count, err := strconv.ParseUint(sequenceCount, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		handshake.SequenceCount = uint32(count)
+		handshake.HasSequenceCount = true
+	}
+
+	if lastReceived != "" {
+		index, err := strconv.ParseUint(lastReceived, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		handshake.LastReceived = uint32(index)
+	}
+
+	if batchSize := query.Get("batchSize"); batchSize != "" {
+		size, err := strconv.ParseUint(batchSize, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		handshake.BatchSize = uint32(size)
+	}
+	if batchInterval := query.Get("batchInterval"); batchInterval != "" {
+		interval, err := strconv.ParseUint(batchInterval, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		handshake.BatchInterval = uint32(interval)
+	}
+	return handshake, nil
+}
+
+// Query converts the handshake into the query string parameters
+// and last received index the other transports connect with.
+func (h *TCPHandshake) Query() (url.Values, string) {
+	query := url.Values{"clientId": {h.ClientID}}
+	if h.Infinite {
+		query.Set("sequenceCount", "infinite")
+	} else if h.HasSequenceCount {
+		query.Set("sequenceCount", strconv.FormatUint(uint64(h.SequenceCount), 10))
+	}
+	if h.Generator != "" {
+		query.Set("generator", h.Generator)
+	}
+	if h.BatchSize > 0 {
+		query.Set("batchSize", strconv.FormatUint(uint64(h.BatchSize), 10))
+		query.Set("batchInterval", strconv.FormatUint(uint64(h.BatchInterval), 10))
+	}
+	if h.Token != "" {
+		query.Set("token", h.Token)
+	}
+
+	lastReceived := ""
+	if h.LastReceived != NoIndex {
+		lastReceived = strconv.FormatUint(uint64(h.LastReceived), 10)
+	}
+	return query, lastReceived
+}
+
+// EncodeTCPHandshake encodes the handshake as the prefix, a flags byte,
+// the sequence count and last received index as little-endian uint32s
+// followed by the client ID and generator name, each prefixed with their length in a byte,
+// then the batch size and flush interval as little-endian uint32s and finally
+// the token prefixed with its length in a byte, which is left out when there is no token.
+func EncodeTCPHandshake(handshake *TCPHandshake) ([]byte, error) {
+	if len(handshake.ClientID) > 0xff || len(handshake.Generator) > 0xff || len(handshake.Token) > 0xff {
+		return nil, errors.New("client ID, generator and token must be at most 255 bytes")
+	}
+
+	flags := uint8(0)
+	if handshake.HasSequenceCount {
+		flags |= tcpHandshakeHasSequenceCount
+	}
+	if handshake.Infinite {
+		flags |= tcpHandshakeInfinite
+	}
+
+	message := []byte{TCPHandshakePrefix, flags}
+	message = append(message, Uint32ToByteArray([]uint32{handshake.SequenceCount, handshake.LastReceived})...)
+	message = append(message, uint8(len(handshake.ClientID)))
+	message = append(message, handshake.ClientID...)
+	message = append(message, uint8(len(handshake.Generator)))
+	message = append(message, handshake.Generator...)
+	message = append(message, Uint32ToByteArray([]uint32{handshake.BatchSize, handshake.BatchInterval})...)
+	if handshake.Token != "" {
+		message = append(message, uint8(len(handshake.Token)))
+		message = append(message, handshake.Token...)
+	}
+	return message, nil
+}
+
+func DecodeTCPHandshake(message []byte) (*TCPHandshake, error) {
+	if len(message) < 11 || message[0] != TCPHandshakePrefix {
+		return nil, errors.New("expected a handshake frame")
+	}
+
+	flags := message[1]
+	handshake := &TCPHandshake{
+		SequenceCount:    binary.LittleEndian.Uint32(message[2:6]),
+		HasSequenceCount: flags&tcpHandshakeHasSequenceCount != 0,
+		Infinite:         flags&tcpHandshakeInfinite != 0,
+		LastReceived:     binary.LittleEndian.Uint32(message[6:10]),
+	}
+
+	rest := message[10:]
+	clientIDLength := int(rest[0])
+	if len(rest) < 1+clientIDLength+1 {
+		return nil, errors.New("handshake frame is truncated")
+	}
+	handshake.ClientID = string(rest[1 : 1+clientIDLength])
+
+	rest = rest[1+clientIDLength:]
+	generatorLength := int(rest[0])
+	if len(rest) < 1+generatorLength+8 {
+		return nil, errors.New("handshake frame has an invalid generator length")
+	}
+	handshake.Generator = string(rest[1 : 1+generatorLength])
+
+	rest = rest[1+generatorLength:]
+	handshake.BatchSize = binary.LittleEndian.Uint32(rest[:4])
+	handshake.BatchInterval = binary.LittleEndian.Uint32(rest[4:8])
+
+	rest = rest[8:]
+	if len(rest) == 0 {
+		return handshake, nil
+	}
+	if len(rest) != 1+int(rest[0]) {
+		return nil, errors.New("handshake frame has an invalid token length")
+	}
+	handshake.Token = string(rest[1:])
+	return handshake, nil
+}
+
+// EncodeTCPError encodes a close code as a little-endian uint16
+// followed by the reason.
+func EncodeTCPError(code int, reason string) []byte {
+	message := make([]byte, 3, 3+len(reason))
+	message[0] = TCPErrorPrefix
+	binary.LittleEndian.PutUint16(message[1:], uint16(code))
+	return append(message, reason...)
+}
+
+func DecodeTCPError(message []byte) (int, string, error) {
+	if len(message) < 3 || message[0] != TCPErrorPrefix {
+		return 0, "", errors.New("expected an error frame")
+	}
+	return int(binary.LittleEndian.Uint16(message[1:3])), string(message[3:]), nil
+}
+
+// TCPConn exchanges length-prefixed frames over a TCP connection,
+// pings and pongs are handled by the connection and never returned from ReadMessage.
+type TCPConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+	// Set once heartbeats have started.
+	heartbeat *HeartbeatParams
+}
+
+func NewTCPConn(conn net.Conn) *TCPConn {
+	return &TCPConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// WriteMessage is safe to call concurrently.
+func (c *TCPConn) WriteMessage(message []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// This deadline could be made configurable.
+	c.conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	return WriteFrame(c.conn, message)
+}
+
+func (c *TCPConn) ReadMessage() ([]byte, error) {
+	for {
+		message, err := ReadFrame(c.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		switch message[0] {
+		case TCPPingPrefix:
+			c.ExtendReadDeadline(c.heartbeatParams())
+			// Mirror WebSocket ping handling, failing to send a pong
+			// is not a reason to stop reading from the connection.
+			c.WriteMessage([]byte{TCPPongPrefix})
+		case TCPPongPrefix:
+			c.ExtendReadDeadline(c.heartbeatParams())
+		default:
+			return message, nil
+		}
+	}
+}
+
+// SetReadDeadline bounds the wait for the next frame before heartbeats
+// have started, such as for the handshake.
+func (c *TCPConn) SetReadDeadline(deadline time.Time) error {
+	return c.conn.SetReadDeadline(deadline)
+}
+
+func (c *TCPConn) Close() error {
+	return c.conn.Close()
+}
+
+// StartHeartbeat works in the same way as StartHeartbeat for WebSocket connections
+// with ping and pong frames in place of control frames.
+func (c *TCPConn) StartHeartbeat(ctx context.Context, params *HeartbeatParams) {
+	if !params.Enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	c.heartbeat = params
+	c.mu.Unlock()
+	c.ExtendReadDeadline(params)
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(params.PingInterval) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := c.WriteMessage([]byte{TCPPingPrefix})
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (c *TCPConn) ExtendReadDeadline(params *HeartbeatParams) {
+	if !params.Enabled() {
+		return
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(params.PongTimeout) * time.Millisecond))
+}
+
+func (c *TCPConn) heartbeatParams() *HeartbeatParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.heartbeat
+}